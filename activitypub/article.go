@@ -0,0 +1,28 @@
+package activitypub
+
+import (
+	"time"
+)
+
+// Source is the markup an object's content was rendered from.
+type Source struct {
+	Content   string `json:"content"`
+	MediaType string `json:"mediaType"`
+}
+
+// An Article is the representation of a wiki page.
+type Article struct {
+	BaseProperties
+	Name         string     `json:"name"`
+	Summary      string     `json:"summary,omitempty"`
+	Content      string     `json:"content"`
+	MediaType    string     `json:"mediaType,omitempty"`
+	Source       *Source    `json:"source,omitempty"`
+	Url          string     `json:"url,omitempty"`
+	AttributedTo string     `json:"attributedTo"`
+	Published    *time.Time `json:"published,omitempty"`
+	Updated      *time.Time `json:"updated,omitempty"`
+
+	Likes  *Collection `json:"likes,omitempty"`
+	Shares *Collection `json:"shares,omitempty"`
+}
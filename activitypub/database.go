@@ -1,23 +1,107 @@
 package activitypub
 
-import (
-	"sync"
-)
+import "time"
+
+// A Block prevents a remote domain or actor from interacting with the
+// wiki. Exactly one of Domain or Actor is set.
+type Block struct {
+	Domain string
+	Actor  string
+	Reason string
+}
+
+type BlockList interface {
+	Block(block Block) error
+	// Unblock removes the block of a domain or actor id.
+	Unblock(target string) error
+	GetBlocks() ([]Block, error)
+	// IsBlocked returns true if the actor or its domain is blocked.
+	IsBlocked(actorid string) bool
+	// IsDomainBlocked returns true if the domain or any domain it's a
+	// subdomain of is blocked.
+	IsDomainBlocked(domain string) bool
+}
+
+// A Report is a Flag received from another server for the admins to
+// look at. ResolvedBy is the admin who dealt with it, if anyone has.
+type Report struct {
+	Flag       Flag
+	Received   time.Time
+	ResolvedBy string
+}
 
 type ActivityDatabase interface {
-	SendUnprocessedObjects(obstream chan Object, wg *sync.WaitGroup) chan string
+	BlockList
+
+	// QueueObject records that an inbound activity has been received
+	// and needs to be processed. The object itself must already have
+	// been saved to the ObjectDatabase.
+	QueueObject(Object) error
+	// UnprocessedObjects returns the queued activities which haven't
+	// been processed successfully, excluding ones which have failed
+	// maxattempts times or more. If maxattempts is 0 every unprocessed
+	// activity is returned.
+	UnprocessedObjects(maxattempts int) ([]Object, error)
+	// IsQueued returns true if the activity with the given id has been
+	// queued, whether or not it's been processed.
+	IsQueued(id string) bool
+	MarkProcessed(id string) error
+	// MarkFailed records a failed attempt at processing the activity
+	// and returns the number of times it has failed.
+	MarkFailed(id string, reason error) (int, error)
 
 	AddFollower(pagename string, request Follow) error
-	UndoFollow(pagename string, request Undo) error
+	// RemoveFollower removes the actor from the followers of every
+	// page, because of the given activity (such as a Delete).
+	RemoveFollower(actor string, activity BaseProperties) error
+	// MoveFollower transfers every page which the from actor follows
+	// to the to actor.
+	MoveFollower(from, to string, move BaseProperties) error
+	// UndoActivity records that the original activity has been undone
+	// by its actor.
+	UndoActivity(original BaseProperties, request Undo) error
 
 	AddPageNote(pagename string, request Note) error
+	// AddReaction records a Like or Announce of the object with the
+	// given id.
+	AddReaction(object string, activity BaseProperties) error
+	// GetReactions returns the Like or Announce activities of the
+	// object which haven't been undone.
+	GetReactions(object, activitytype string) ([]BaseProperties, error)
+
+	// AddReport adds a Flag to the moderation queue. The Flag must
+	// already have been saved as an object.
+	AddReport(flag Flag) error
+	// GetReports returns every report, including resolved ones, oldest
+	// first.
+	GetReports() ([]Report, error)
+	ResolveReport(id, admin string) error
+
+	// GetNote returns a note which was added to a page's talk page,
+	// or an error if it doesn't exist.
+	GetNote(id string) (*Note, error)
+	// UpdateNote replaces the stored copy of a note.
+	UpdateNote(note Note) error
+	// DeleteNote replaces a note with a Tombstone, which keeps its
+	// place in the thread so that replies to it are still displayed.
+	DeleteNote(id string) error
 }
 
 type ActorDatabase interface {
 	GetForeignActor(url string) (*Actor, error)
+	// StoreActor caches a foreign actor, replacing any older copy.
 	StoreActor(actor Actor, rawobject []byte) error
+	// IsActorStale returns true if the cached copy of the actor is
+	// missing or old enough that it should be fetched again.
+	IsActorStale(url string) bool
+	RemoveActor(url string) error
 }
 
 type ObjectDatabase interface {
 	SaveObject(Object) error
+	// UpdateObject replaces the stored copy of an object, saving it if
+	// it isn't stored yet.
+	UpdateObject(Object) error
+	HasObject(id string) bool
+	GetObject(id string) (*Object, error)
 }
@@ -12,26 +12,17 @@ type JSONLDContext []interface{}
 func (c JSONLDContext) MarshalJSON() ([]byte, error) {
 	switch len(c) {
 	case 0:
-		return nil, nil
+		return []byte("null"), nil
 	case 1:
 		return json.Marshal(c[0])
 	default:
-		var r []string
-		for _, val := range c {
-			switch s := val.(type) {
-			case string:
-				r = append(r, s)
-			default:
-				return nil, fmt.Errorf("Unhandle context type")
-			}
-		}
-		return json.Marshal(r)
+		return json.Marshal([]interface{}(c))
 	}
 }
 
 func (c *JSONLDContext) UnmarshalJSON(b []byte) error {
 	trimmed := bytes.TrimSpace(b)
-	if trimmed == nil || len(trimmed) == 0 {
+	if trimmed == nil || len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) {
 		*c = nil
 		return nil
 	}
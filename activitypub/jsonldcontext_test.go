@@ -63,6 +63,28 @@ func TestJSONLDContextUnmarshalJSON(t *testing.T) {
 	}
 }
 
+func TestJSONLDContextMarshalJSON(t *testing.T) {
+	tests := []struct {
+		Input JSONLDContext
+		Want  string
+	}{
+		{JSONLDContext{}, `null`},
+		{JSONLDContext{"foo"}, `"foo"`},
+		{JSONLDContext{"foo", "bar"}, `["foo","bar"]`},
+		{JSONLDContext{"foo", map[string]interface{}{"foo": "bar"}}, `["foo",{"foo":"bar"}]`},
+	}
+	for _, tc := range tests {
+		result, err := json.Marshal(tc.Input)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(result) != tc.Want {
+			t.Errorf("Unexpected result. Want %v got %v", tc.Want, string(result))
+		}
+	}
+}
+
 /*
 type JSONLDContext []interface{}
 
@@ -1,9 +1,45 @@
 package activitypub
 
 import (
+	"bytes"
+	"encoding/json"
 	"time"
 )
 
+// A Tag links to an object referenced in a note's content, such as the
+// actor of a Mention.
+type Tag struct {
+	Type string `json:"type"`
+	Href string `json:"href,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// Tags is a list of tags, which may also be given as a single tag when
+// there's only one.
+type Tags []Tag
+
+func (t *Tags) UnmarshalJSON(b []byte) error {
+	trimmed := bytes.TrimSpace(b)
+	if bytes.Equal(trimmed, []byte("null")) {
+		*t = nil
+		return nil
+	}
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var tags []Tag
+		if err := json.Unmarshal(trimmed, &tags); err != nil {
+			return err
+		}
+		*t = tags
+		return nil
+	}
+	var tag Tag
+	if err := json.Unmarshal(trimmed, &tag); err != nil {
+		return err
+	}
+	*t = Tags{tag}
+	return nil
+}
+
 type Note struct {
 	BaseProperties
 	Summary      *string    `json:"summary"`
@@ -15,4 +51,11 @@ type Note struct {
 	AttributedTo string     `json:"attributedTo,omitempty"`
 	MediaType    string     `json:"mediaType,omitempty"`
 	Content      string     `json:"content,omitempty"`
+	Tag          Tags       `json:"tag,omitempty"`
+	Updated      *time.Time `json:"updated,omitempty"`
+	// Deleted is set when a note has been replaced by a Tombstone.
+	Deleted *time.Time `json:"deleted,omitempty"`
+
+	Likes  *Collection `json:"likes,omitempty"`
+	Shares *Collection `json:"shares,omitempty"`
 }
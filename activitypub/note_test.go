@@ -170,3 +170,30 @@ func TestNoteMarshalJSON(t *testing.T) {
 		}
 	}
 }
+
+func TestTagsUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		Value    string
+		Expected []string
+	}{
+		{`{"type": "Note", "tag": null}`, nil},
+		{`{"type": "Note", "tag": {"type": "Mention", "href": "https://example.com/user", "name": "@user@example.com"}}`, []string{"https://example.com/user"}},
+		{`{"type": "Note", "tag": [{"type": "Mention", "href": "https://example.com/user"}, {"type": "Hashtag", "href": "https://example.com/tags/wiki", "name": "#wiki"}]}`, []string{"https://example.com/user", "https://example.com/tags/wiki"}},
+	}
+	for i, tc := range tests {
+		var n Note
+		if err := json.Unmarshal([]byte(tc.Value), &n); err != nil {
+			t.Errorf("case %d: %v", i, err)
+			continue
+		}
+		if len(n.Tag) != len(tc.Expected) {
+			t.Errorf("case %d: got %v want %v", i, n.Tag, tc.Expected)
+			continue
+		}
+		for j, href := range tc.Expected {
+			if n.Tag[j].Href != href {
+				t.Errorf("case %d: got %v want %v", i, n.Tag[j].Href, href)
+			}
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package activitypub
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
 	"time"
 )
 
@@ -14,6 +18,17 @@ type Object struct {
 	RawBytes []byte `json:"-"`
 }
 
+// ValidId returns true if id is an https URL with no query or fragment
+// which is already in its canonical form, so that it can be stored and
+// linked to as an actor's id without further escaping.
+func ValidId(id string) bool {
+	u, err := url.Parse(id)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "https" && u.Host != "" && u.User == nil && u.RawQuery == "" && u.Fragment == "" && u.String() == id
+}
+
 type BaseProperties struct {
 	Context JSONLDContext `json:"@context,omitempty"`
 	Id      string        `json:"id"`
@@ -26,10 +41,130 @@ type Follow struct {
 	Object string `json:"object"`
 }
 
-// FIXME: Might not necessarily be an Undo follow. Other things can be undone.
+// An ObjectReference is the object of an activity which may either be
+// embedded or referred to by its id.
+type ObjectReference struct {
+	Id   string
+	Type string
+}
+
+func (o ObjectReference) MarshalJSON() ([]byte, error) {
+	return json.Marshal(o.Id)
+}
+
+func (o *ObjectReference) UnmarshalJSON(b []byte) error {
+	trimmed := bytes.TrimSpace(b)
+	if len(trimmed) == 0 {
+		return fmt.Errorf("Could not unmarshal empty object")
+	}
+	switch trimmed[0] {
+	case '"':
+		o.Type = ""
+		return json.Unmarshal(trimmed, &o.Id)
+	case '{':
+		var obj Object
+		if err := json.Unmarshal(trimmed, &obj); err != nil {
+			return err
+		}
+		o.Id = obj.Id
+		o.Type = obj.Type
+		return nil
+	default:
+		return fmt.Errorf("Could not unmarshal %s", b)
+	}
+}
+
+// ObjectReferences is a list of objects, which may also be given as a
+// single object when there's only one.
+type ObjectReferences []ObjectReference
+
+func (o *ObjectReferences) UnmarshalJSON(b []byte) error {
+	trimmed := bytes.TrimSpace(b)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var refs []ObjectReference
+		if err := json.Unmarshal(trimmed, &refs); err != nil {
+			return err
+		}
+		*o = refs
+		return nil
+	}
+	var ref ObjectReference
+	if err := ref.UnmarshalJSON(trimmed); err != nil {
+		return err
+	}
+	*o = ObjectReferences{ref}
+	return nil
+}
+
+// A Flag reports its objects, usually an actor and some of their notes,
+// to the moderators of the server it's sent to.
+type Flag struct {
+	BaseProperties
+	Object  ObjectReferences `json:"object"`
+	Content string           `json:"content,omitempty"`
+}
+
+// An Offer proposes a change to a page, in the spirit of ForgeFed. Its
+// object is either an Article with the whole proposed page or a Patch of
+// the page's content, and its target is the page or its actor.
+type Offer struct {
+	BaseProperties
+	Summary string          `json:"summary,omitempty"`
+	Object  json.RawMessage `json:"object"`
+	Target  ObjectReference `json:"target"`
+}
+
+// A Patch is a unified diff of a page's content.
+type Patch struct {
+	BaseProperties
+	Summary      string `json:"summary,omitempty"`
+	Content      string `json:"content"`
+	MediaType    string `json:"mediaType,omitempty"`
+	AttributedTo string `json:"attributedTo,omitempty"`
+}
+
+// An OfferReply is the Accept or Reject of an Offer, sent once the
+// proposal has been decided. The result of an accepted Offer is the
+// revision it created.
+type OfferReply struct {
+	BaseProperties
+	To     []string        `json:"to,omitempty"`
+	Object ObjectReference `json:"object"`
+	Result string          `json:"result,omitempty"`
+}
+
+// An Undo's object may be any activity that the actor previously sent,
+// either embedded or referred to by its id.
 type Undo struct {
 	BaseProperties
-	Object Follow `json:"object"`
+	Object ObjectReference `json:"object"`
+}
+
+// A Delete's object is usually either the id of the deleted object or a
+// Tombstone.
+type Delete struct {
+	BaseProperties
+	Object ObjectReference `json:"object"`
+}
+
+type Like struct {
+	BaseProperties
+	Object ObjectReference `json:"object"`
+}
+
+type Announce struct {
+	BaseProperties
+	Object ObjectReference `json:"object"`
+}
+
+// A Collection is used for the likes and shares of an object. Items are
+// the ids of the Like or Announce activities.
+type Collection struct {
+	Context    JSONLDContext `json:"@context,omitempty"`
+	Id         string        `json:"id"`
+	Type       string        `json:"type"`
+	TotalItems int           `json:"totalItems"`
+	Items      []string      `json:"items,omitempty"`
 }
 
 type Accept struct {
@@ -74,3 +209,35 @@ type CreateNote struct {
 	Published *time.Time `json:"published,omitempty"`
 	Object    Note       `json:"object"`
 }
+
+// An Update of an object of any type. Object is left to be unmarshalled
+// once its type is known.
+type Update struct {
+	BaseProperties
+	Object json.RawMessage `json:"object"`
+}
+
+// A Move is sent when an actor moves to a new account, Target.
+type Move struct {
+	BaseProperties
+	Object string `json:"object"`
+	Target string `json:"target"`
+}
+
+// UpdateActor is sent to followers when an actor's profile or key
+// changes.
+type UpdateActor struct {
+	BaseProperties
+	To     []string `json:"to"`
+	Cc     []string `json:"cc,omitempty"`
+	Object Actor    `json:"object"`
+}
+
+// An Update of a Note. Updates are only unmarshalled into it once the
+// object is known to be a Note.
+type UpdateNote struct {
+	BaseProperties
+	To     []string `json:"to"`
+	Cc     []string `json:"cc"`
+	Object Note     `json:"object"`
+}
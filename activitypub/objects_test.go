@@ -0,0 +1,84 @@
+package activitypub
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestObjectReferenceUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		Value    string
+		Expected ObjectReference
+	}{
+		{`"https://example.com/note/1"`, ObjectReference{Id: "https://example.com/note/1"}},
+		{`{"id": "https://example.com/note/1", "type": "Tombstone"}`, ObjectReference{Id: "https://example.com/note/1", Type: "Tombstone"}},
+	}
+	for i, tc := range tests {
+		var o ObjectReference
+		if err := json.Unmarshal([]byte(tc.Value), &o); err != nil {
+			t.Errorf("case %d: %v", i, err)
+			continue
+		}
+		if o != tc.Expected {
+			t.Errorf("case %d: got %v want %v", i, o, tc.Expected)
+		}
+	}
+
+	var d Delete
+	if err := json.Unmarshal([]byte(`{"id": "https://example.com/delete/1", "type": "Delete", "actor": "https://example.com/user", "object": {"id": "https://example.com/note/1", "type": "Tombstone"}}`), &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Actor != "https://example.com/user" || d.Object.Id != "https://example.com/note/1" {
+		t.Errorf("Unexpected delete: %v", d)
+	}
+}
+
+func TestFlagUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		Value    string
+		Expected []string
+	}{
+		{`{"type": "Flag", "object": "https://example.com/user"}`, []string{"https://example.com/user"}},
+		{`{"type": "Flag", "object": ["https://example.com/user", {"id": "https://example.com/note/1", "type": "Note"}]}`, []string{"https://example.com/user", "https://example.com/note/1"}},
+	}
+	for i, tc := range tests {
+		var f Flag
+		if err := json.Unmarshal([]byte(tc.Value), &f); err != nil {
+			t.Errorf("case %d: %v", i, err)
+			continue
+		}
+		if len(f.Object) != len(tc.Expected) {
+			t.Errorf("case %d: got %v want %v", i, f.Object, tc.Expected)
+			continue
+		}
+		for j, id := range tc.Expected {
+			if f.Object[j].Id != id {
+				t.Errorf("case %d: got %v want %v", i, f.Object[j].Id, id)
+			}
+		}
+	}
+}
+
+func TestValidId(t *testing.T) {
+	tests := []struct {
+		Id    string
+		Valid bool
+	}{
+		{"https://example.com/users/bob", true},
+		{"https://example.com/@bob", true},
+		{"http://example.com/users/bob", false},
+		{"javascript:alert(1)", false},
+		{"https://example.com/users/<script>", false},
+		{`https://example.com/users/"bob"`, false},
+		{"https://example.com/users/bob?x=<b>", false},
+		{"https://example.com/users/bob#key", false},
+		{"https://user@example.com/users/bob", false},
+		{"https:///users/bob", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := ValidId(test.Id); got != test.Valid {
+			t.Errorf("ValidId(%q) = %v, want %v", test.Id, got, test.Valid)
+		}
+	}
+}
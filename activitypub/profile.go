@@ -10,6 +10,19 @@ type PublicKey struct {
 	PublicKeyPem string `json:"publicKeyPem"`
 }
 
+// A Multikey is an Ed25519 public key in the FEP-521a format, listed in an
+// actor's assertionMethod.
+type Multikey struct {
+	Id                 string `json:"id"`
+	Type               string `json:"type"`
+	Controller         string `json:"controller"`
+	PublicKeyMultibase string `json:"publicKeyMultibase"`
+}
+
+type Endpoints struct {
+	SharedInbox string `json:"sharedInbox,omitempty"`
+}
+
 type Actor struct {
 	Context           JSONLDContext `json:"@context"`
 	Id                string        `json:"id"`
@@ -23,6 +36,19 @@ type Actor struct {
 	Followers         string        `json:"followers,omitempty"`
 	ProfileIcon       string        `json:"profileicon,omitempty"`
 	PublicKey         PublicKey     `json:"publicKey"`
+	AssertionMethod   []Multikey    `json:"assertionMethod,omitempty"`
+	Endpoints         *Endpoints    `json:"endpoints,omitempty"`
+	AlsoKnownAs       []string      `json:"alsoKnownAs,omitempty"`
+	MovedTo           string        `json:"movedTo,omitempty"`
+}
+
+// DeliveryInbox returns the inbox which activities for the actor should be
+// delivered to, preferring its server's shared inbox.
+func (a Actor) DeliveryInbox() string {
+	if a.Endpoints != nil && a.Endpoints.SharedInbox != "" {
+		return a.Endpoints.SharedInbox
+	}
+	return a.Inbox
 }
 
 func (a Actor) MentionName() string {
@@ -0,0 +1,398 @@
+// Package archive exports and imports the content of a wiki.
+//
+// An archive is a gzipped tar file with the following layout:
+//
+//	fediwiki.json                         Archive metadata (see Manifest)
+//	actors.json                           Cached actors of page followers
+//	pages/<name>/actor.json               The page's ActivityPub actor (not imported)
+//	pages/<name>/private.pem              The page actor's private key (optional)
+//	pages/<name>/revisions.json           Revision metadata, oldest first
+//	pages/<name>/history/<id>/title.txt   The title of revision <id>
+//	pages/<name>/history/<id>/summary.md  The summary of revision <id>
+//	pages/<name>/history/<id>/content.md  The content of revision <id>
+//	pages/<name>/followers.json           Accepted Follow activities
+//	pages/<name>/notes.json               Talk page notes
+//
+// Sessions and OAuth client registrations are specific to an instance and
+// are never exported. Private keys are only exported when requested, and
+// new keys are generated on import when they are absent, so that an
+// archive without keys can safely be shared to seed test instances.
+//
+// The page actors in an archive are only for reference. Actor ids depend on
+// the wiki's domain, so importing creates new actors from the latest
+// revision of each page, with the imported or generated key.
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"fediwiki/activitypub"
+	"fediwiki/pages"
+)
+
+// The version of the archive format written by Export.
+const Version = 1
+
+type Database interface {
+	pages.Persister
+	pages.PagesDatabase
+	activitypub.ActorDatabase
+	activitypub.ActivityDatabase
+}
+
+type Options struct {
+	// Include (or, when importing, restore) page actors' private keys.
+	PrivateKeys bool
+}
+
+// Manifest is the content of fediwiki.json at the root of the archive.
+type Manifest struct {
+	Version     int       `json:"version"`
+	Domain      string    `json:"domain"`
+	Exported    time.Time `json:"exported"`
+	PrivateKeys bool      `json:"privateKeys"`
+	Pages       []string  `json:"pages"`
+}
+
+// Revision is an entry in a page's revisions.json.
+type Revision struct {
+	Id     string     `json:"id"`
+	Editor string     `json:"editor"`
+	Time   *time.Time `json:"time,omitempty"`
+	Origin string     `json:"origin,omitempty"`
+}
+
+func writeFile(tw *tar.Writer, name string, data []byte, mode int64) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    mode,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func writeJSON(tw *tar.Writer, name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFile(tw, name, data, 0644)
+}
+
+// Export writes an archive of every page in db to w.
+func Export(w io.Writer, db Database, domain string, opts Options) error {
+	names, err := db.ListPages()
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	if err := writeJSON(tw, "fediwiki.json", Manifest{
+		Version:     Version,
+		Domain:      domain,
+		Exported:    time.Now(),
+		PrivateKeys: opts.PrivateKeys,
+		Pages:       names,
+	}); err != nil {
+		return err
+	}
+
+	followers := make(map[string]activitypub.Actor)
+	for _, name := range names {
+		if err := exportPage(tw, db, name, opts, followers); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	var actors []activitypub.Actor
+	for _, actor := range followers {
+		actors = append(actors, actor)
+	}
+	sort.Slice(actors, func(i, j int) bool {
+		return actors[i].Id < actors[j].Id
+	})
+	if err := writeJSON(tw, "actors.json", actors); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func exportPage(tw *tar.Writer, db Database, name string, opts Options, followers map[string]activitypub.Actor) error {
+	dir := "pages/" + name + "/"
+
+	actor, err := db.GetPageActor(name)
+	if err != nil {
+		return err
+	}
+	if err := writeJSON(tw, dir+"actor.json", actor); err != nil {
+		return err
+	}
+	if opts.PrivateKeys {
+		_, key, err := db.GetPrivateKey(name)
+		if err != nil {
+			return err
+		}
+		keybytes, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return err
+		}
+		if err := writeFile(tw, dir+"private.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keybytes}), 0400); err != nil {
+			return err
+		}
+	}
+
+	revs, err := db.GetPageRevisions(name)
+	if err != nil {
+		return err
+	}
+	var revisions []Revision
+	for _, rev := range revs {
+		page, err := db.GetPageRevision(name, rev.RevisionID)
+		if err != nil {
+			return err
+		}
+		revdir := dir + "history/" + rev.RevisionID + "/"
+		if err := writeFile(tw, revdir+"title.txt", []byte(page.Title), 0644); err != nil {
+			return err
+		}
+		if err := writeFile(tw, revdir+"summary.md", []byte(page.Summary), 0644); err != nil {
+			return err
+		}
+		if err := writeFile(tw, revdir+"content.md", []byte(page.Content), 0644); err != nil {
+			return err
+		}
+		revisions = append(revisions, Revision{Id: rev.RevisionID, Editor: rev.Editor, Time: rev.EditTime, Origin: rev.Origin})
+	}
+	if err := writeJSON(tw, dir+"revisions.json", revisions); err != nil {
+		return err
+	}
+
+	follows, err := db.GetPageFollowRequests(name)
+	if err != nil {
+		return err
+	}
+	for _, follow := range follows {
+		if actor, err := db.GetForeignActor(follow.Actor); err == nil {
+			followers[actor.Id] = *actor
+		}
+	}
+	if err := writeJSON(tw, dir+"followers.json", follows); err != nil {
+		return err
+	}
+
+	// There may not be a talk page yet.
+	notes, _ := db.GetPageNotes(name)
+	return writeJSON(tw, dir+"notes.json", notes)
+}
+
+func readJSON(files map[string][]byte, name string, v interface{}) error {
+	data, ok := files[name]
+	if !ok {
+		return fmt.Errorf("Missing %s in archive", name)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Import reads an archive written by Export from r and recreates its
+// pages in db, with page actors on domain. It refuses to overwrite pages
+// which already exist.
+func Import(r io.Reader, db Database, domain string, opts Options) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		files[hdr.Name] = data
+	}
+
+	var manifest Manifest
+	if err := readJSON(files, "fediwiki.json", &manifest); err != nil {
+		return err
+	}
+	if manifest.Version != Version {
+		return fmt.Errorf("Unsupported archive version %d", manifest.Version)
+	}
+	// Read every page before writing anything, so that an invalid
+	// archive doesn't leave some pages half imported.
+	var archived []*archivedPage
+	for _, name := range manifest.Pages {
+		if strings.ContainsAny(name, "/\\") || name == "." || name == ".." {
+			return fmt.Errorf("Invalid page name %s", name)
+		}
+		if _, err := db.GetPage(name); err == nil {
+			return fmt.Errorf("Page %s already exists", name)
+		}
+		page, err := readPage(files, name, opts)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		archived = append(archived, page)
+	}
+
+	var actors []activitypub.Actor
+	if err := readJSON(files, "actors.json", &actors); err != nil {
+		return err
+	}
+	for _, actor := range actors {
+		if actor.Id == "" {
+			continue
+		}
+		raw, err := json.Marshal(actor)
+		if err != nil {
+			return err
+		}
+		if _, err := db.GetForeignActor(actor.Id); err == nil {
+			continue
+		}
+		if err := db.StoreActor(actor, raw); err != nil {
+			return err
+		}
+	}
+
+	for _, page := range archived {
+		if err := importPage(db, page, domain); err != nil {
+			return fmt.Errorf("%s: %v", page.Name, err)
+		}
+	}
+	return nil
+}
+
+// archivedPage is a page read from an archive by readPage.
+type archivedPage struct {
+	Name      string
+	Revisions []Revision
+	History   []pages.Page
+	// Private is nil if a new key should be generated.
+	Private   crypto.Signer
+	Followers []activitypub.Follow
+	Notes     []activitypub.Note
+}
+
+// readPage reads and validates the files of the named page.
+func readPage(files map[string][]byte, name string, opts Options) (*archivedPage, error) {
+	dir := "pages/" + name + "/"
+	page := &archivedPage{Name: name}
+
+	if err := readJSON(files, dir+"revisions.json", &page.Revisions); err != nil {
+		return nil, err
+	}
+	for _, rev := range page.Revisions {
+		revdir := dir + "history/" + rev.Id + "/"
+		content, ok := files[revdir+"content.md"]
+		if !ok {
+			return nil, fmt.Errorf("Missing content for revision %s", rev.Id)
+		}
+		page.History = append(page.History, pages.Page{
+			PageName: name,
+			Title:    string(files[revdir+"title.txt"]),
+			Summary:  string(files[revdir+"summary.md"]),
+			Content:  string(content),
+		})
+	}
+	if len(page.History) == 0 {
+		return nil, fmt.Errorf("No revisions")
+	}
+
+	if pembytes, ok := files[dir+"private.pem"]; ok && opts.PrivateKeys {
+		block, _ := pem.Decode(pembytes)
+		if block == nil {
+			return nil, fmt.Errorf("Invalid private key")
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("Unsupported private key type")
+		}
+		page.Private = signer
+	}
+
+	if err := readJSON(files, dir+"followers.json", &page.Followers); err != nil {
+		return nil, err
+	}
+	if err := readJSON(files, dir+"notes.json", &page.Notes); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// importPage creates a page read by readPage in db.
+func importPage(db Database, page *archivedPage, domain string) error {
+	signer := page.Private
+	if signer == nil {
+		key, err := rsa.GenerateKey(rand.Reader, 4096)
+		if err != nil {
+			return err
+		}
+		signer = key
+	}
+	// The actor is created from the latest revision, the same as it
+	// would be if the page was edited.
+	actor, err := db.NewPageActor(page.History[len(page.History)-1], domain, signer, signer.Public())
+	if err != nil {
+		return err
+	}
+
+	for i, rev := range page.History {
+		if _, err := db.SavePageRevision(rev, *actor, pages.Revision{
+			PageName: page.Name,
+			Editor:   page.Revisions[i].Editor,
+			EditTime: page.Revisions[i].Time,
+			Origin:   page.Revisions[i].Origin,
+		}); err != nil {
+			return err
+		}
+	}
+
+	for _, follow := range page.Followers {
+		follow.Object = actor.Id
+		if err := db.AddFollower(page.Name, follow); err != nil {
+			return err
+		}
+	}
+	for _, note := range page.Notes {
+		if err := db.AddPageNote(page.Name, note); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"testing"
+	"time"
+
+	"fediwiki/activitypub"
+	"fediwiki/filesystemdb"
+	"fediwiki/pages"
+)
+
+func TestExportImport(t *testing.T) {
+	srcdir, err := os.MkdirTemp("", "exporttest")
+	if err != nil {
+		t.Fatal("Could not create temp dir for test")
+	}
+	defer os.RemoveAll(srcdir)
+	src := &filesystemdb.FileSystemDB{FSRoot: srcdir}
+
+	page := pages.Page{
+		PageName: "Foo",
+		Title:    "Foo title",
+		Summary:  "yay",
+		Content:  "hoooray",
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actor, err := src.NewPageActor(page, "example.com", key, &key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edittime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if _, err := src.SavePageRevision(page, *actor, pages.Revision{Editor: "@bob@example.org", EditTime: &edittime}); err != nil {
+		t.Fatal(err)
+	}
+	page.Content = "changed"
+	if _, err := src.SavePage(page, *actor, "@alice@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	follower := activitypub.Actor{Id: "https://example.org/users/bob", Type: "Person", Inbox: "https://example.org/users/bob/inbox"}
+	if err := src.StoreActor(follower, []byte(`{"id":"https://example.org/users/bob","type":"Person","inbox":"https://example.org/users/bob/inbox"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.AddFollower("Foo", activitypub.Follow{
+		BaseProperties: activitypub.BaseProperties{Id: "https://example.org/follows/1", Type: "Follow", Actor: follower.Id},
+		Object:         actor.Id,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.AddPageNote("Foo", activitypub.Note{
+		BaseProperties: activitypub.BaseProperties{Id: "https://example.org/notes/1", Type: "Note"},
+		AttributedTo:   follower.Id,
+		Content:        "Nice page",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if err := Export(&archive, src, "example.com", Options{PrivateKeys: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	dstdir, err := os.MkdirTemp("", "importtest")
+	if err != nil {
+		t.Fatal("Could not create temp dir for test")
+	}
+	defer os.RemoveAll(dstdir)
+	dst := &filesystemdb.FileSystemDB{FSRoot: dstdir}
+	if err := Import(bytes.NewReader(archive.Bytes()), dst, "example.net", Options{PrivateKeys: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := dst.GetPage("Foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Content != "changed" || imported.Title != "Foo title" {
+		t.Errorf("Unexpected imported page %v", imported)
+	}
+	revs, err := dst.GetPageRevisions("Foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 2 {
+		t.Fatalf("Unexpected number of revisions: want 2 got %v", len(revs))
+	}
+	if revs[0].Editor != "@bob@example.org" || !revs[0].EditTime.Equal(edittime) {
+		t.Errorf("Revision metadata not preserved: %v %v", revs[0].Editor, revs[0].EditTime)
+	}
+	dstactor, err := dst.GetPageActor("Foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dstactor.Id != "https://example.net/pages/Foo/actor" {
+		t.Errorf("Unexpected imported actor id %v", dstactor.Id)
+	}
+	if dstactor.PublicKey.PublicKeyPem != actor.PublicKey.PublicKeyPem {
+		t.Error("Private key was not restored")
+	}
+	followers, err := dst.GetPageFollowers("Foo", dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(followers) != 1 || followers[0].Id != follower.Id {
+		t.Errorf("Unexpected followers %v", followers)
+	}
+	notes, err := dst.GetPageNotes("Foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].Content != "Nice page" {
+		t.Errorf("Unexpected notes %v", notes)
+	}
+
+	if err := Import(bytes.NewReader(archive.Bytes()), dst, "example.net", Options{PrivateKeys: true}); err == nil {
+		t.Error("Importing over an existing page did not fail")
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	files := []struct {
+		Name string
+		Data interface{}
+	}{
+		{"fediwiki.json", Manifest{Version: Version, Pages: []string{"Good", "Bad"}}},
+		{"actors.json", []activitypub.Actor{}},
+		{"pages/Good/revisions.json", []Revision{{Id: "1"}}},
+		{"pages/Good/followers.json", []activitypub.Follow{}},
+		{"pages/Good/notes.json", []activitypub.Note{}},
+		// Bad is missing the content of its revision.
+		{"pages/Bad/revisions.json", []Revision{{Id: "1"}}},
+		{"pages/Bad/followers.json", []activitypub.Follow{}},
+		{"pages/Bad/notes.json", []activitypub.Note{}},
+	}
+	for _, f := range files {
+		if err := writeJSON(tw, f.Name, f.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeFile(tw, "pages/Good/history/1/content.md", []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dstdir, err := os.MkdirTemp("", "importtest")
+	if err != nil {
+		t.Fatal("Could not create temp dir for test")
+	}
+	defer os.RemoveAll(dstdir)
+	dst := &filesystemdb.FileSystemDB{FSRoot: dstdir}
+	if err := Import(&archive, dst, "example.net", Options{}); err == nil {
+		t.Fatal("Importing an invalid archive did not fail")
+	}
+	if _, err := dst.GetPage("Good"); err == nil {
+		t.Error("Pages were imported from an invalid archive")
+	}
+	if _, err := dst.GetPageActor("Good"); err == nil {
+		t.Error("Page actors were created from an invalid archive")
+	}
+}
@@ -0,0 +1,83 @@
+// Package blocklist parses the domain blocklist formats commonly shared
+// between fediverse instances.
+//
+// The supported formats are Mastodon's domain block export (with a
+// "#domain,#severity,..." header), the same CSV with a header which isn't
+// prefixed by '#', and plain lists with one domain per line.
+package blocklist
+
+import (
+	"encoding/csv"
+	"io"
+	"strings"
+
+	"fediwiki/activitypub"
+)
+
+// Parse reads a blocklist from r. Only blocks which suspend the domain
+// are returned, since there is no equivalent of a silence or media
+// rejection for a wiki.
+func Parse(r io.Reader) ([]activitypub.Block, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	domainCol, severityCol, commentCol := 0, -1, -1
+	var blocks []activitypub.Block
+	first := true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if first {
+			first = false
+			if isHeader(record) {
+				for i, name := range record {
+					switch strings.TrimPrefix(strings.ToLower(strings.TrimSpace(name)), "#") {
+					case "domain":
+						domainCol = i
+					case "severity":
+						severityCol = i
+					case "public_comment", "comment", "reason":
+						commentCol = i
+					}
+				}
+				continue
+			}
+		}
+		if domainCol >= len(record) {
+			continue
+		}
+		domain := strings.ToLower(strings.TrimSpace(record[domainCol]))
+		if domain == "" || strings.HasPrefix(domain, "#") {
+			// Blank line or a comment in a plain list.
+			continue
+		}
+		if severityCol >= 0 && severityCol < len(record) {
+			switch strings.ToLower(strings.TrimSpace(record[severityCol])) {
+			case "", "suspend":
+			default:
+				continue
+			}
+		}
+		block := activitypub.Block{Domain: domain}
+		if commentCol >= 0 && commentCol < len(record) {
+			block.Reason = strings.TrimSpace(record[commentCol])
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+func isHeader(record []string) bool {
+	for _, name := range record {
+		if strings.TrimPrefix(strings.ToLower(strings.TrimSpace(name)), "#") == "domain" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package blocklist
+
+import (
+	"strings"
+	"testing"
+
+	"fediwiki/activitypub"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Input string
+		Want  []activitypub.Block
+	}{
+		{
+			Name: "Mastodon export",
+			Input: `#domain,#severity,#reject_media,#reject_reports,#public_comment,#obfuscate
+spam.example,suspend,true,true,Spam,false
+quiet.example,silence,false,false,Annoying,false
+`,
+			Want: []activitypub.Block{{Domain: "spam.example", Reason: "Spam"}},
+		},
+		{
+			Name: "Header without #",
+			Input: `domain,severity,public_comment
+Bad.Example,suspend,"Harassment, spam"
+`,
+			Want: []activitypub.Block{{Domain: "bad.example", Reason: "Harassment, spam"}},
+		},
+		{
+			Name: "Plain list",
+			Input: `# Comment
+one.example
+
+two.example
+`,
+			Want: []activitypub.Block{{Domain: "one.example"}, {Domain: "two.example"}},
+		},
+	}
+	for _, tc := range tests {
+		got, err := Parse(strings.NewReader(tc.Input))
+		if err != nil {
+			t.Errorf("%s: %v", tc.Name, err)
+			continue
+		}
+		if len(got) != len(tc.Want) {
+			t.Errorf("%s: got %v want %v", tc.Name, got, tc.Want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.Want[i] {
+				t.Errorf("%s: got %v want %v", tc.Name, got[i], tc.Want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"fediwiki/activitypub"
+	"fediwiki/archive"
+	"fediwiki/blocklist"
+	"fediwiki/filesystemdb"
+	"fediwiki/inbox"
+	"fediwiki/mediawiki"
+	"fediwiki/outbox"
+	"fediwiki/pages"
+)
+
+// A command is an administrative subcommand which can be run from the
+// command line instead of starting the server.
+type command struct {
+	Usage string
+	Run   func(db *filesystemdb.FileSystemDB, args []string) error
+}
+
+// Commands return errUsage when they're given invalid arguments.
+var errUsage = errors.New("Invalid arguments")
+
+var commands = map[string]command{
+	"export": {
+		Usage: "export [-keys] file.tar.gz: write an archive of every page, its history, followers and talk notes",
+		Run:   exportCommand,
+	},
+	"import": {
+		Usage: "import [-keys] file.tar.gz: create pages from an archive written by export",
+		Run:   importCommand,
+	},
+	"import-mediawiki": {
+		Usage: "import-mediawiki dump.xml: create pages from a MediaWiki XML dump, preserving their history",
+		Run:   importMediaWikiCommand,
+	},
+	"render-static": {
+		Usage: "render-static [-history] dir: render a read-only copy of the wiki as static HTML files in dir",
+		Run:   renderStaticCommand,
+	},
+	"replay": {
+		Usage: "replay: retry processing every inbox activity which hasn't been processed, including ones which were given up on",
+		Run:   replayCommand,
+	},
+	"rotate-key": {
+		Usage: "rotate-key page: replace the page actor's keypair and send an Update to its followers",
+		Run:   rotateKeyCommand,
+	},
+	"fork": {
+		Usage: "fork page Page@host|url: create page as a copy of a page on another wiki, and propose the original's later changes",
+		Run:   forkCommand,
+	},
+	"block": {
+		Usage: "block [-reason text] domain|actor: reject activities, deliveries and logins from a domain or actor id",
+		Run:   blockCommand,
+	},
+	"unblock": {
+		Usage: "unblock domain|actor: remove a block",
+		Run:   unblockCommand,
+	},
+	"blocks": {
+		Usage: "blocks: list the blocked domains and actors",
+		Run:   blocksCommand,
+	},
+	"import-blocklist": {
+		Usage: "import-blocklist file.csv: block every suspended domain in a Mastodon or plain text blocklist",
+		Run:   importBlocklistCommand,
+	},
+	"gc": {
+		Usage: "gc: remove page content blobs which are no longer referenced by any revision",
+		Run:   gcCommand,
+	},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: fediwiki [command [args...]]\n\n")
+	fmt.Fprintf(os.Stderr, "Starts the server if no command is given. Commands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "\t%s\n", commands[name].Usage)
+	}
+}
+
+func runCommand(db *filesystemdb.FileSystemDB, args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usage()
+		return fmt.Errorf("Unknown command %s", args[0])
+	}
+	err := cmd.Run(db, args[1:])
+	if err == errUsage {
+		fmt.Fprintf(os.Stderr, "usage: fediwiki %s\n", cmd.Usage)
+	}
+	return err
+}
+
+func gcCommand(db *filesystemdb.FileSystemDB, args []string) error {
+	removed, err := db.CollectGarbage()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d unreferenced blobs\n", removed)
+	return nil
+}
+
+func exportCommand(db *filesystemdb.FileSystemDB, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	keys := flags.Bool("keys", false, "Include page actors' private keys in the archive")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errUsage
+	}
+
+	f, err := os.OpenFile(flags.Arg(0), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := archive.Export(f, db, os.Getenv("fediwikidomain"), archive.Options{PrivateKeys: *keys}); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	return f.Close()
+}
+
+func importCommand(db *filesystemdb.FileSystemDB, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	keys := flags.Bool("keys", false, "Restore page actors' private keys from the archive instead of generating new ones")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errUsage
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return archive.Import(f, db, os.Getenv("fediwikidomain"), archive.Options{PrivateKeys: *keys})
+}
+
+func importMediaWikiCommand(db *filesystemdb.FileSystemDB, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	domain := os.Getenv("fediwikidomain")
+	imported, err := mediawiki.Import(f, db, func(page pages.Page) (*activitypub.Actor, error) {
+		return getOrCreatePageActor(db, page, domain)
+	})
+	for _, name := range imported {
+		fmt.Printf("Imported %s\n", name)
+	}
+	return err
+}
+
+func renderStaticCommand(db *filesystemdb.FileSystemDB, args []string) error {
+	flags := flag.NewFlagSet("render-static", flag.ExitOnError)
+	history := flags.Bool("history", false, "Also render the history and diffs of each page")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errUsage
+	}
+	parseTemplates()
+	site := staticSite{Dir: flags.Arg(0), History: *history, db: db}
+	return site.Render()
+}
+
+func replayCommand(db *filesystemdb.FileSystemDB, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	succeeded, failed, err := inbox.Replay(db, func(obj activitypub.Object) error {
+		return inbox.Process(db, db, db, db, db, obj)
+	})
+	fmt.Printf("Processed %d activities, %d failed\n", succeeded, failed)
+	return err
+}
+
+func rotateKeyCommand(db *filesystemdb.FileSystemDB, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	pagename := args[0]
+	key, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		return err
+	}
+	actor, err := db.RotatePageKey(pagename, key, &key.PublicKey)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rotated key for %s\n", actor.Id)
+
+	followers, err := db.GetPageFollowers(pagename, db)
+	if err != nil {
+		return err
+	}
+	update := activitypub.UpdateActor{
+		BaseProperties: activitypub.BaseProperties{
+			Context: activitypub.JSONLDContext{"https://www.w3.org/ns/activitystreams", "https://w3id.org/security/v1"},
+			Id:      fmt.Sprintf("%s#update-%d", actor.Id, time.Now().Unix()),
+			Type:    "Update",
+			Actor:   actor.Id,
+		},
+		To:     []string{"https://www.w3.org/ns/activitystreams#Public"},
+		Cc:     []string{strings.TrimSuffix(actor.Id, "/actor") + "/followers"},
+		Object: *actor,
+	}
+	update.Object.Context = nil
+	bytes, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	return outbox.Deliver(db, pagename, followers, activitypub.Object{Id: update.Id, Type: "Update", RawBytes: bytes})
+}
+
+func blockCommand(db *filesystemdb.FileSystemDB, args []string) error {
+	flags := flag.NewFlagSet("block", flag.ExitOnError)
+	reason := flags.String("reason", "", "Reason for the block")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errUsage
+	}
+	block := activitypub.Block{Reason: *reason}
+	if target := flags.Arg(0); strings.Contains(target, "/") {
+		block.Actor = target
+	} else {
+		block.Domain = target
+	}
+	return db.Block(block)
+}
+
+func unblockCommand(db *filesystemdb.FileSystemDB, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	return db.Unblock(args[0])
+}
+
+func blocksCommand(db *filesystemdb.FileSystemDB, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	blocks, err := db.GetBlocks()
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		target := block.Domain
+		if target == "" {
+			target = block.Actor
+		}
+		fmt.Printf("%s\t%s\n", target, block.Reason)
+	}
+	return nil
+}
+
+func importBlocklistCommand(db *filesystemdb.FileSystemDB, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	blocks, err := blocklist.Parse(f)
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		if err := db.Block(block); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Blocked %d domains\n", len(blocks))
+	return nil
+}
+
+func forkCommand(db *filesystemdb.FileSystemDB, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	rev, err := forkPage(db, db, db, args[0], args[1], "fork")
+	if rev != nil {
+		fmt.Printf("Forked %s from %s\n", rev.PageName, rev.Origin)
+	}
+	return err
+}
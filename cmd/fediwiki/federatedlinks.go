@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"fediwiki/activitypub"
+	"fediwiki/httpsig"
+	"fediwiki/pages"
+)
+
+// federatedLink matches [[Page@host]] links to pages on other wikis.
+var federatedLink = regexp.MustCompile(`\[\[([[:alpha:]]+)@([[:alnum:]\.\-]+)\]\]`)
+
+// brokenLinkExpiry is how long to wait after trying to resolve a
+// federated link before trying again, if it couldn't be resolved or there
+// was no preview.
+var brokenLinkExpiry = time.Hour
+
+// maxLinkAttempts is the most federated links which are remembered as
+// being resolved or having failed to at once.
+const maxLinkAttempts = 1000
+
+// A linkAttempt records the last attempt to resolve a federated link.
+type linkAttempt struct {
+	At      time.Time
+	Running bool
+	Broken  bool
+}
+
+var linkAttempts = struct {
+	sync.Mutex
+	links map[string]linkAttempt
+}{links: make(map[string]linkAttempt)}
+
+// A remoteLink is a federated link resolved to the page it refers to.
+type remoteLink struct {
+	Href    string
+	Summary string
+	Broken  bool
+}
+
+// webFingerCacheId returns the id which the WebFinger response for
+// name@host is cached under in the ObjectDatabase. It isn't the real
+// WebFinger URL, since the ObjectDatabase can't store ids containing '='.
+func webFingerCacheId(name, host string) string {
+	return "https://" + host + "/.well-known/webfinger#acct:" + name + "@" + host
+}
+
+// federatedLinkExpiry is how long a resolved federated link is cached
+// before it's fetched again, so that previews are refreshed.
+var federatedLinkExpiry = 24 * time.Hour
+
+// A cachedObject is an object fetched for a federated link, saved with
+// the time it was fetched.
+type cachedObject struct {
+	Fetched time.Time       `json:"fetched"`
+	Object  json.RawMessage `json:"object"`
+}
+
+// isHTTPS returns true if s is an absolute https URL, which is safe to
+// use as the href of a link from a remote source.
+func isHTTPS(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme == "https" && u.Host != ""
+}
+
+// readCachedObject returns the cached copy of the object with id from
+// objects, and whether it's still fresh. Its Object is nil if it isn't
+// cached.
+func readCachedObject(objects activitypub.ObjectDatabase, id string) (cachedObject, bool) {
+	var cached cachedObject
+	if !objects.HasObject(id) {
+		return cached, false
+	}
+	obj, err := objects.GetObject(id)
+	if err != nil {
+		return cached, false
+	}
+	// Objects cached before they were saved with the time they were
+	// fetched are treated as expired.
+	if err := json.Unmarshal(obj.RawBytes, &cached); err != nil {
+		return cachedObject{}, false
+	}
+	return cached, time.Since(cached.Fetched) < federatedLinkExpiry
+}
+
+// getCachedObject returns the raw bytes of the object with id from objects,
+// or fetches them with fetch and saves them if they aren't cached or the
+// cached copy is older than federatedLinkExpiry. If they can't be fetched
+// again, the old copy is returned.
+func getCachedObject(objects activitypub.ObjectDatabase, id, objtype string, fetch func() ([]byte, error)) ([]byte, error) {
+	cached, fresh := readCachedObject(objects, id)
+	if fresh {
+		return cached.Object, nil
+	}
+	bytes, err := fetch()
+	if err != nil {
+		if cached.Object != nil {
+			log.Printf("Could not refresh %v: %v\n", id, err)
+			return cached.Object, nil
+		}
+		return nil, err
+	}
+	if strings.ContainsAny(id, "= \t\n") {
+		// Can't be stored in the ObjectDatabase.
+		return bytes, nil
+	}
+	raw, err := json.Marshal(cachedObject{Fetched: time.Now(), Object: bytes})
+	if err != nil {
+		// Not valid JSON, so there's nothing worth caching.
+		return bytes, nil
+	}
+	if err := objects.UpdateObject(activitypub.Object{Id: id, Type: objtype, RawBytes: raw}); err != nil {
+		log.Println(err)
+	}
+	return bytes, nil
+}
+
+// profileHref returns the https URL of the page in a cached WebFinger
+// response, or an empty string if there isn't one.
+func profileHref(jrd []byte) string {
+	var webfinger webFingerResponse
+	if err := json.Unmarshal(jrd, &webfinger); err != nil {
+		return ""
+	}
+	if href := webfinger.Link("http://webfinger.net/rel/profile-page", ""); isHTTPS(href) {
+		return href
+	}
+	return ""
+}
+
+// articleSummary returns the text to preview a cached Article with.
+func articleSummary(raw []byte) string {
+	var article activitypub.Article
+	if err := json.Unmarshal(raw, &article); err != nil {
+		return ""
+	}
+	if article.Summary != "" {
+		return article.Summary
+	}
+	return article.Name
+}
+
+// resolveFederatedLink finds the page that [[name@host]] refers to, using
+// WebFinger to find the page actor's HTML page and fetching its Article
+// for a preview. Both are cached in objects. Only public hosts are
+// contacted, since anyone who can edit a page can choose them.
+func resolveFederatedLink(objects activitypub.ObjectDatabase, name, host string) remoteLink {
+	link := remoteLink{Href: "https://" + host + pages.Root + name}
+	if strings.EqualFold(host, os.Getenv("fediwikidomain")) {
+		return link
+	}
+	if err := checkPublicHost(host); err != nil {
+		log.Printf("Could not resolve [[%s@%s]]: %v\n", name, host, err)
+		link.Broken = true
+		return link
+	}
+
+	jrd, err := getCachedObject(objects, webFingerCacheId(name, host), "JRD", func() ([]byte, error) {
+		response, err := webFingerLookup(name, host)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(response)
+	})
+	if err != nil {
+		log.Printf("Could not resolve [[%s@%s]]: %v\n", name, host, err)
+		link.Broken = true
+		return link
+	}
+	if href := profileHref(jrd); href != "" {
+		if err := checkPublicURL(href); err != nil {
+			log.Printf("Not following [[%s@%s]] to %v: %v\n", name, host, href, err)
+		} else {
+			link.Href = href
+		}
+	}
+
+	raw, err := getCachedObject(objects, link.Href, "Article", func() ([]byte, error) {
+		resp, err := httpsig.Get(link.Href, "application/activity+json")
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("Fetching %v returned %v", link.Href, resp.Status)
+		}
+		return io.ReadAll(resp.Body)
+	})
+	if err != nil {
+		// The page exists, since WebFinger found it, but there's
+		// no preview.
+		log.Println(err)
+		return link
+	}
+	link.Summary = articleSummary(raw)
+	return link
+}
+
+// cachedFederatedLink returns what's known about [[name@host]] without
+// fetching anything, and whether it's up to date.
+func cachedFederatedLink(objects activitypub.ObjectDatabase, name, host string) (remoteLink, bool) {
+	link := remoteLink{Href: "https://" + host + pages.Root + name}
+	if strings.EqualFold(host, os.Getenv("fediwikidomain")) {
+		return link, true
+	}
+	linkAttempts.Lock()
+	attempt, ok := linkAttempts.links[name+"@"+host]
+	linkAttempts.Unlock()
+	if ok && attempt.Broken && time.Since(attempt.At) < brokenLinkExpiry {
+		link.Broken = true
+		return link, true
+	}
+
+	jrd, fresh := readCachedObject(objects, webFingerCacheId(name, host))
+	if jrd.Object == nil {
+		return link, false
+	}
+	if href := profileHref(jrd.Object); href != "" {
+		link.Href = href
+	}
+	article, articlefresh := readCachedObject(objects, link.Href)
+	if article.Object == nil {
+		return link, false
+	}
+	link.Summary = articleSummary(article.Object)
+	return link, fresh && articlefresh
+}
+
+// refreshFederatedLink resolves [[name@host]] in the background, unless
+// it's already being resolved or was tried recently.
+func refreshFederatedLink(objects activitypub.ObjectDatabase, name, host string) {
+	key := name + "@" + host
+	linkAttempts.Lock()
+	defer linkAttempts.Unlock()
+	now := time.Now()
+	if attempt, ok := linkAttempts.links[key]; ok && (attempt.Running || now.Sub(attempt.At) < brokenLinkExpiry) {
+		return
+	}
+	if len(linkAttempts.links) >= maxLinkAttempts {
+		for k, attempt := range linkAttempts.links {
+			if !attempt.Running && now.Sub(attempt.At) >= brokenLinkExpiry {
+				delete(linkAttempts.links, k)
+			}
+		}
+		if len(linkAttempts.links) >= maxLinkAttempts {
+			// Try again once some have expired.
+			return
+		}
+	}
+	linkAttempts.links[key] = linkAttempt{At: now, Running: true}
+	go func() {
+		link := resolveFederatedLink(objects, name, host)
+		linkAttempts.Lock()
+		linkAttempts.links[key] = linkAttempt{At: time.Now(), Broken: link.Broken}
+		linkAttempts.Unlock()
+	}()
+}
+
+// refreshFederatedLinks resolves every [[Page@host]] link in content in
+// the background, so that they're cached before the page is viewed.
+func refreshFederatedLinks(objects activitypub.ObjectDatabase, content string) {
+	for _, pieces := range federatedLink.FindAllStringSubmatch(content, -1) {
+		refreshFederatedLink(objects, pieces[1], pieces[2])
+	}
+}
+
+// renderFederatedLink returns the HTML for a [[name@host]] link. If
+// objects is nil the link isn't resolved. Otherwise, the cached copy of
+// the link is used, and it's refreshed in the background if it's missing
+// or out of date.
+func renderFederatedLink(objects activitypub.ObjectDatabase, name, host string) string {
+	link := remoteLink{Href: "https://" + host + pages.Root + name}
+	if objects != nil {
+		var fresh bool
+		if link, fresh = cachedFederatedLink(objects, name, host); !fresh {
+			refreshFederatedLink(objects, name, host)
+		}
+	}
+	class := "federated"
+	title := link.Summary
+	if link.Broken {
+		class += " broken"
+		title = fmt.Sprintf("%s does not exist on %s", name, host)
+	}
+	return fmt.Sprintf(`<a class="%s" href="%s" title="%s">%s (%s)</a>`, class, template.HTMLEscapeString(link.Href), template.HTMLEscapeString(title), name, host)
+}
+
+// replaceFederatedLinks replaces the [[Page@host]] links in content.
+func replaceFederatedLinks(content string, objects activitypub.ObjectDatabase) string {
+	return federatedLink.ReplaceAllStringFunc(content, func(match string) string {
+		pieces := federatedLink.FindStringSubmatch(match)
+		return renderFederatedLink(objects, pieces[1], pieces[2])
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"fediwiki/pages"
+	"fediwiki/session"
+)
+
+var handleRe = regexp.MustCompile(`^@?([^@\s]+)@([^@\s/]+)$`)
+
+// renderFollowForm returns the "Follow this page" form shown on each
+// page, for people who aren't logged in to follow from their own server.
+func renderFollowForm(pagename string) template.HTML {
+	return template.HTML(fmt.Sprintf(`<form method="get" action="%s/follow"><input type="text" name="handle" placeholder="@you@your.server"><input type="submit" value="Follow this page"></form>`, template.HTMLEscapeString(pages.Root+pagename)))
+}
+
+// remoteInteractionURL returns the URL on the handle's server to follow
+// the actor with id actorid from, using the server's subscribe template
+// if it has one. The URL must be on the handle's server, so that the
+// follow page can't be used to redirect people anywhere else.
+func remoteInteractionURL(handle, actorid string) (string, error) {
+	pieces := handleRe.FindStringSubmatch(strings.TrimSpace(handle))
+	if pieces == nil {
+		return "", fmt.Errorf("Invalid handle %v", handle)
+	}
+	user, host := pieces[1], pieces[2]
+	server, err := url.Parse("https://" + host)
+	if err != nil || server.Host != host {
+		return "", fmt.Errorf("Invalid handle %v", handle)
+	}
+	if err := checkPublicHost(server.Hostname()); err != nil {
+		return "", err
+	}
+	tmpl := "https://" + host + "/authorize_interaction?uri={uri}"
+	if webfinger, err := webFingerLookup(user, host); err != nil {
+		return "", err
+	} else if t := webfinger.Template("http://ostatus.org/schema/1.0/subscribe"); t != "" {
+		tmpl = t
+	}
+	target := strings.Replace(tmpl, "{uri}", url.QueryEscape(actorid), -1)
+	if u, err := url.Parse(target); err != nil || u.Scheme != "https" || !strings.EqualFold(u.Host, host) {
+		return "", fmt.Errorf("Invalid subscribe template %v", tmpl)
+	}
+	return target, nil
+}
+
+// remoteFollow asks for the user's handle and redirects them to their
+// server to follow the page.
+func remoteFollow(sess *session.Session, pagename string, pagesdb pages.PagesDatabase, w http.ResponseWriter, r *http.Request) {
+	actor, err := pagesdb.GetPageActor(pagename)
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+	var message string
+	if handle := r.URL.Query().Get("handle"); handle != "" {
+		target, err := remoteInteractionURL(handle, actor.Id)
+		if err == nil {
+			http.Redirect(w, r, target, http.StatusSeeOther)
+			return
+		}
+		log.Println(err)
+		message = "<p>Could not find your server. Check your handle and try again.</p>"
+	}
+	pageTemplate.Execute(
+		w,
+		PageTemplateData{
+			Title:   "Follow " + pagename,
+			Header:  getHeader(sess, pagename),
+			Content: template.HTML(message+"<p>Enter your fediverse handle to follow this page from your server.</p>") + renderFollowForm(pagename),
+		},
+	)
+}
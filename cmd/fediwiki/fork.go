@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"fediwiki/activitypub"
+	"fediwiki/outbox"
+	"fediwiki/pages"
+	"fediwiki/session"
+)
+
+// forkForm is shown when creating a page, to copy it from another wiki
+// instead.
+var forkForm = template.Must(template.New("ForkForm").Parse(`
+        <form method="post" action="` + pages.Root + `{{.}}/fork">
+            <fieldset>
+                <legend>Or fork it from another wiki</legend>
+                <input type="text" name="remote" placeholder="Page@wiki.example or https://wiki.example/pages/Page">
+                <input type="submit" value="Fork">
+            </fieldset>
+        </form>
+`))
+
+// remoteArticleURL returns the URL of the Article for a page on another
+// wiki, given either its URL or Page@host.
+func remoteArticleURL(remote string) (string, error) {
+	remote = strings.TrimSpace(remote)
+	if strings.HasPrefix(remote, "https://") {
+		if err := checkPublicURL(remote); err != nil {
+			return "", err
+		}
+		return remote, nil
+	}
+	pieces := handleRe.FindStringSubmatch(remote)
+	if pieces == nil {
+		return "", fmt.Errorf("Invalid page %v", remote)
+	}
+	name, host := pieces[1], pieces[2]
+	if err := checkPublicHost(host); err != nil {
+		return "", err
+	}
+	webfinger, err := webFingerLookup(name, host)
+	if err != nil {
+		return "", err
+	}
+	if href := webfinger.Link("http://webfinger.net/rel/profile-page", ""); href != "" {
+		if err := checkPublicURL(href); err != nil {
+			return "", err
+		}
+		return href, nil
+	}
+	return "https://" + host + pages.Root + name, nil
+}
+
+// forkPage creates the page pagename as a copy of a page on another
+// wiki, and follows the original so that later changes to it are
+// proposed as changes to the copy. Only the current version of the
+// original is copied.
+func forkPage(pagesdb pages.PagesDatabase, db pages.Persister, actors activitypub.ActorDatabase, pagename, remote, editor string) (*pages.Revision, error) {
+	if _, err := db.GetPage(pagename); err == nil {
+		return nil, fmt.Errorf("%v already exists", pagename)
+	}
+	articleurl, err := remoteArticleURL(remote)
+	if err != nil {
+		return nil, err
+	}
+	article, err := outbox.FetchArticle(articleurl)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPublicURL(article.AttributedTo); err != nil {
+		return nil, err
+	}
+	upstream, err := outbox.GetActor(actors, article.AttributedTo)
+	if err != nil {
+		return nil, err
+	}
+
+	page := pages.PageFromArticle(pagename, *article)
+	actor, err := getOrCreatePageActor(pagesdb, page, os.Getenv("fediwikidomain"))
+	if err != nil {
+		return nil, err
+	}
+	rev, err := db.SavePageRevision(page, *actor, pages.Revision{Editor: editor, Origin: article.Id})
+	if err != nil {
+		return nil, err
+	}
+	if err := pagesdb.SetUpstream(pagename, upstream.Id, article.Id); err != nil {
+		return rev, err
+	}
+	if err := pagesdb.SetUpstreamVersion(pagename, page.Version()); err != nil {
+		return rev, err
+	}
+
+	if err := followUpstream(pagesdb, actors, pagename); err != nil {
+		return rev, fmt.Errorf("Forked %v but could not follow %v: %w", pagename, upstream.Id, err)
+	}
+	return rev, nil
+}
+
+// followUpstream sends a Follow from a forked page to the page it was
+// forked from.
+func followUpstream(pagesdb pages.PagesDatabase, actors activitypub.ActorDatabase, pagename string) error {
+	upstreamid, _, err := pagesdb.GetUpstream(pagename)
+	if err != nil {
+		return err
+	}
+	if upstreamid == "" {
+		return fmt.Errorf("%v is not a fork", pagename)
+	}
+	if err := checkPublicURL(upstreamid); err != nil {
+		return err
+	}
+	upstream, err := outbox.GetActor(actors, upstreamid)
+	if err != nil {
+		return err
+	}
+	if err := checkPublicURL(upstream.Inbox); err != nil {
+		return err
+	}
+	actor, err := pagesdb.GetPageActor(pagename)
+	if err != nil {
+		return err
+	}
+	var idrand [32]byte
+	if _, err := rand.Read(idrand[:]); err != nil {
+		return err
+	}
+	follow := activitypub.Follow{
+		BaseProperties: activitypub.BaseProperties{
+			Context: activitypub.JSONLDContext{"https://www.w3.org/ns/activitystreams"},
+			Id:      actor.Id + "#follow-" + base64.URLEncoding.EncodeToString(idrand[:]),
+			Type:    "Follow",
+			Actor:   actor.Id,
+		},
+		Object: upstream.Id,
+	}
+	bytes, err := json.Marshal(follow)
+	if err != nil {
+		return err
+	}
+	return outbox.Send(pagesdb, pagename, *upstream, activitypub.Object{Id: follow.Id, Type: follow.Type, RawBytes: bytes})
+}
+
+// forkHandler forks a page from the remote page given in the form.
+func forkHandler(session *session.Session, pagename string, pagesdb pages.PagesDatabase, db pages.Persister, actors activitypub.ActorDatabase, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Add("Allow", "POST")
+		w.WriteHeader(405)
+		return
+	}
+	if !hasEditPermission(session) {
+		w.WriteHeader(403)
+		fmt.Fprintf(w, "Permission denied")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		badRequest(w, r)
+		return
+	}
+	if r.Form.Get("action") == "follow" {
+		// Retrying the Follow of a page which has already been forked.
+		if err := followUpstream(pagesdb, actors, pagename); err != nil {
+			log.Println(err)
+			followFailed(session, pagename, err, w)
+			return
+		}
+		http.Redirect(w, r, pages.Root+pagename, http.StatusSeeOther)
+		return
+	}
+	rev, err := forkPage(pagesdb, db, actors, pagename, r.Form.Get("remote"), session.Get("OAuthAuthenticatedUsername"))
+	if err != nil {
+		log.Println(err)
+		if rev == nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Could not fork page: %v\n", err)
+			return
+		}
+		followFailed(session, pagename, err, w)
+		return
+	}
+	http.Redirect(w, r, pages.Root+pagename, http.StatusSeeOther)
+}
+
+// followFailed tells the user that a forked page couldn't follow its
+// upstream, so it won't receive changes to it, and lets them try again.
+func followFailed(session *session.Session, pagename string, err error, w http.ResponseWriter) {
+	w.WriteHeader(502)
+	content := fmt.Sprintf(`<p>%s</p><p>Changes to the original page won't be proposed until it's followed.</p><form method="post" action="%s%s/fork"><input type="hidden" name="action" value="follow"><input type="submit" value="Try again"></form><p><a href="%[2]s%[3]s">Go to the page</a></p>`, template.HTMLEscapeString(err.Error()), pages.Root, template.HTMLEscapeString(pagename))
+	pageTemplate.Execute(
+		w,
+		PageTemplateData{
+			Title:   "Could not follow the original of " + pagename,
+			Header:  getHeader(session, pagename),
+			Content: template.HTML(content),
+		},
+	)
+}
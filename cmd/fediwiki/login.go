@@ -15,6 +15,7 @@ import (
 	"os"
 	"regexp"
 
+	"fediwiki/activitypub"
 	"fediwiki/oauth"
 	"fediwiki/pages"
 	"fediwiki/session"
@@ -24,7 +25,7 @@ import (
 
 var loginTemplate *template.Template
 
-func loginHandler(clientDB oauth.ClientStore, sessionDB session.Store) func(w http.ResponseWriter, r *http.Request) {
+func loginHandler(clientDB oauth.ClientStore, sessionDB session.Store, blocks activitypub.BlockList) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println("URL", r.URL.Path)
 		session, err := session.Start(sessionDB, w, r)
@@ -48,6 +49,11 @@ func loginHandler(clientDB oauth.ClientStore, sessionDB session.Store) func(w ht
 					io.WriteString(w, "Internal error")
 					return
 				}
+				if blocks.IsDomainBlocked(host) {
+					w.WriteHeader(403)
+					io.WriteString(w, "Logins from this instance are blocked")
+					return
+				}
 
 				client, err := clientDB.GetClient(host)
 
@@ -72,6 +78,7 @@ func loginHandler(clientDB oauth.ClientStore, sessionDB session.Store) func(w ht
 				}
 				session.Set("OAuthBearerToken", tok.AccessToken)
 				session.Set("OAuthAuthenticatedUsername", session.Get("ClaimedUsername"))
+				session.Set("OAuthAuthenticatedActor", session.Get("ClaimedActor"))
 				if err := sessionDB.SaveSession(session); err != nil {
 					w.WriteHeader(500)
 					return
@@ -109,53 +116,31 @@ func loginHandler(clientDB oauth.ClientStore, sessionDB session.Store) func(w ht
 			}
 			user := pieces[1]
 			host := pieces[2]
-
-			webfingerURI := fmt.Sprintf("https://%s/.well-known/webfinger?resource=%s@%s", host, user, host)
-			resp, err := http.Get(webfingerURI)
-			if err != nil {
-				log.Println(err)
-				w.WriteHeader(400)
-				io.WriteString(w, "Bad username")
-				return
-			}
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				log.Println(err)
-				w.WriteHeader(500)
-				io.WriteString(w, "Error")
+			if blocks.IsDomainBlocked(host) {
+				w.WriteHeader(403)
+				io.WriteString(w, "Logins from this instance are blocked")
 				return
 			}
-			fmt.Println(string(body))
 
-			var webFingerResponse struct {
-				Subject string   `json:"subject"`
-				Aliases []string `json:"aliases"`
-				Links   []struct {
-					Rel  string `json:"rel"`
-					Type string `json:"type"`
-					Href string `json:"href"`
-				} `json:"links"`
-			}
-			var actorID string
-			if err := json.Unmarshal(body, &webFingerResponse); err != nil {
+			webfinger, err := webFingerLookup(user, host)
+			if err != nil {
 				log.Println(err)
 				w.WriteHeader(400)
 				io.WriteString(w, "Bad username")
 				return
 			}
-			for _, link := range webFingerResponse.Links {
-				if link.Type == "application/activity+json" && link.Rel == "self" {
-					actorID = link.Href
-					break
-				}
-
-			}
-			fmt.Println(actorID)
+			actorID := webfinger.Link("self", "application/activity+json")
 			parsedActor, err := url.Parse(actorID)
 			if err != nil {
 				log.Println(err)
 				w.WriteHeader(400)
 				io.WriteString(w, "Bad username")
+				return
+			}
+			if blocks.IsBlocked(actorID) {
+				w.WriteHeader(403)
+				io.WriteString(w, "This account is blocked")
+				return
 			}
 			client, err := clientDB.GetClient(parsedActor.Hostname())
 			if err != nil {
@@ -189,6 +174,7 @@ func loginHandler(clientDB oauth.ClientStore, sessionDB session.Store) func(w ht
 			theState := base64.URLEncoding.EncodeToString(stateRand[:])
 
 			session.Set("OAuthState", theState)
+			session.Set("ClaimedActor", actorID)
 			session.Set("OAuthHost", parsedActor.Hostname())
 			if err := sessionDB.SaveSession(session); err != nil {
 				w.WriteHeader(500)
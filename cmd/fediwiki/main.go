@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/json"
@@ -15,6 +16,7 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	"fediwiki/activitypub"
 	"fediwiki/filesystemdb"
@@ -77,7 +79,10 @@ func getHeader(s *session.Session, pagename string) template.HTML {
 	var b bytes.Buffer
 	if s != nil {
 		if user := s.Get("OAuthAuthenticatedUsername"); user != "" {
-			if err := loggedInHeader.Execute(&b, struct{ PageName, Username string }{pagename, user}); err != nil {
+			if err := loggedInHeader.Execute(&b, struct {
+				PageName, Username string
+				Admin              bool
+			}{pagename, user, isAdmin(s)}); err != nil {
 				panic(err)
 			}
 			return template.HTML(b.Bytes())
@@ -95,6 +100,12 @@ func createPage(session *session.Session, page string, adb pages.PagesDatabase,
 		w.WriteHeader(500)
 		return
 	}
+	if hasEditPermission(session) {
+		if err := forkForm.Execute(&b, page); err != nil {
+			w.WriteHeader(500)
+			return
+		}
+	}
 	pageTemplate.Execute(
 		w,
 		PageTemplateData{
@@ -113,7 +124,18 @@ func hasEditPermission(session *session.Session) bool {
 	return session.Get("OAuthAuthenticatedUsername") != ""
 }
 
-func pagehistory(session *session.Session, pagename string, historydb pages.Persister, w http.ResponseWriter, r *http.Request) {
+// sortNewestFirst sorts revisions by their edit time, newest first, with
+// any that don't have a time at the end.
+func sortNewestFirst(revs []pages.Revision) {
+	sort.SliceStable(revs, func(i, j int) bool {
+		if revs[i].EditTime == nil || revs[j].EditTime == nil {
+			return revs[j].EditTime == nil && revs[i].EditTime != nil
+		}
+		return revs[i].EditTime.After(*(revs[j].EditTime))
+	})
+}
+
+func pagehistory(session *session.Session, pagename string, historydb pages.Persister, activityDb activitypub.ActivityDatabase, w http.ResponseWriter, r *http.Request) {
 	revs, err := historydb.GetPageRevisions(pagename)
 	if err != nil {
 		notFound(w, r)
@@ -122,11 +144,13 @@ func pagehistory(session *session.Session, pagename string, historydb pages.Pers
 
 	var b bytes.Buffer
 	fmt.Fprintf(&b, "<ul>\n")
-	sort.Slice(revs, func(i, j int) bool {
-		return revs[i].EditTime.After(*(revs[j].EditTime))
-	})
+	sortNewestFirst(revs)
 	for _, rev := range revs {
-		fmt.Fprintf(&b, `<li><a href="%s%s/history/%s">%v</a>: edited by %v (<a href="%s%s/history/%s/diff">diff</a>)</li>`, pages.Root, pagename, rev.RevisionID, rev.EditTime, rev.Editor, pages.Root, pagename, rev.RevisionID)
+		var origin string
+		if rev.Origin != "" {
+			origin = fmt.Sprintf(` from <a href="%[1]s">%[1]s</a>`, template.HTMLEscapeString(rev.Origin))
+		}
+		fmt.Fprintf(&b, `<li><a href="%s%s/history/%s">%v</a>: edited by %v%s (<a href="%s%s/history/%s/diff">diff</a>) %s</li>`, pages.Root, pagename, rev.RevisionID, rev.EditTime, template.HTMLEscapeString(rev.Editor), origin, pages.Root, pagename, rev.RevisionID, reactionCounts(activityDb, rev.DiffNote("").Id))
 	}
 	fmt.Fprintf(&b, "</ul>")
 	pageTemplate.Execute(
@@ -139,7 +163,7 @@ func pagehistory(session *session.Session, pagename string, historydb pages.Pers
 	)
 }
 
-func renderTalkThread(note activitypub.Note, allPageNotes []activitypub.Note, actors activitypub.ActorDatabase) string {
+func renderTalkThread(note activitypub.Note, allPageNotes []activitypub.Note, actors activitypub.ActorDatabase, admin bool) string {
 	var content strings.Builder
 	var replies []activitypub.Note
 
@@ -149,6 +173,21 @@ func renderTalkThread(note activitypub.Note, allPageNotes []activitypub.Note, ac
 		}
 	}
 
+	if note.Type == "Tombstone" {
+		// Deleted notes are only shown as a placeholder so that any
+		// replies to them still make sense.
+		if len(replies) == 0 {
+			return ""
+		}
+		fmt.Fprintf(&content, "<div><div><em>This note has been deleted.</em></div>")
+		fmt.Fprintf(&content, "<div style=\"padding: 5px; margin-left: 35px;\">")
+		for _, n := range replies {
+			fmt.Fprintf(&content, "%v", renderTalkThread(n, allPageNotes, actors, admin))
+		}
+		fmt.Fprintf(&content, "</div></div>")
+		return content.String()
+	}
+
 	var actordisplay string
 	act, err := actors.GetForeignActor(note.AttributedTo)
 	if err != nil {
@@ -158,10 +197,13 @@ func renderTalkThread(note activitypub.Note, allPageNotes []activitypub.Note, ac
 	}
 
 	fmt.Fprintf(&content, "<div><div>%v</div><div>- by <a href=\"%s\">%s</a> @ %v</div>", note.Content, note.AttributedTo, actordisplay, note.Published)
+	if admin {
+		fmt.Fprintf(&content, "%v", renderReportForm(note))
+	}
 	if len(replies) > 0 {
 		fmt.Fprintf(&content, "<div style=\"padding: 5px; margin-left: 35px;\">")
 		for _, n := range replies {
-			reply := renderTalkThread(n, allPageNotes, actors)
+			reply := renderTalkThread(n, allPageNotes, actors, admin)
 			fmt.Fprintf(&content, "%v", reply)
 		}
 		fmt.Fprintf(&content, "</div>")
@@ -169,7 +211,11 @@ func renderTalkThread(note activitypub.Note, allPageNotes []activitypub.Note, ac
 	fmt.Fprintf(&content, "</div>")
 	return content.String()
 }
-func talkpage(session *session.Session, pagename string, pagedb pages.Persister, actors activitypub.ActorDatabase, w http.ResponseWriter, r *http.Request) {
+func talkpage(session *session.Session, pagename string, pagesdb pages.PagesDatabase, pagedb pages.Persister, actors activitypub.ActorDatabase, activityDb activitypub.ActivityDatabase, w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		postTalkForm(session, pagename, pagesdb, pagedb, actors, activityDb, w, r)
+		return
+	}
 	notes, err := pagedb.GetPageNotes(pagename)
 	if err != nil {
 		notFound(w, r)
@@ -178,7 +224,10 @@ func talkpage(session *session.Session, pagename string, pagedb pages.Persister,
 	var content strings.Builder
 	for _, note := range notes {
 		if note.InReplyTo == nil {
-			fmt.Fprintf(&content, "%v", renderTalkThread(note, notes, actors))
+			fmt.Fprintf(&content, "%v", renderTalkThread(note, notes, actors, isAdmin(session)))
+			if hasEditPermission(session) && note.Type != "Tombstone" {
+				fmt.Fprintf(&content, "%v", renderReplyForm(r.URL.Path, note.Id, "Reply"))
+			}
 		}
 	}
 	pageTemplate.Execute(
@@ -192,27 +241,35 @@ func talkpage(session *session.Session, pagename string, pagedb pages.Persister,
 
 }
 
-func renderPage(page pages.Page) template.HTML {
+func renderPage(page pages.Page, objects activitypub.ObjectDatabase) template.HTML {
+	return renderPageLinks(page, pages.Root+"$1", 0, objects)
+}
+
+// renderPageLinks renders page to HTML, replacing [[Page]] links with
+// links to internalHref. $1 in internalHref is replaced by the name of the
+// linked page. flags are added to the flags of the markdown renderer.
+// [[Page@host]] links to other wikis are resolved using objects as a
+// cache, unless it's nil.
+func renderPageLinks(page pages.Page, internalHref string, flags html.Flags, objects activitypub.ObjectDatabase) template.HTML {
 	contentparser := parser.NewWithExtensions(parser.CommonExtensions)
-	summaryrenderer := html.NewRenderer(html.RendererOptions{Flags: html.CommonFlags | html.SkipHTML})
-	contentrenderer := html.NewRenderer(html.RendererOptions{Flags: html.CommonFlags | html.SkipHTML | html.TOC})
+	summaryrenderer := html.NewRenderer(html.RendererOptions{Flags: html.CommonFlags | html.SkipHTML | flags})
+	contentrenderer := html.NewRenderer(html.RendererOptions{Flags: html.CommonFlags | html.SkipHTML | html.TOC | flags})
 
-	federatedLink := regexp.MustCompile(`\[\[([[:alpha:]]+)@([[:alpha:]\.]+)\]\]`)
 	internalLink := regexp.MustCompile(`\[\[([[:alpha:]]+)\]\]`)
 
 	content := string(markdown.ToHTML([]byte(page.Content), contentparser, contentrenderer))
-	content = federatedLink.ReplaceAllString(content, `<a href="https://$2/`+pages.Root+` "/$1">$1 ($2)</a>`)
-	content = internalLink.ReplaceAllString(content, `<a href="`+pages.Root+`/$1">$1</a>`)
+	content = replaceFederatedLinks(content, objects)
+	content = internalLink.ReplaceAllString(content, `<a href="`+internalHref+`">$1</a>`)
 	var summary string
 	if page.Summary != "" {
 		summaryparser := parser.NewWithExtensions(parser.CommonExtensions)
 		summary = string(markdown.ToHTML([]byte(page.Summary), summaryparser, summaryrenderer))
-		summary = federatedLink.ReplaceAllString(summary, `<a href="https://$2/`+pages.Root+` "/$1">$1 ($2)</a>`)
-		summary = internalLink.ReplaceAllString(summary, `<a href="`+pages.Root+`/$1">$1</a>`)
+		summary = replaceFederatedLinks(summary, objects)
+		summary = internalLink.ReplaceAllString(summary, `<a href="`+internalHref+`">$1</a>`)
 	}
 	return template.HTML(summary + content)
 }
-func wikipagerev(session *session.Session, pagename, rev string, db pages.Persister, w http.ResponseWriter, r *http.Request) {
+func wikipagerev(session *session.Session, pagename, rev string, db pages.Persister, objectDB activitypub.ObjectDatabase, w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		page, err := db.GetPageRevision(pagename, rev)
@@ -220,7 +277,13 @@ func wikipagerev(session *session.Session, pagename, rev string, db pages.Persis
 			notFound(w, r)
 			return
 		}
-		content := renderPage(*page)
+		if format := r.URL.Query().Get("format"); format != "" {
+			if !servePageFormat(w, *page, findRevision(pagename, rev, db), format) {
+				badRequest(w, r)
+			}
+			return
+		}
+		content := renderPage(*page, objectDB)
 		pageTemplate.Execute(
 			w,
 			PageTemplateData{
@@ -271,7 +334,7 @@ func pageDiff(pagename, rev string, db pages.Persister) (string, *pages.Page, *p
 	return diff, page, thisrev, nil
 }
 
-func wikipagerevdiff(session *session.Session, pagename, rev string, db pages.Persister, w http.ResponseWriter, r *http.Request, iscreatenote bool) {
+func wikipagerevdiff(session *session.Session, pagename, rev string, pagesdb pages.PagesDatabase, db pages.Persister, actors activitypub.ActorDatabase, activityDb activitypub.ActivityDatabase, w http.ResponseWriter, r *http.Request, iscreatenote bool) {
 	switch r.Method {
 	case "GET":
 		diff, page, thisrev, err := pageDiff(pagename, rev, db)
@@ -287,6 +350,12 @@ func wikipagerevdiff(session *session.Session, pagename, rev string, db pages.Pe
 				w.Header().Set("Content-Type", `application/ld+json; profile="https://www.w3.org/ns/activitystreams"`)
 			}
 			note := thisrev.DiffNote(diff)
+			if note.Likes, err = reactionCollection(activityDb, note.Id, "likes", false); err != nil {
+				log.Println(err)
+			}
+			if note.Shares, err = reactionCollection(activityDb, note.Id, "shares", false); err != nil {
+				log.Println(err)
+			}
 			if iscreatenote {
 				create := activitypub.CreateNote{
 					BaseProperties: activitypub.BaseProperties{
@@ -318,22 +387,156 @@ func wikipagerevdiff(session *session.Session, pagename, rev string, db pages.Pe
 				w.Write(bytes)
 			}
 		} else {
+			var content strings.Builder
+			fmt.Fprintf(&content, "<pre>%s</pre>", template.HTMLEscapeString(diff))
+			fmt.Fprintf(&content, "<h2>Discussion</h2>")
+			noteid := thisrev.DiffNote("").Id
+			// A page without any notes yet doesn't have a notes database,
+			// so errors only mean there's nothing to discuss.
+			notes, _ := db.GetPageNotes(pagename)
+			for _, note := range notes {
+				if note.InReplyTo != nil && *note.InReplyTo == noteid {
+					fmt.Fprintf(&content, "%v", renderTalkThread(note, notes, actors, isAdmin(session)))
+					if hasEditPermission(session) && note.Type != "Tombstone" {
+						fmt.Fprintf(&content, "%v", renderReplyForm(r.URL.Path, note.Id, "Reply"))
+					}
+				}
+			}
+			if hasEditPermission(session) {
+				fmt.Fprintf(&content, "%v", renderReplyForm(r.URL.Path, noteid, "Comment on this change"))
+			}
 			pageTemplate.Execute(
 				w,
 				PageTemplateData{
 					Title:   page.Title,
 					Header:  getHeader(session, pagename),
-					Content: template.HTML("<pre>" + diff + "</pre>"),
+					Content: template.HTML(content.String()),
 				},
 			)
 		}
+	case "POST":
+		if iscreatenote {
+			w.Header().Add("Allow", "GET")
+			w.WriteHeader(405)
+			return
+		}
+		postTalkForm(session, pagename, pagesdb, db, actors, activityDb, w, r)
 	default:
+		w.Header().Add("Allow", "GET,POST")
 		w.WriteHeader(405)
-		w.Header().Add("Allow", "GET")
 		io.WriteString(w, "Invalid method")
 	}
 }
-func wikipage(session *session.Session, pagename string, pagesdb pages.PagesDatabase, db pages.Persister, actors activitypub.ActorDatabase, w http.ResponseWriter, r *http.Request) {
+
+// getOrCreatePageActor returns the actor for page, creating it with a new
+// key if the page doesn't have one yet.
+func getOrCreatePageActor(pagesdb pages.PagesDatabase, page pages.Page, domain string) (*activitypub.Actor, error) {
+	pageactor, err := pagesdb.GetPageActor(page.PageName)
+	if err == filesystemdb.NotFound {
+		key, err := rsa.GenerateKey(rand.Reader, 4096)
+		if err != nil {
+			return nil, err
+		}
+		return pagesdb.NewPageActor(page, domain, key, &key.PublicKey)
+	}
+	return pageactor, err
+}
+
+// pageArticle returns the Article representing the current version of
+// page.
+func pageArticle(page pages.Page, db pages.Persister, activityDb activitypub.ActivityDatabase) (activitypub.Article, error) {
+	var published, updated *time.Time
+	if revs, err := db.GetPageRevisions(page.PageName); err == nil && len(revs) > 0 {
+		published = revs[0].EditTime
+		updated = revs[len(revs)-1].EditTime
+	}
+	article := page.Article(string(renderPageLinks(page, "https://"+os.Getenv("fediwikidomain")+pages.Root+"$1", 0, nil)), published, updated)
+	var err error
+	if article.Likes, err = reactionCollection(activityDb, article.Id, "likes", false); err != nil {
+		return article, err
+	}
+	if article.Shares, err = reactionCollection(activityDb, article.Id, "shares", false); err != nil {
+		return article, err
+	}
+	return article, nil
+}
+
+// getOrCreateInstanceActor returns the wiki's instance actor, creating it
+// the first time it's needed.
+func getOrCreateInstanceActor(pagesdb pages.PagesDatabase, domain string) (*activitypub.Actor, crypto.PrivateKey, error) {
+	actor, key, err := pagesdb.GetInstanceActor()
+	if err == filesystemdb.NotFound {
+		key, err := rsa.GenerateKey(rand.Reader, 4096)
+		if err != nil {
+			return nil, nil, err
+		}
+		actor, err := pagesdb.NewInstanceActor(domain, key, &key.PublicKey)
+		return actor, key, err
+	}
+	return actor, key, err
+}
+
+// writeActivityJSON writes v as JSON with the ActivityPub content type
+// requested by r.
+func writeActivityJSON(v interface{}, w http.ResponseWriter, r *http.Request) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		internalError(w, r)
+		return
+	}
+	if ctype := wantJSONType(r); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	} else {
+		w.Header().Set("Content-Type", `application/ld+json; profile="https://www.w3.org/ns/activitystreams"`)
+	}
+	w.Write(bytes)
+}
+
+// instanceActor serves the instance actor. It's always served without
+// requiring a signature, since other servers need its key to validate
+// our signed fetches.
+func instanceActor(actor activitypub.Actor) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeActivityJSON(actor, w, r)
+	}
+}
+
+// instanceOutbox serves the instance actor's outbox, which is always
+// empty since it only signs requests and never publishes anything.
+func instanceOutbox(actor activitypub.Actor) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeActivityJSON(activitypub.Collection{
+			Context: activitypub.JSONLDContext{"https://www.w3.org/ns/activitystreams"},
+			Id:      actor.Outbox,
+			Type:    "OrderedCollection",
+		}, w, r)
+	}
+}
+
+// authorizedFetch is set by the fediwikiauthorizedfetch environment
+// variable. When it's set, ActivityPub representations of pages and their
+// revisions are only served to requests with a valid HTTP signature.
+// Actors are still served without one so that the keys needed to validate
+// signatures can be fetched.
+var authorizedFetch = os.Getenv("fediwikiauthorizedfetch") == "true"
+
+// isActivityPubGet returns true if r is a request for an ActivityPub
+// object other than an actor.
+func isActivityPubGet(r *http.Request, urlPieces []string) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	switch urlPieces[len(urlPieces)-1] {
+	case "actor":
+		return false
+	case "diff.activity", "likes", "shares":
+		return true
+	}
+	return wantJSONType(r) != ""
+}
+
+func wikipage(session *session.Session, pagename string, pagesdb pages.PagesDatabase, db pages.Persister, objectDB activitypub.ObjectDatabase, actors activitypub.ActorDatabase, activityDb activitypub.ActivityDatabase, w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		page, err := db.GetPage(pagename)
@@ -360,8 +563,36 @@ func wikipage(session *session.Session, pagename string, pagesdb pages.PagesData
 			return
 
 		}
+		if format := r.URL.Query().Get("format"); format != "" {
+			if !servePageFormat(w, *page, latestRevision(pagename, db), format) {
+				badRequest(w, r)
+			}
+			return
+		}
+		if ctype := wantJSONType(r); ctype != "" {
+			article, err := pageArticle(*page, db, activityDb)
+			if err != nil {
+				log.Println(err)
+				internalError(w, r)
+				return
+			}
+			bytes, err := json.Marshal(article)
+			if err != nil {
+				log.Println(err)
+				internalError(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", ctype)
+			w.Write(bytes)
+			return
+		}
 		w.WriteHeader(200)
-		content := renderPage(*page)
+		content := renderPage(*page, objectDB)
+		footer := proposalsLink(pagesdb, pagename) + renderFollowForm(pagename)
+		if counts := reactionCounts(activityDb, "https://"+os.Getenv("fediwikidomain")+pages.Root+pagename); counts != "" {
+			footer = counts + footer
+		}
+		content += "<footer>" + footer + "</footer>"
 
 		pageTemplate.Execute(
 			w,
@@ -389,71 +620,24 @@ func wikipage(session *session.Session, pagename string, pagesdb pages.PagesData
 			Summary:  r.Form.Get("summary"),
 			Content:  r.Form.Get("content"),
 		}
-		pageactor, err := pagesdb.GetPageActor(pagename)
-		if err == filesystemdb.NotFound {
-			key, err := rsa.GenerateKey(rand.Reader, 4096)
-			if err != nil {
-				log.Println(err)
-				w.WriteHeader(500)
-				io.WriteString(w, "Internal server error")
-				return
-			}
-			a2, err := pagesdb.NewPageActor(page, r.Host, key, &key.PublicKey)
-			if err != nil {
-				log.Println(err)
-				w.WriteHeader(500)
-				io.WriteString(w, "Internal server error")
-				return
-			}
-			pageactor = a2
+		pageactor, err := getOrCreatePageActor(pagesdb, page, r.Host)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(500)
+			io.WriteString(w, "Internal server error")
+			return
 		}
 		rev, err := db.SavePage(page, *pageactor, session.Get("OAuthAuthenticatedUsername"))
 		if err != nil {
 			log.Println(err)
 			w.WriteHeader(500)
 			io.WriteString(w, "Internal server error")
+			return
 		}
 		http.Redirect(w, r, pages.Root+page.PageName, 303)
 
-		go func() {
-			followers, err := pagesdb.GetPageFollowers(page.PageName, actors)
-			if err != nil {
-				log.Println(err)
-			}
-
-			// func pageDiff(pagename, rev string, db pages.Persister) (string, *pages.Page, *pages.Revision, error) {
-			diff, _, _, err := pageDiff(rev.PageName, rev.RevisionID, db)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-
-			note := rev.DiffNote(diff)
-			create := activitypub.CreateNote{
-				BaseProperties: activitypub.BaseProperties{
-					Id:      note.Id + ".activity",
-					Context: note.Context,
-					Type:    "Create",
-					Actor:   note.AttributedTo,
-				},
-				Published: note.Published,
-				To:        note.To,
-				Cc:        note.Cc,
-				Object:    note,
-			}
-			create.Object.Context = nil
-			bytes, err := json.Marshal(create)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			for _, follower := range followers {
-				log.Printf("Sending update note to %v\n", follower)
-				if err := outbox.Send(pagesdb, rev.PageName, follower, activitypub.Object{Id: create.Id, Type: "Create", RawBytes: bytes}); err != nil {
-					log.Println(err)
-				}
-			}
-		}()
+		refreshFederatedLinks(objectDB, page.Summary+"\n"+page.Content)
+		go publishRevision(pagesdb, db, actors, *rev)
 
 	default:
 		w.WriteHeader(405)
@@ -464,7 +648,132 @@ func wikipage(session *session.Session, pagename string, pagesdb pages.PagesData
 	}
 }
 
-func rootPage(pagesdb pages.PagesDatabase, pagedb pages.Persister, sessionDB session.Store, keystore httpsig.KeyStore, objectDB activitypub.ObjectDatabase, actorDb activitypub.ActorDatabase, activityDb activitypub.ActivityDatabase, prefix string) func(w http.ResponseWriter, r *http.Request) {
+// publishRevision sends the diff of a new revision to the page's
+// followers.
+func publishRevision(pagesdb pages.PagesDatabase, db pages.Persister, actors activitypub.ActorDatabase, rev pages.Revision) {
+	followers, err := pagesdb.GetPageFollowers(rev.PageName, actors)
+	if err != nil {
+		log.Println(err)
+	}
+
+	diff, _, _, err := pageDiff(rev.PageName, rev.RevisionID, db)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	note := rev.DiffNote(diff)
+	create := activitypub.CreateNote{
+		BaseProperties: activitypub.BaseProperties{
+			Id:      note.Id + ".activity",
+			Context: note.Context,
+			Type:    "Create",
+			Actor:   note.AttributedTo,
+		},
+		Published: note.Published,
+		To:        note.To,
+		Cc:        note.Cc,
+		Object:    note,
+	}
+	create.Object.Context = nil
+	bytes, err := json.Marshal(create)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	log.Printf("Sending update note to %d followers\n", len(followers))
+	if err := outbox.Deliver(pagesdb, rev.PageName, followers, activitypub.Object{Id: create.Id, Type: "Create", RawBytes: bytes}); err != nil {
+		log.Println(err)
+	}
+}
+
+// postInbox validates and saves an activity which was POSTed to an inbox,
+// then queues it to be processed.
+func postInbox(keystore httpsig.KeyStore, objectDB activitypub.ObjectDatabase, activityDb activitypub.ActivityDatabase, queue *inbox.Queue, w http.ResponseWriter, r *http.Request) {
+	owner, err := httpsig.Validate(r, keystore)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(401)
+		fmt.Fprintf(w, "Could not validate http signature: %v\n", err)
+		return
+	}
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		internalError(w, r)
+		return
+	}
+
+	var inbound activitypub.Object
+	if err := json.Unmarshal(bytes, &inbound); err != nil {
+		log.Println(err)
+		badRequest(w, r)
+		return
+	}
+	inbound.RawBytes = bytes
+	var activity activitypub.BaseProperties
+	if err := json.Unmarshal(bytes, &activity); err != nil {
+		log.Println(err)
+		badRequest(w, r)
+		return
+	}
+	if err := httpsig.CheckOwner(owner, activity.Actor); err != nil {
+		log.Println(err)
+		w.WriteHeader(401)
+		fmt.Fprintf(w, "Could not validate http signature: %v\n", err)
+		return
+	}
+	if activityDb.IsBlocked(owner) || activityDb.IsBlocked(activity.Actor) {
+		w.WriteHeader(403)
+		fmt.Fprintf(w, "Blocked\n")
+		return
+	}
+	if activityDb.IsQueued(inbound.Id) {
+		// We've already received it, it's either been processed or
+		// is in the queue.
+		w.WriteHeader(202)
+		return
+	}
+	// It may have been saved without being queued if queueing it
+	// failed, or if it was fetched for some other reason, so replace
+	// any stored copy with the one whose signature was just verified.
+	if err := objectDB.UpdateObject(inbound); err != nil {
+		if err == filesystemdb.BadId {
+			badRequest(w, r)
+			return
+		}
+		log.Println(err)
+		internalError(w, r)
+		return
+	}
+	if err := activityDb.QueueObject(inbound); err != nil {
+		log.Println(err)
+		internalError(w, r)
+		return
+	}
+	queue.Push(inbound)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(202)
+	fmt.Fprintf(w, `{ "okay" : "accepted" }`)
+}
+
+// sharedInbox handles the site-wide inbox advertised as the sharedInbox
+// endpoint of every page actor. Activities are routed to pages by their
+// addressing when they're processed, the same way as for page inboxes.
+func sharedInbox(keystore httpsig.KeyStore, objectDB activitypub.ObjectDatabase, activityDb activitypub.ActivityDatabase, queue *inbox.Queue) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			postInbox(keystore, objectDB, activityDb, queue, w, r)
+		default:
+			w.Header().Add("Allow", "POST")
+			w.WriteHeader(405)
+			io.WriteString(w, "Invalid method")
+		}
+	}
+}
+
+func rootPage(pagesdb pages.PagesDatabase, pagedb pages.Persister, sessionDB session.Store, keystore httpsig.KeyStore, objectDB activitypub.ObjectDatabase, actorDb activitypub.ActorDatabase, activityDb activitypub.ActivityDatabase, queue *inbox.Queue, prefix string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println(r.URL.Path)
 		sess, err := session.Start(sessionDB, w, r)
@@ -473,16 +782,24 @@ func rootPage(pagesdb pages.PagesDatabase, pagedb pages.Persister, sessionDB ses
 		}
 		// 1: to get rid of the leading slash.
 		urlPieces := strings.Split(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		if authorizedFetch && isActivityPubGet(r, urlPieces) {
+			if _, err := httpsig.Validate(r, keystore); err != nil {
+				log.Println(err)
+				w.WriteHeader(401)
+				io.WriteString(w, "Signature required\n")
+				return
+			}
+		}
 		switch len(urlPieces) {
 		case 0:
-			wikipage(sess, frontPage, pagesdb, pagedb, actorDb, w, r)
+			wikipage(sess, frontPage, pagesdb, pagedb, objectDB, actorDb, activityDb, w, r)
 			return
 		case 1:
 			if urlPieces[0] == "" {
-				wikipage(sess, frontPage, pagesdb, pagedb, actorDb, w, r)
+				wikipage(sess, frontPage, pagesdb, pagedb, objectDB, actorDb, activityDb, w, r)
 				return
 			}
-			wikipage(sess, urlPieces[0], pagesdb, pagedb, actorDb, w, r)
+			wikipage(sess, urlPieces[0], pagesdb, pagedb, objectDB, actorDb, activityDb, w, r)
 			return
 		case 2:
 			switch urlPieces[1] {
@@ -546,38 +863,7 @@ func rootPage(pagesdb pages.PagesDatabase, pagedb pages.Persister, sessionDB ses
 						return
 					}
 				case "POST":
-					if err := httpsig.Validate(r, keystore); err != nil {
-						log.Println(err)
-						badRequest(w, r)
-						fmt.Fprintf(w, "Could not validate http signature\n")
-						return
-					}
-					bytes, err := io.ReadAll(r.Body)
-					if err != nil {
-						log.Println(err)
-						internalError(w, r)
-						return
-					}
-
-					var inbound activitypub.Object
-					if err := json.Unmarshal(bytes, &inbound); err != nil {
-						log.Println(err)
-						badRequest(w, r)
-						return
-					}
-					inbound.RawBytes = bytes
-					if err := inbox.Process(objectDB, pagesdb, actorDb, activityDb, inbound); err != nil {
-						if err == filesystemdb.BadId {
-							badRequest(w, r)
-							return
-						}
-						log.Println(err)
-						internalError(w, r)
-						return
-					}
-					w.WriteHeader(201)
-					w.Header().Set("Content-Type", "application/json")
-					fmt.Fprintf(w, `{ "okay" : "accepted" }`)
+					postInbox(keystore, objectDB, activityDb, queue, w, r)
 				}
 
 				return
@@ -585,20 +871,39 @@ func rootPage(pagesdb pages.PagesDatabase, pagedb pages.Persister, sessionDB ses
 				notImplemented(w, r)
 				return
 			case "history":
-				pagehistory(sess, urlPieces[0], pagedb, w, r)
+				pagehistory(sess, urlPieces[0], pagedb, activityDb, w, r)
+				return
+			case "likes", "shares":
+				if _, err := pagedb.GetPage(urlPieces[0]); err != nil {
+					notFound(w, r)
+					return
+				}
+				serveReactionCollection(activityDb, "https://"+os.Getenv("fediwikidomain")+pages.Root+urlPieces[0], urlPieces[1], w, r)
 				return
 			case "talk":
-				talkpage(sess, urlPieces[0], pagedb, actorDb, w, r)
+				talkpage(sess, urlPieces[0], pagesdb, pagedb, actorDb, activityDb, w, r)
+				return
+			case "follow":
+				remoteFollow(sess, urlPieces[0], pagesdb, w, r)
+				return
+			case "fork":
+				forkHandler(sess, urlPieces[0], pagesdb, pagedb, actorDb, w, r)
+				return
+			case "proposals":
+				proposalsPage(sess, urlPieces[0], pagesdb, pagedb, actorDb, w, r)
 				return
 			default:
 				notFound(w, r)
 			}
 		case 3:
-			if urlPieces[1] != "history" {
+			switch urlPieces[1] {
+			case "history":
+				wikipagerev(sess, urlPieces[0], urlPieces[2], pagedb, objectDB, w, r)
+			case "talk":
+				talkNote(urlPieces[0], urlPieces[2], pagesdb, actorDb, activityDb, w, r)
+			default:
 				notFound(w, r)
-				return
 			}
-			wikipagerev(sess, urlPieces[0], urlPieces[2], pagedb, w, r)
 		case 4:
 			page := urlPieces[0]
 			if urlPieces[1] != "history" {
@@ -610,7 +915,18 @@ func rootPage(pagesdb pages.PagesDatabase, pagedb pages.Persister, sessionDB ses
 				notFound(w, r)
 				return
 			}
-			wikipagerevdiff(sess, page, rev, pagedb, w, r, urlPieces[3] == "diff.activity")
+			wikipagerevdiff(sess, page, rev, pagesdb, pagedb, actorDb, activityDb, w, r, urlPieces[3] == "diff.activity")
+		case 5:
+			if urlPieces[1] != "history" || urlPieces[3] != "diff" {
+				notFound(w, r)
+				return
+			}
+			if _, err := pagedb.GetPageRevision(urlPieces[0], urlPieces[2]); err != nil {
+				notFound(w, r)
+				return
+			}
+			note := pages.Revision{PageName: urlPieces[0], RevisionID: urlPieces[2]}.DiffNote("")
+			serveReactionCollection(activityDb, note.Id, urlPieces[4], w, r)
 		default:
 			notFound(w, r)
 		}
@@ -620,8 +936,7 @@ func rootPage(pagesdb pages.PagesDatabase, pagedb pages.Persister, sessionDB ses
 func redirectToPagesRoot(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, pages.Root+r.URL.Path, http.StatusSeeOther)
 }
-func main() {
-	mux := http.NewServeMux()
+func parseTemplates() {
 	pageTemplate = template.Must(template.New("MainPage").Parse(`
     <html>
     <title>{{.Title}}</title>
@@ -653,6 +968,10 @@ func main() {
     main {
         margin-left: 5em;
     }
+    a.federated.broken {
+        color: #b00;
+        text-decoration: line-through;
+    }
     main h1 {
         text-align: center;
     }
@@ -748,11 +1067,17 @@ func main() {
             <nav class="actions">
                 <ul>
                     <li><a href="` + pages.Root + `{{.PageName}}?edit=true">Edit {{.PageName}}</li>
+                    {{if .Admin}}<li><a href="/moderation">Moderation</a></li>{{end}}
                     <li><a href="/logout">Logout</a></li>
                 </ul>
             </nav>
         </header>
     `))
+}
+
+func main() {
+	mux := http.NewServeMux()
+	parseTemplates()
 	var db filesystemdb.FileSystemDB
 	if root := os.Getenv("fediwikiroot"); root != "" {
 		db.FSRoot = root
@@ -763,10 +1088,58 @@ func main() {
 	if domain == "" {
 		log.Fatal("Missing fediwikidomain")
 	}
+	if skew := os.Getenv("fediwikiclockskew"); skew != "" {
+		d, err := time.ParseDuration(skew)
+		if err != nil {
+			log.Fatal("Invalid fediwikiclockskew: ", err)
+		}
+		httpsig.MaxClockSkew = d
+	}
+	// Under CGI, a query string without an = is passed as arguments, so
+	// they can't be trusted to be commands.
+	if len(os.Args) > 1 && os.Getenv("FEDIWIKI_CGI") != "true" {
+		// Commands sign their fetches if the wiki has been served
+		// before, but don't wait to generate a key if it hasn't.
+		if instance, instancekey, err := db.GetInstanceActor(); err == nil {
+			httpsig.FetchKey = &httpsig.SigningKey{KeyId: instance.PublicKey.Id, PrivateKey: instancekey}
+		}
+		if err := runCommand(&db, os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	instance, instancekey, err := getOrCreateInstanceActor(&db, domain)
+	if err != nil {
+		log.Fatal(err)
+	}
+	httpsig.FetchKey = &httpsig.SigningKey{KeyId: instance.PublicKey.Id, PrivateKey: instancekey}
 	mux.HandleFunc("/.well-known/webfinger", webFingerHandler(&db))
-	mux.HandleFunc(pages.Root, rootPage(&db, &db, &db, &db, &db, &db, &db, pages.Root))
-	mux.HandleFunc("/login/", loginHandler(&db, &db))
+	mux.HandleFunc("/.well-known/host-meta", hostMeta)
+	mux.HandleFunc("/authorize_interaction", authorizeInteraction)
+	mux.HandleFunc("/.well-known/nodeinfo", nodeInfoDiscovery)
+	mux.HandleFunc("/nodeinfo/2.1", nodeInfoHandler(&db))
+	workers := 4
+	if os.Getenv("FEDIWIKI_CGI") == "true" {
+		// There's no background to process things in after the
+		// request finishes.
+		workers = 0
+	}
+	queue := inbox.NewQueue(&db, func(obj activitypub.Object) error {
+		return inbox.Process(&db, &db, &db, &db, &db, obj)
+	}, workers)
+	if workers > 0 {
+		if err := queue.Resume(); err != nil {
+			log.Println(err)
+		}
+	}
+
+	mux.HandleFunc(pages.Root, rootPage(&db, &db, &db, &db, &db, &db, &db, queue, pages.Root))
+	mux.HandleFunc("/inbox", sharedInbox(&db, &db, &db, queue))
+	mux.HandleFunc("/actor", instanceActor(*instance))
+	mux.HandleFunc("/actor/outbox", instanceOutbox(*instance))
+	mux.HandleFunc("/login/", loginHandler(&db, &db, &db))
 	mux.HandleFunc("/logout", logoutHandler(&db))
+	mux.HandleFunc("/moderation", moderationHandler(&db, &db, &db, &db))
 	mux.HandleFunc("/", redirectToPagesRoot)
 
 	if os.Getenv("FEDIWIKI_CGI") == "true" {
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"fediwiki/activitypub"
+	"fediwiki/outbox"
+	"fediwiki/pages"
+	"fediwiki/session"
+)
+
+// admins is set by the fediwikiadmins environment variable, a comma
+// separated list of @user@host usernames who can see the moderation queue
+// and file reports.
+var admins = strings.Split(os.Getenv("fediwikiadmins"), ",")
+
+func isAdmin(s *session.Session) bool {
+	if s == nil {
+		return false
+	}
+	user := s.Get("OAuthAuthenticatedUsername")
+	if user == "" {
+		return false
+	}
+	for _, admin := range admins {
+		if strings.EqualFold(strings.TrimSpace(admin), user) {
+			return true
+		}
+	}
+	return false
+}
+
+// renderReportForm returns a form for admins to report the note to its
+// author's server.
+func renderReportForm(note activitypub.Note) string {
+	return fmt.Sprintf(`<form method="post" action="/moderation"><input type="hidden" name="action" value="flag"><input type="hidden" name="note" value="%s"><input type="text" name="comment" placeholder="Reason"><input type="submit" value="Report"></form>`, template.HTMLEscapeString(note.Id))
+}
+
+func moderationHandler(sessionDB session.Store, pagesdb pages.PagesDatabase, actors activitypub.ActorDatabase, activityDb activitypub.ActivityDatabase) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, err := session.Start(sessionDB, w, r)
+		if err != nil {
+			log.Println(err)
+		}
+		if !isAdmin(sess) {
+			w.WriteHeader(403)
+			fmt.Fprintf(w, "Forbidden\n")
+			return
+		}
+		switch r.Method {
+		case "GET":
+			moderationQueue(sess, activityDb, w, r)
+		case "POST":
+			if err := r.ParseForm(); err != nil {
+				badRequest(w, r)
+				return
+			}
+			switch r.Form.Get("action") {
+			case "resolve":
+				if err := activityDb.ResolveReport(r.Form.Get("id"), sess.Get("OAuthAuthenticatedUsername")); err != nil {
+					log.Println(err)
+					notFound(w, r)
+					return
+				}
+				http.Redirect(w, r, "/moderation", http.StatusSeeOther)
+			case "flag":
+				if err := sendReport(pagesdb, actors, activityDb, r.Form.Get("note"), r.Form.Get("comment")); err != nil {
+					log.Println(err)
+					w.WriteHeader(502)
+					fmt.Fprintf(w, "Could not send report: %v\n", err)
+					return
+				}
+				pageTemplate.Execute(w, PageTemplateData{
+					Title:   "Report sent",
+					Header:  getHeader(sess, frontPage),
+					Content: template.HTML("<p>The report was sent to the author's server.</p>"),
+				})
+			default:
+				badRequest(w, r)
+			}
+		default:
+			w.Header().Add("Allow", "GET,POST")
+			w.WriteHeader(405)
+		}
+	}
+}
+
+// remoteLinkHTML returns a link to a URL received from another server. If
+// it isn't an https URL it's only shown as text, since it could be a
+// javascript: URL.
+func remoteLinkHTML(href string) string {
+	if !isHTTPS(href) {
+		return template.HTMLEscapeString(href)
+	}
+	return fmt.Sprintf(`<a href="%[1]s">%[1]s</a>`, template.HTMLEscapeString(href))
+}
+
+// moderationQueue lists the reports which haven't been resolved.
+func moderationQueue(sess *session.Session, activityDb activitypub.ActivityDatabase, w http.ResponseWriter, r *http.Request) {
+	reports, err := activityDb.GetReports()
+	if err != nil {
+		log.Println(err)
+		internalError(w, r)
+		return
+	}
+	var content strings.Builder
+	var unresolved int
+	for i := len(reports) - 1; i >= 0; i-- {
+		report := reports[i]
+		if report.ResolvedBy != "" {
+			continue
+		}
+		unresolved++
+		fmt.Fprintf(&content, "<div><h2>Report from %s</h2><div>Received %v</div>", remoteLinkHTML(report.Flag.Actor), report.Received)
+		if report.Flag.Content != "" {
+			fmt.Fprintf(&content, "<blockquote>%s</blockquote>", template.HTMLEscapeString(report.Flag.Content))
+		}
+		fmt.Fprintf(&content, "<ul>")
+		for _, obj := range report.Flag.Object {
+			fmt.Fprintf(&content, "<li>%s</li>", remoteLinkHTML(obj.Id))
+		}
+		fmt.Fprintf(&content, "</ul>")
+		fmt.Fprintf(&content, `<form method="post"><input type="hidden" name="action" value="resolve"><input type="hidden" name="id" value="%s"><input type="submit" value="Resolve"></form></div>`, template.HTMLEscapeString(report.Flag.Id))
+	}
+	if unresolved == 0 {
+		fmt.Fprintf(&content, "<p>There are no reports to look at.</p>")
+	}
+	pageTemplate.Execute(w, PageTemplateData{
+		Title:   "Moderation",
+		Header:  getHeader(sess, frontPage),
+		Content: template.HTML(content.String()),
+	})
+}
+
+// sendReport sends a Flag of the note and its author from the instance
+// actor to the author's server.
+func sendReport(pagesdb pages.PagesDatabase, actors activitypub.ActorDatabase, activityDb activitypub.ActivityDatabase, noteid, comment string) error {
+	note, err := activityDb.GetNote(noteid)
+	if err != nil {
+		return err
+	}
+	author, err := outbox.GetActor(actors, note.AttributedTo)
+	if err != nil {
+		return err
+	}
+	instance, key, err := pagesdb.GetInstanceActor()
+	if err != nil {
+		return err
+	}
+	var idrand [32]byte
+	if _, err := rand.Read(idrand[:]); err != nil {
+		return err
+	}
+	flag := activitypub.Flag{
+		BaseProperties: activitypub.BaseProperties{
+			Context: activitypub.JSONLDContext{"https://www.w3.org/ns/activitystreams"},
+			Id:      instance.Id + "#flag-" + base64.URLEncoding.EncodeToString(idrand[:]),
+			Type:    "Flag",
+			Actor:   instance.Id,
+		},
+		Object:  activitypub.ObjectReferences{{Id: author.Id}, {Id: note.Id}},
+		Content: comment,
+	}
+	bytes, err := json.Marshal(flag)
+	if err != nil {
+		return err
+	}
+	return outbox.SendFrom(*instance, key, *author, activitypub.Object{Id: flag.Id, Type: flag.Type, RawBytes: bytes})
+}
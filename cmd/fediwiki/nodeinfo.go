@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"fediwiki/pages"
+)
+
+// version is reported by NodeInfo. It can be set at build time with
+// -ldflags "-X main.version=...".
+var version = "0.1"
+
+const nodeInfoSchema = "http://nodeinfo.diaspora.software/ns/schema/2.1"
+
+// nodeInfoDiscovery serves /.well-known/nodeinfo, which links to the
+// NodeInfo document.
+func nodeInfoDiscovery(w http.ResponseWriter, r *http.Request) {
+	type link struct {
+		Rel  string `json:"rel"`
+		Href string `json:"href"`
+	}
+	val, err := json.Marshal(struct {
+		Links []link `json:"links"`
+	}{
+		[]link{{Rel: nodeInfoSchema, Href: "https://" + os.Getenv("fediwikidomain") + "/nodeinfo/2.1"}},
+	})
+	if err != nil {
+		log.Println(err)
+		internalError(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "%s", val)
+}
+
+type nodeInfoUsers struct {
+	Total          int `json:"total"`
+	ActiveMonth    int `json:"activeMonth"`
+	ActiveHalfyear int `json:"activeHalfyear"`
+}
+
+type nodeInfo struct {
+	Version  string `json:"version"`
+	Software struct {
+		Name       string `json:"name"`
+		Version    string `json:"version"`
+		Repository string `json:"repository,omitempty"`
+	} `json:"software"`
+	Protocols []string `json:"protocols"`
+	Services  struct {
+		Inbound  []string `json:"inbound"`
+		Outbound []string `json:"outbound"`
+	} `json:"services"`
+	OpenRegistrations bool `json:"openRegistrations"`
+	Usage             struct {
+		Users      nodeInfoUsers `json:"users"`
+		LocalPosts int           `json:"localPosts"`
+	} `json:"usage"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
+
+// getNodeInfo returns the NodeInfo for the wiki. Each page is counted as
+// a user, since pages are the wiki's actors, and each edit as a post.
+func getNodeInfo(db pages.Persister, now time.Time) (nodeInfo, error) {
+	var info nodeInfo
+	info.Version = "2.1"
+	info.Software.Name = "fediwiki"
+	info.Software.Version = version
+	info.Protocols = []string{"activitypub"}
+	info.Services.Inbound = []string{}
+	info.Services.Outbound = []string{}
+	// Anyone with an account on the fediverse can log in and edit.
+	info.OpenRegistrations = true
+	info.Metadata = map[string]interface{}{"nodeName": os.Getenv("fediwikidomain")}
+
+	pagelist, err := db.ListPages()
+	if err != nil {
+		return info, err
+	}
+	for _, pagename := range pagelist {
+		revs, err := db.GetPageRevisions(pagename)
+		if err != nil {
+			return info, err
+		}
+		info.Usage.Users.Total++
+		info.Usage.LocalPosts += len(revs)
+		var lastEdit time.Time
+		for _, rev := range revs {
+			if rev.EditTime != nil && rev.EditTime.After(lastEdit) {
+				lastEdit = *rev.EditTime
+			}
+		}
+		if now.Sub(lastEdit) < 30*24*time.Hour {
+			info.Usage.Users.ActiveMonth++
+		}
+		if now.Sub(lastEdit) < 180*24*time.Hour {
+			info.Usage.Users.ActiveHalfyear++
+		}
+	}
+	return info, nil
+}
+
+func nodeInfoHandler(db pages.Persister) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info, err := getNodeInfo(db, time.Now())
+		if err != nil {
+			log.Println(err)
+			internalError(w, r)
+			return
+		}
+		val, err := json.Marshal(info)
+		if err != nil {
+			log.Println(err)
+			internalError(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", `application/json; profile="`+nodeInfoSchema+`#"`)
+		w.WriteHeader(200)
+		fmt.Fprintf(w, "%s", val)
+	}
+}
+
+// hostMeta serves the host-meta XRD document, which tells clients where
+// to find WebFinger.
+func hostMeta(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/xrd+xml")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<XRD xmlns="http://docs.oasis-open.org/ns/xri/xrd-1.0">
+  <Link rel="lrdd" template="https://%s/.well-known/webfinger?resource={uri}"/>
+</XRD>
+`, xmlEscape(os.Getenv("fediwikidomain")))
+}
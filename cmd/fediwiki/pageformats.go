@@ -0,0 +1,241 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	stdhtml "html"
+
+	"fediwiki/pages"
+
+	"github.com/gomarkdown/markdown/html"
+)
+
+// PageExport is the JSON representation of a page downloaded with
+// ?format=json.
+type PageExport struct {
+	pages.Page
+	Revision *pages.Revision
+}
+
+// namedEntity matches HTML named character references, which (other than
+// the ones predefined by XML) aren't valid in the XHTML of an EPUB and
+// need to be converted to numeric references.
+var namedEntity = regexp.MustCompile(`&([[:alpha:]][[:alnum:]]*);`)
+
+func xhtmlEntities(s string) string {
+	return namedEntity.ReplaceAllStringFunc(s, func(entity string) string {
+		switch entity {
+		case "&amp;", "&lt;", "&gt;", "&quot;", "&apos;":
+			return entity
+		}
+		unescaped := []rune(stdhtml.UnescapeString(entity))
+		if len(unescaped) != 1 {
+			return entity
+		}
+		return fmt.Sprintf("&#%d;", unescaped[0])
+	})
+}
+
+func latestRevision(pagename string, db pages.Persister) *pages.Revision {
+	revs, err := db.GetPageRevisions(pagename)
+	if err != nil || len(revs) == 0 {
+		return nil
+	}
+	return &revs[len(revs)-1]
+}
+
+func findRevision(pagename, revid string, db pages.Persister) *pages.Revision {
+	revs, err := db.GetPageRevisions(pagename)
+	if err != nil {
+		return nil
+	}
+	for _, rev := range revs {
+		if rev.RevisionID == revid {
+			return &rev
+		}
+	}
+	return nil
+}
+
+// servePageFormat writes page (at revision rev, if known) to w as a
+// download in the requested format. It returns false if the format is
+// unknown.
+func servePageFormat(w http.ResponseWriter, page pages.Page, rev *pages.Revision, format string) bool {
+	filename := page.PageName
+	if rev != nil && rev.RevisionID != "" {
+		filename += "-" + rev.RevisionID
+	}
+	var contentType string
+	var b bytes.Buffer
+	switch format {
+	case "md":
+		contentType = "text/markdown; charset=utf-8"
+		fmt.Fprintf(&b, "# %s\n\n", page.Title)
+		if page.Summary != "" {
+			fmt.Fprintf(&b, "%s\n\n", page.Summary)
+		}
+		fmt.Fprintf(&b, "%s", page.Content)
+	case "html":
+		contentType = "text/html; charset=utf-8"
+		if err := pageTemplate.Execute(&b, PageTemplateData{
+			Title:   page.Title,
+			Content: renderPageLinks(page, "https://"+os.Getenv("fediwikidomain")+pages.Root+"$1", 0, nil),
+		}); err != nil {
+			log.Println(err)
+			return false
+		}
+	case "json":
+		contentType = "application/json"
+		if err := json.NewEncoder(&b).Encode(PageExport{Page: page, Revision: rev}); err != nil {
+			log.Println(err)
+			return false
+		}
+	case "epub":
+		contentType = "application/epub+zip"
+		if err := writeEPUB(&b, page, rev); err != nil {
+			log.Println(err)
+			return false
+		}
+	default:
+		return false
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename + "." + format}))
+	w.WriteHeader(200)
+	w.Write(b.Bytes())
+	return true
+}
+
+var epubContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+// html/template would escape the XML declaration, so it's written
+// separately before executing the EPUB templates.
+const xmlDeclaration = `<?xml version="1.0" encoding="UTF-8"?>
+`
+
+var epubPackage = template.Must(template.New("EPUBPackage").Parse(`<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">{{.Id}}</dc:identifier>
+    <dc:title>{{.Title}}</dc:title>
+    <dc:language>en</dc:language>
+    {{if .Editor}}<dc:contributor>{{.Editor}}</dc:contributor>{{end}}
+    <meta property="dcterms:modified">{{.Modified}}</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="page" href="page.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="page"/>
+  </spine>
+</package>
+`))
+
+var epubDocument = template.Must(template.New("EPUBDocument").Parse(`<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>{{.Title}}</title></head>
+<body>
+{{.Body}}
+</body>
+</html>
+`))
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// writeEPUB writes page to w as a single chapter EPUB 3 document.
+func writeEPUB(w io.Writer, page pages.Page, rev *pages.Revision) error {
+	z := zip.NewWriter(w)
+	// The mimetype must be the first file and must not be compressed.
+	mimetype, err := z.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(mimetype, "application/epub+zip"); err != nil {
+		return err
+	}
+
+	container, err := z.Create("META-INF/container.xml")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(container, epubContainer); err != nil {
+		return err
+	}
+
+	modified := time.Now()
+	id := "https://" + os.Getenv("fediwikidomain") + pages.Root + page.PageName
+	var editor string
+	if rev != nil {
+		if rev.EditTime != nil {
+			modified = *rev.EditTime
+		}
+		if rev.RevisionID != "" {
+			id += "/history/" + rev.RevisionID
+		}
+		editor = rev.Editor
+	}
+	opf, err := z.Create("OEBPS/content.opf")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(opf, xmlDeclaration); err != nil {
+		return err
+	}
+	if err := epubPackage.Execute(opf, struct{ Id, Title, Editor, Modified string }{
+		id, page.Title, editor, modified.UTC().Format("2006-01-02T15:04:05Z"),
+	}); err != nil {
+		return err
+	}
+
+	nav, err := z.Create("OEBPS/nav.xhtml")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(nav, xmlDeclaration); err != nil {
+		return err
+	}
+	if err := epubDocument.Execute(nav, struct {
+		Title string
+		Body  template.HTML
+	}{page.Title, template.HTML(`<nav epub:type="toc"><ol><li><a href="page.xhtml">` + xmlEscape(page.Title) + `</a></li></ol></nav>`)}); err != nil {
+		return err
+	}
+
+	body := "<h1>" + xmlEscape(page.Title) + "</h1>\n" + string(renderPageLinks(page, "https://"+os.Getenv("fediwikidomain")+pages.Root+"$1", html.UseXHTML, nil))
+	chapter, err := z.Create("OEBPS/page.xhtml")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(chapter, xmlDeclaration); err != nil {
+		return err
+	}
+	if err := epubDocument.Execute(chapter, struct {
+		Title string
+		Body  template.HTML
+	}{page.Title, template.HTML(xhtmlEntities(body))}); err != nil {
+		return err
+	}
+	return z.Close()
+}
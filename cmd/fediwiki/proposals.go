@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"fediwiki/activitypub"
+	"fediwiki/outbox"
+	"fediwiki/pages"
+	"fediwiki/session"
+)
+
+// openProposals returns the proposals for the page which haven't been
+// merged or rejected.
+func openProposals(pagesdb pages.PagesDatabase, pagename string) []pages.Proposal {
+	proposals, err := pagesdb.GetProposals(pagename)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	var result []pages.Proposal
+	for _, p := range proposals {
+		if p.Status == pages.ProposalOpen {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// proposalsLink returns a link to the page's open proposals, if it has
+// any.
+func proposalsLink(pagesdb pages.PagesDatabase, pagename string) template.HTML {
+	n := len(openProposals(pagesdb, pagename))
+	if n == 0 {
+		return ""
+	}
+	return template.HTML(fmt.Sprintf(`<a href="%s%s/proposals">%d proposed change(s)</a>`, pages.Root, template.HTMLEscapeString(pagename), n))
+}
+
+// decideProposal merges or rejects a proposal. Merged proposals are saved
+// as a new revision credited to the actor who proposed them. Proposals
+// which arrived in an Offer are answered with an Accept or Reject.
+func decideProposal(pagesdb pages.PagesDatabase, db pages.Persister, actors activitypub.ActorDatabase, proposal pages.Proposal, status string) error {
+	if proposal.Status != pages.ProposalOpen {
+		return fmt.Errorf("Proposal %v is already %v", proposal.Id, proposal.Status)
+	}
+	var rev *pages.Revision
+	if status == pages.ProposalAccepted {
+		// The proposer is credited as the revision's editor.
+		if !activitypub.ValidId(proposal.Actor) {
+			return fmt.Errorf("Proposal %v is from invalid actor %q", proposal.Id, proposal.Actor)
+		}
+		actor, err := pagesdb.GetPageActor(proposal.PageName)
+		if err != nil {
+			return err
+		}
+		page := proposal.Page
+		page.PageName = proposal.PageName
+		if rev, err = db.SavePageRevision(page, *actor, pages.Revision{Editor: proposal.Actor, Origin: proposal.Origin}); err != nil {
+			return err
+		}
+		go publishRevision(pagesdb, db, actors, *rev)
+	}
+	if err := pagesdb.SetProposalStatus(proposal.PageName, proposal.Id, status); err != nil {
+		return err
+	}
+	if proposal.Offer {
+		go func() {
+			if err := replyToOffer(pagesdb, actors, proposal, status, rev); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+	return nil
+}
+
+// replyToOffer sends an Accept or Reject of the Offer that a proposal
+// arrived in to the actor who sent it.
+func replyToOffer(pagesdb pages.PagesDatabase, actors activitypub.ActorDatabase, proposal pages.Proposal, status string, rev *pages.Revision) error {
+	pageactor, err := pagesdb.GetPageActor(proposal.PageName)
+	if err != nil {
+		return err
+	}
+	to, err := outbox.GetActor(actors, proposal.Actor)
+	if err != nil {
+		return err
+	}
+	reply := activitypub.OfferReply{
+		BaseProperties: activitypub.BaseProperties{
+			Context: activitypub.JSONLDContext{"https://www.w3.org/ns/activitystreams"},
+			Id:      strings.TrimSuffix(pageactor.Id, "/actor") + "/proposals/" + proposal.Id + "#" + status,
+			Type:    "Reject",
+			Actor:   pageactor.Id,
+		},
+		To:     []string{proposal.Actor},
+		Object: activitypub.ObjectReference{Id: proposal.Activity},
+	}
+	if status == pages.ProposalAccepted {
+		reply.Type = "Accept"
+		if rev != nil {
+			reply.Result = rev.DiffNote("").Id
+		}
+	}
+	bytes, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	return outbox.Send(pagesdb, proposal.PageName, *to, activitypub.Object{Id: reply.Id, Type: reply.Type, RawBytes: bytes})
+}
+
+func proposalsPage(session *session.Session, pagename string, pagesdb pages.PagesDatabase, db pages.Persister, actors activitypub.ActorDatabase, w http.ResponseWriter, r *http.Request) {
+	current, err := db.GetPage(pagename)
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		var content strings.Builder
+		proposals := openProposals(pagesdb, pagename)
+		if len(proposals) == 0 {
+			fmt.Fprintf(&content, "<p>There are no proposed changes to this page.</p>")
+		}
+		for _, p := range proposals {
+			diff, err := p.Page.Diff(current)
+			if err != nil {
+				log.Println(err)
+				internalError(w, r)
+				return
+			}
+			fmt.Fprintf(&content, `<div><h2>%s</h2><div>Proposed by <a href="%[2]s">%[2]s</a> @ %v</div><pre>%s</pre>`, template.HTMLEscapeString(p.Summary), template.HTMLEscapeString(p.Actor), p.Created, template.HTMLEscapeString(diff))
+			if hasEditPermission(session) {
+				fmt.Fprintf(&content, `<form method="post"><input type="hidden" name="id" value="%[1]s"><button type="submit" name="action" value="merge">Merge</button> <button type="submit" name="action" value="reject">Reject</button></form>`, template.HTMLEscapeString(p.Id))
+			}
+			fmt.Fprintf(&content, "</div>")
+		}
+		pageTemplate.Execute(
+			w,
+			PageTemplateData{
+				Title:   "Proposed changes to " + pagename,
+				Header:  getHeader(session, pagename),
+				Content: template.HTML(content.String()),
+			},
+		)
+	case "POST":
+		if !hasEditPermission(session) {
+			w.WriteHeader(403)
+			fmt.Fprintf(w, "Permission denied")
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			badRequest(w, r)
+			return
+		}
+		proposal, err := pagesdb.GetProposal(pagename, r.Form.Get("id"))
+		if err != nil {
+			notFound(w, r)
+			return
+		}
+		var status string
+		switch r.Form.Get("action") {
+		case "merge":
+			status = pages.ProposalAccepted
+		case "reject":
+			status = pages.ProposalRejected
+		default:
+			badRequest(w, r)
+			return
+		}
+		if err := decideProposal(pagesdb, db, actors, *proposal, status); err != nil {
+			log.Println(err)
+			w.WriteHeader(409)
+			fmt.Fprintf(w, "%v\n", err)
+			return
+		}
+		http.Redirect(w, r, pages.Root+pagename+"/proposals", http.StatusSeeOther)
+	default:
+		w.Header().Add("Allow", "GET,POST")
+		w.WriteHeader(405)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// checkPublicHost returns an error if host is this wiki or resolves to a
+// loopback, private or otherwise local address, so that users can't make
+// the wiki send signed requests to services on its own network.
+func checkPublicHost(host string) error {
+	if strings.EqualFold(host, os.Getenv("fediwikidomain")) {
+		return fmt.Errorf("%v is this wiki", host)
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+			return fmt.Errorf("%v is not a public host", host)
+		}
+	}
+	return nil
+}
+
+// checkPublicURL returns an error unless u is an https URL on a public
+// host.
+func checkPublicURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "https" || parsed.Hostname() == "" {
+		return fmt.Errorf("Invalid URL %v", u)
+	}
+	return checkPublicHost(parsed.Hostname())
+}
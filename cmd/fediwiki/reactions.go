@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+
+	"fediwiki/activitypub"
+)
+
+// reactionCollections maps the name of the collection in the object's URL
+// to the type of activity it contains.
+var reactionCollections = map[string]string{
+	"likes":  "Like",
+	"shares": "Announce",
+}
+
+// reactionCollection returns the likes or shares collection of the object
+// with the given id. Items are only included if withItems is set, so that
+// the collections embedded in objects only have a count.
+func reactionCollection(db activitypub.ActivityDatabase, objectid, name string, withItems bool) (*activitypub.Collection, error) {
+	activitytype, ok := reactionCollections[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown collection %v", name)
+	}
+	reactions, err := db.GetReactions(objectid, activitytype)
+	if err != nil {
+		return nil, err
+	}
+	collection := &activitypub.Collection{
+		Id:         objectid + "/" + name,
+		Type:       "Collection",
+		TotalItems: len(reactions),
+	}
+	if withItems {
+		collection.Context = activitypub.JSONLDContext{"https://www.w3.org/ns/activitystreams"}
+		for _, r := range reactions {
+			collection.Items = append(collection.Items, r.Id)
+		}
+	}
+	return collection, nil
+}
+
+// reactionCounts renders the number of likes and boosts of the object with
+// the given id.
+func reactionCounts(db activitypub.ActivityDatabase, objectid string) template.HTML {
+	likes, err := db.GetReactions(objectid, "Like")
+	if err != nil {
+		log.Println(err)
+	}
+	shares, err := db.GetReactions(objectid, "Announce")
+	if err != nil {
+		log.Println(err)
+	}
+	if len(likes) == 0 && len(shares) == 0 {
+		return ""
+	}
+	return template.HTML(fmt.Sprintf(`<span class="reactions">%d likes, %d boosts</span>`, len(likes), len(shares)))
+}
+
+func serveReactionCollection(db activitypub.ActivityDatabase, objectid, name string, w http.ResponseWriter, r *http.Request) {
+	if _, ok := reactionCollections[name]; !ok {
+		notFound(w, r)
+		return
+	}
+	collection, err := reactionCollection(db, objectid, name, true)
+	if err != nil {
+		log.Println(err)
+		internalError(w, r)
+		return
+	}
+	writeActivityJSON(collection, w, r)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/url"
+	"os"
+	"strings"
+
+	"path/filepath"
+
+	"fediwiki/pages"
+)
+
+var staticHeader = template.Must(template.New("StaticHeader").Parse(`
+        <header>
+            <nav>
+                <ul>
+                    <li><a href="{{.Prefix}}index.html">Home</a></li>
+                    {{if .PageName}}<li><a href="{{.Prefix}}{{.PageName}}.html">{{.PageName}}</a>{{if .History}} (<a href="{{.Prefix}}{{.PageName}}/history.html">History</a>){{end}}</li>{{end}}
+                </ul>
+            </nav>
+        </header>
+`))
+
+// A staticSite renders a read-only copy of the wiki into a directory
+// which can be served by any static web server. Links between the
+// generated files are relative, so the directory can be hosted under
+// any path.
+type staticSite struct {
+	Dir     string
+	History bool
+	db      pages.Persister
+}
+
+// writePage renders content with the page template to the file at path,
+// which is relative to the site's directory.
+func (s staticSite) writePage(path, title, pagename string, content template.HTML) error {
+	prefix := strings.Repeat("../", strings.Count(path, "/"))
+	var header bytes.Buffer
+	if err := staticHeader.Execute(&header, struct {
+		Prefix, PageName string
+		History          bool
+	}{prefix, pagename, s.History}); err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := pageTemplate.Execute(&b, PageTemplateData{
+		Title:   title,
+		Header:  template.HTML(header.String()),
+		Content: content,
+	}); err != nil {
+		return err
+	}
+	filename := filepath.Join(s.Dir, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, b.Bytes(), 0644)
+}
+
+func (s staticSite) renderPage(pagename string) error {
+	page, err := s.db.GetPage(pagename)
+	if err != nil {
+		return err
+	}
+	if err := s.writePage(pagename+".html", page.Title, pagename, renderPageLinks(*page, "$1.html", 0, nil)); err != nil {
+		return err
+	}
+	if !s.History {
+		return nil
+	}
+
+	revs, err := s.db.GetPageRevisions(pagename)
+	if err != nil {
+		return err
+	}
+	sortNewestFirst(revs)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<ul>\n")
+	for _, rev := range revs {
+		fmt.Fprintf(&b, `<li><a href="history/%s.html">%v</a>: edited by %v (<a href="history/%s.diff.html">diff</a>)</li>`, rev.RevisionID, rev.EditTime, template.HTMLEscapeString(rev.Editor), rev.RevisionID)
+		revpage, err := s.db.GetPageRevision(pagename, rev.RevisionID)
+		if err != nil {
+			return err
+		}
+		if err := s.writePage(pagename+"/history/"+rev.RevisionID+".html", revpage.Title, pagename, renderPageLinks(*revpage, "../../$1.html", 0, nil)); err != nil {
+			return err
+		}
+		diff, _, _, err := pageDiff(pagename, rev.RevisionID, s.db)
+		if err != nil {
+			return err
+		}
+		if err := s.writePage(pagename+"/history/"+rev.RevisionID+".diff.html", revpage.Title, pagename, template.HTML("<pre>"+template.HTMLEscapeString(diff)+"</pre>")); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(&b, "</ul>")
+	return s.writePage(pagename+"/history.html", "History of "+pagename, pagename, template.HTML(b.String()))
+}
+
+// Render renders every page in the wiki, and an index.html listing them.
+func (s staticSite) Render() error {
+	names, err := s.db.ListPages()
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<ul>\n")
+	for _, name := range names {
+		if err := s.renderPage(name); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		fmt.Fprintf(&b, `<li><a href="%s.html">%s</a></li>`, template.HTMLEscapeString(url.PathEscape(name)), template.HTMLEscapeString(name))
+	}
+	fmt.Fprintf(&b, "</ul>")
+	if page, err := s.db.GetPage(frontPage); err == nil {
+		return s.writePage("index.html", page.Title, frontPage, template.HTML(string(renderPageLinks(*page, "$1.html", 0, nil))+"<h2>All pages</h2>"+b.String()))
+	}
+	return s.writePage("index.html", "All pages", "", template.HTML(b.String()))
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"fediwiki/activitypub"
+	"fediwiki/outbox"
+	"fediwiki/pages"
+	"fediwiki/session"
+
+	"github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+// renderReplyForm returns a form for replying to the note with the given
+// id. The form is POSTed to action.
+func renderReplyForm(action, inReplyTo, label string) template.HTML {
+	return template.HTML(fmt.Sprintf(`<form method="post" action="%s"><input type="hidden" name="inReplyTo" value="%s"><div><textarea cols="80" rows="6" name="content"></textarea></div><div><input type="submit" value="%s"></div></form>`, template.HTMLEscapeString(action), template.HTMLEscapeString(inReplyTo), template.HTMLEscapeString(label)))
+}
+
+// maxMentions is the most actors which are looked up and linked in a
+// note, so that posting one doesn't wait on an unbounded number of
+// WebFinger lookups.
+const maxMentions = 10
+
+// renderNoteContent renders the Markdown of a note posted from the web
+// interface to HTML, linking any mentions with linkMentions. It returns
+// the HTML and a Mention tag for each linked actor.
+func renderNoteContent(content string) (string, []activitypub.Tag) {
+	p := parser.NewWithExtensions(parser.CommonExtensions)
+	doc := markdown.Parse([]byte(content), p)
+	tags := linkMentions(doc)
+	renderer := html.NewRenderer(html.RendererOptions{
+		Flags:          html.CommonFlags | html.SkipHTML,
+		RenderNodeHook: renderMention,
+	})
+	return string(markdown.Render(doc, renderer)), tags
+}
+
+// mentionRe matches @user@host mentions in Markdown text. The first group
+// is whatever came before the mention, since Go doesn't support lookbehind.
+var mentionRe = regexp.MustCompile(`(^|[^\w@/.])@([\w.-]+)@([\w-]+(?:\.[\w-]+)+)`)
+
+// mentionNode is a mention in a note's Markdown which was resolved to an
+// actor.
+type mentionNode struct {
+	ast.Leaf
+	Profile string
+	Name    string
+}
+
+// renderMention renders a mentionNode as a link to the actor's profile.
+func renderMention(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	mention, ok := node.(*mentionNode)
+	if !ok {
+		return ast.GoToNext, false
+	}
+	fmt.Fprintf(w, `<span class="h-card"><a href="%s" class="u-url mention">%s</a></span>`, template.HTMLEscapeString(mention.Profile), template.HTMLEscapeString(mention.Name))
+	return ast.GoToNext, true
+}
+
+// resolveMention looks up the actor for @user@host, and returns its id and
+// the https URL to link mentions of it to.
+func resolveMention(user, host string) (actorid, profile string, err error) {
+	if err := checkPublicHost(host); err != nil {
+		return "", "", err
+	}
+	webfinger, err := webFingerLookup(user, host)
+	if err != nil {
+		return "", "", err
+	}
+	actorid = webfinger.Link("self", "application/activity+json")
+	if !isHTTPS(actorid) {
+		return "", "", fmt.Errorf("No actor for @%v@%v", user, host)
+	}
+	if profile = webfinger.Link("http://webfinger.net/rel/profile-page", ""); !isHTTPS(profile) {
+		profile = actorid
+	}
+	return actorid, profile, nil
+}
+
+// mergeText replaces each run of adjacent text nodes among the children
+// of parent with a single text node, since the parser may split a mention
+// at characters such as _.
+func mergeText(parent ast.Node) {
+	var children []ast.Node
+	var last *ast.Text
+	for _, child := range parent.GetChildren() {
+		text, ok := child.(*ast.Text)
+		if ok && last != nil {
+			// Copy, since Literal shares the parser's input with
+			// the nodes after it.
+			last.Literal = append(append([]byte(nil), last.Literal...), text.Literal...)
+			continue
+		}
+		last = text
+		children = append(children, child)
+	}
+	parent.SetChildren(children)
+}
+
+// linkMentions replaces the @user@host mentions in the text of a parsed
+// note with mentionNodes, leaving code and existing links alone. Mentions
+// which can't be resolved, and those after the first maxMentions actors,
+// are left as they are. It returns a Mention tag for each linked actor.
+func linkMentions(doc ast.Node) []activitypub.Tag {
+	var texts []*ast.Text
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		switch node.(type) {
+		case *ast.Link, *ast.Image:
+			return ast.SkipChildren
+		}
+		if entering && node.AsContainer() != nil {
+			mergeText(node)
+		}
+		if text, ok := node.(*ast.Text); ok {
+			texts = append(texts, text)
+		}
+		return ast.GoToNext
+	})
+	var names []string
+	seen := make(map[string]bool)
+	for _, text := range texts {
+		for _, pieces := range mentionRe.FindAllSubmatch(text.Literal, -1) {
+			name := "@" + string(pieces[2]) + "@" + string(pieces[3])
+			if !seen[name] && len(names) < maxMentions {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	// Look up every actor at once, so that the note waits for at most
+	// one WebFinger timeout.
+	actorids := make([]string, len(names))
+	profiles := make([]string, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			pieces := strings.SplitN(name[1:], "@", 2)
+			actorid, profile, err := resolveMention(pieces[0], pieces[1])
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			actorids[i], profiles[i] = actorid, profile
+		}(i, name)
+	}
+	wg.Wait()
+	var tags []activitypub.Tag
+	profile := make(map[string]string)
+	for i, name := range names {
+		if actorids[i] != "" {
+			profile[name] = profiles[i]
+			tags = append(tags, activitypub.Tag{Type: "Mention", Href: actorids[i], Name: name})
+		}
+	}
+
+	for _, text := range texts {
+		var replacement []ast.Node
+		last := 0
+		for _, loc := range mentionRe.FindAllSubmatchIndex(text.Literal, -1) {
+			start := loc[3]
+			name := string(text.Literal[start:loc[1]])
+			if profile[name] == "" {
+				continue
+			}
+			if start > last {
+				replacement = append(replacement, &ast.Text{Leaf: ast.Leaf{Literal: text.Literal[last:start]}})
+			}
+			replacement = append(replacement, &mentionNode{Profile: profile[name], Name: name})
+			last = loc[1]
+		}
+		if replacement == nil {
+			continue
+		}
+		if last < len(text.Literal) {
+			replacement = append(replacement, &ast.Text{Leaf: ast.Leaf{Literal: text.Literal[last:]}})
+		}
+		parent := text.Parent
+		var children []ast.Node
+		for _, child := range parent.GetChildren() {
+			if child != ast.Node(text) {
+				children = append(children, child)
+				continue
+			}
+			for _, node := range replacement {
+				node.SetParent(parent)
+				children = append(children, node)
+			}
+		}
+		parent.SetChildren(children)
+	}
+	return tags
+}
+
+// talkParent returns the note on the page's talk page with the given id,
+// or the diff note of one of its revisions.
+func talkParent(db pages.Persister, pagename, id string) (*activitypub.Note, error) {
+	if pname, rev, err := pages.GetPageNameFromObjectId(id); err == nil && pname == pagename && rev != "" {
+		if _, err := db.GetPageRevision(pagename, rev); err != nil {
+			return nil, err
+		}
+		note := pages.Revision{PageName: pagename, RevisionID: rev}.DiffNote("")
+		return &note, nil
+	}
+	notes, err := db.GetPageNotes(pagename)
+	if err != nil {
+		return nil, err
+	}
+	for _, note := range notes {
+		if note.Id == id {
+			return &note, nil
+		}
+	}
+	return nil, fmt.Errorf("%v is not on the talk page of %v", id, pagename)
+}
+
+// federatedNote returns the copy of a talk page note which is sent to
+// other servers. Users on other servers can't be signed for, so a note
+// written by one is attributed to the page's actor instead, and credits
+// its author in its content.
+func federatedNote(note activitypub.Note, pageactor string, actors activitypub.ActorDatabase) activitypub.Note {
+	if note.AttributedTo == pageactor {
+		return note
+	}
+	name := note.AttributedTo
+	if actor, err := actors.GetForeignActor(note.AttributedTo); err == nil {
+		name = actor.MentionName()
+	}
+	note.Content = fmt.Sprintf(`<p><a href="%s">%s</a> wrote:</p>%s`, template.HTMLEscapeString(note.AttributedTo), template.HTMLEscapeString(name), note.Content)
+	note.AttributedTo = pageactor
+	return note
+}
+
+// postTalkNote publishes a note written by the logged in user on the
+// page's talk page in reply to parent. content is Markdown. The note is
+// attributed to the user's actor, and sent by the page's actor as
+// described by federatedNote to the page's followers, the author of
+// parent and anyone mentioned.
+func postTalkNote(session *session.Session, pagename string, pagesdb pages.PagesDatabase, actors activitypub.ActorDatabase, activityDb activitypub.ActivityDatabase, parent activitypub.Note, content string) (*activitypub.Note, error) {
+	pageactor, err := pagesdb.GetPageActor(pagename)
+	if err != nil {
+		return nil, err
+	}
+	author := session.Get("OAuthAuthenticatedActor")
+	if author == "" {
+		return nil, fmt.Errorf("No actor for %v", session.Get("OAuthAuthenticatedUsername"))
+	}
+	var idrand [16]byte
+	if _, err := rand.Read(idrand[:]); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	id := pages.NoteId(pagename, now.UTC().Format("20060102150405")+"-"+hex.EncodeToString(idrand[:]))
+
+	rendered, tags := renderNoteContent(content)
+	note := activitypub.Note{
+		BaseProperties: activitypub.BaseProperties{
+			Id:   id,
+			Type: "Note",
+		},
+		InReplyTo:    &parent.Id,
+		To:           []string{"https://www.w3.org/ns/activitystreams#Public"},
+		Cc:           []string{strings.TrimSuffix(pageactor.Id, "/actor") + "/followers"},
+		Published:    &now,
+		Url:          id,
+		AttributedTo: author,
+		MediaType:    "text/html",
+		Content:      rendered,
+		Tag:          tags,
+	}
+	var addressed []string
+	if parent.AttributedTo != "" && parent.AttributedTo != pageactor.Id {
+		addressed = append(addressed, parent.AttributedTo)
+	}
+	for _, tag := range tags {
+		if tag.Href != pageactor.Id && tag.Href != parent.AttributedTo {
+			addressed = append(addressed, tag.Href)
+		}
+	}
+	note.Cc = append(note.Cc, addressed...)
+	if err := activityDb.AddPageNote(pagename, note); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		recipients, err := pagesdb.GetPageFollowers(pagename, actors)
+		if err != nil {
+			log.Println(err)
+		}
+		for _, actorid := range addressed {
+			if actor, err := outbox.GetActor(actors, actorid); err == nil {
+				recipients = append(recipients, *actor)
+			} else {
+				log.Println(err)
+			}
+		}
+		create := activitypub.CreateNote{
+			BaseProperties: activitypub.BaseProperties{
+				Context: activitypub.JSONLDContext{"https://www.w3.org/ns/activitystreams"},
+				Id:      note.Id + "#create",
+				Type:    "Create",
+				Actor:   pageactor.Id,
+			},
+			Published: note.Published,
+			To:        note.To,
+			Cc:        note.Cc,
+			Object:    note,
+		}
+		bytes, err := json.Marshal(create)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if err := outbox.Deliver(pagesdb, pagename, recipients, activitypub.Object{Id: create.Id, Type: "Create", RawBytes: bytes}); err != nil {
+			log.Println(err)
+		}
+	}()
+	return &note, nil
+}
+
+// postTalkForm posts the note submitted with a reply form and redirects
+// back to the page it was submitted from.
+func postTalkForm(session *session.Session, pagename string, pagesdb pages.PagesDatabase, db pages.Persister, actors activitypub.ActorDatabase, activityDb activitypub.ActivityDatabase, w http.ResponseWriter, r *http.Request) {
+	if !hasEditPermission(session) {
+		w.WriteHeader(403)
+		fmt.Fprintf(w, "Permission denied")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		badRequest(w, r)
+		return
+	}
+	content := strings.TrimSpace(r.Form.Get("content"))
+	if content == "" {
+		badRequest(w, r)
+		return
+	}
+	parent, err := talkParent(db, pagename, r.Form.Get("inReplyTo"))
+	if err != nil {
+		log.Println(err)
+		notFound(w, r)
+		return
+	}
+	if _, err := postTalkNote(session, pagename, pagesdb, actors, activityDb, *parent, content); err != nil {
+		log.Println(err)
+		internalError(w, r)
+		return
+	}
+	http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+}
+
+// talkNote serves a note which was posted from this wiki, as it was sent
+// to other servers.
+func talkNote(pagename, id string, pagesdb pages.PagesDatabase, actors activitypub.ActorDatabase, activityDb activitypub.ActivityDatabase, w http.ResponseWriter, r *http.Request) {
+	note, err := activityDb.GetNote(pages.NoteId(pagename, id))
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+	if wantJSONType(r) == "" {
+		http.Redirect(w, r, pages.Root+pagename+"/talk", http.StatusSeeOther)
+		return
+	}
+	pageactor, err := pagesdb.GetPageActor(pagename)
+	if err != nil {
+		log.Println(err)
+		internalError(w, r)
+		return
+	}
+	federated := federatedNote(*note, pageactor.Id, actors)
+	federated.Context = activitypub.JSONLDContext{"https://www.w3.org/ns/activitystreams"}
+	writeActivityJSON(federated, w, r)
+}
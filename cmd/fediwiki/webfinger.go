@@ -3,71 +3,181 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"fediwiki/pages"
 )
 
+type webFingerLink struct {
+	Rel      string `json:"rel"`
+	Type     string `json:"type,omitempty"`
+	Href     string `json:"href,omitempty"`
+	Template string `json:"template,omitempty"`
+}
+
+type webFingerResponse struct {
+	Subject string          `json:"subject"`
+	Aliases []string        `json:"aliases"`
+	Links   []webFingerLink `json:"links"`
+}
+
+// Link returns the href of the first link with rel and, if ctype isn't
+// empty, type ctype.
+func (r webFingerResponse) Link(rel, ctype string) string {
+	for _, link := range r.Links {
+		if link.Rel == rel && (ctype == "" || link.Type == ctype) {
+			return link.Href
+		}
+	}
+	return ""
+}
+
+// Template returns the template of the first link with rel.
+func (r webFingerResponse) Template(rel string) string {
+	for _, link := range r.Links {
+		if link.Rel == rel && link.Template != "" {
+			return link.Template
+		}
+	}
+	return ""
+}
+
+// webFingerClient is used for WebFinger lookups, which are sometimes made
+// while rendering a page, so a slow server can't hold up the response for
+// long. Redirects are only followed to public hosts.
+var webFingerClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return fmt.Errorf("Too many redirects")
+		}
+		return checkPublicURL(req.URL.String())
+	},
+}
+
+// webFingerLookup looks up user@host with the WebFinger server on host.
+func webFingerLookup(user, host string) (*webFingerResponse, error) {
+	webfingerURI := fmt.Sprintf("https://%s/.well-known/webfinger?resource=%s", host, url.QueryEscape("acct:"+user+"@"+host))
+	resp, err := webFingerClient.Get(webfingerURI)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("WebFinger for %s@%s returned %v", user, host, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var response webFingerResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// webFingerPageName returns the name of the page a WebFinger resource
+// refers to. The resource may be an acct: URI, the page's URL or the
+// page actor's id.
+func webFingerPageName(resource, domain string) (string, bool) {
+	if strings.HasPrefix(resource, "acct:") {
+		acct := strings.TrimPrefix(resource, "acct:")
+		name, host, ok := strings.Cut(strings.TrimPrefix(acct, "@"), "@")
+		if !ok || name == "" || !strings.EqualFold(host, domain) {
+			return "", false
+		}
+		return name, true
+	}
+	u, err := url.Parse(resource)
+	if err != nil || u.Scheme != "https" || !strings.EqualFold(u.Host, domain) {
+		return "", false
+	}
+	if !strings.HasPrefix(u.Path, pages.Root) {
+		return "", false
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(u.Path, pages.Root), "/actor")
+	if name == "" || strings.Contains(name, "/") {
+		return "", false
+	}
+	return name, true
+}
+
+func webFingerError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/jrd+json")
+	w.WriteHeader(status)
+	val, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{msg})
+	fmt.Fprintf(w, "%s", val)
+}
+
 func webFingerHandler(actorsdb pages.PagesDatabase) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		resource := r.URL.Query().Get("resource")
 		log.Println("WebFinger for ", resource)
 		if resource == "" {
-			w.WriteHeader(400)
-			fmt.Fprintf(w, "Missing resource")
+			webFingerError(w, 400, "Missing resource")
 			return
 		}
-		if !strings.HasPrefix(resource, "acct:") {
-			w.WriteHeader(400)
-			fmt.Fprintf(w, "Invalid resource")
-			return
-		}
-		acct := strings.TrimPrefix(resource, "acct:")
 		domain := os.Getenv("fediwikidomain")
-		if !strings.HasSuffix(acct, domain) {
-			notFound(w, r)
+		name, ok := webFingerPageName(resource, domain)
+		if !ok {
+			webFingerError(w, 404, "Unknown resource")
 			return
-
 		}
-		name := strings.TrimSuffix(acct, "@"+domain)
-		if prof, err := actorsdb.GetPageActor(name); err != nil {
-			notFound(w, r)
+		prof, err := actorsdb.GetPageActor(name)
+		if err != nil {
+			webFingerError(w, 404, "Unknown resource")
 			return
-		} else {
-			val, err := json.Marshal(struct {
-				Subject string   `json:"subject"`
-				Aliases []string `json:"aliases"`
-				Links   []struct {
-					Rel  string `json:"rel"`
-					Type string `json:"type"`
-					Href string `json:"href"`
-				} `json:"links"`
-			}{
-				resource,
-				[]string{prof.Id},
-				[]struct {
-					Rel  string `json:"rel"`
-					Type string `json:"type"`
-					Href string `json:"href"`
-				}{
-					{
-						Rel:  "self",
-						Type: "application/activity+json",
-						Href: prof.Id,
-					},
+		}
+		pageurl := "https://" + domain + pages.Root + name
+		val, err := json.Marshal(webFingerResponse{
+			Subject: "acct:" + name + "@" + domain,
+			Aliases: []string{pageurl, prof.Id},
+			Links: []webFingerLink{
+				{
+					Rel:  "self",
+					Type: "application/activity+json",
+					Href: prof.Id,
+				},
+				{
+					Rel:  "http://webfinger.net/rel/profile-page",
+					Type: "text/html",
+					Href: pageurl,
 				},
-			})
-			if err != nil {
-				log.Println(err)
-				w.WriteHeader(500)
-				return
-			}
-			w.Header().Set("Content-Type", "application/jrd+json")
-			w.WriteHeader(200)
-			fmt.Fprintf(w, "%s", string(val))
+				{
+					Rel:      "http://ostatus.org/schema/1.0/subscribe",
+					Template: "https://" + domain + "/authorize_interaction?uri={uri}",
+				},
+			},
+		})
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(500)
+			return
 		}
+		w.Header().Set("Content-Type", "application/jrd+json")
+		w.WriteHeader(200)
+		fmt.Fprintf(w, "%s", string(val))
+	}
+}
+
+// authorizeInteraction is the target of the subscribe template. The wiki
+// doesn't have accounts which can follow anything, so it only redirects
+// to pages on this wiki.
+func authorizeInteraction(w http.ResponseWriter, r *http.Request) {
+	name, ok := webFingerPageName(r.URL.Query().Get("uri"), os.Getenv("fediwikidomain"))
+	if !ok {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "This wiki can only show its own pages.\n")
+		return
 	}
+	http.Redirect(w, r, pages.Root+name, http.StatusSeeOther)
 }
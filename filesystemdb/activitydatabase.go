@@ -1,11 +1,12 @@
 package filesystemdb
 
 import (
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"os"
-	"sync"
+	"strings"
+	"time"
 
 	"path/filepath"
 
@@ -16,105 +17,120 @@ import (
 	"github.com/mischief/ndb"
 )
 
-func (d *FileSystemDB) SendUnprocessedObjects(objstream chan activitypub.Object, wg *sync.WaitGroup) chan string {
-	wg.Add(1)
-	returnstream := make(chan string)
-	go func() {
-		for {
-			id := <-returnstream
-			filename := filepath.Join(d.FSRoot, "objects", "processed.db")
-			f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
-			if err != nil {
-				log.Println(err)
-				wg.Done()
-				continue
-			}
-			if _, err := io.WriteString(f, "\nid="+id); err != nil {
-				f.Close()
-				log.Println(err)
-				wg.Done()
-				continue
-			}
-			f.Close()
-			wg.Done()
-		}
-	}()
+func (d *FileSystemDB) QueueObject(obj activitypub.Object) error {
+	if err := os.MkdirAll(filepath.Join(d.FSRoot, "objects"), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(d.FSRoot, "objects", "queue.db"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-	ndbdb, err := ndb.Open(filepath.Join(d.FSRoot, "objects", "objects.db"))
+	record := fmt.Sprintf("\nid=%s type=%s received=%s\n", obj.Id, obj.Type, time.Now().Format(time.RFC3339))
+	if _, err := f.WriteString(record); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *FileSystemDB) UnprocessedObjects(maxattempts int) ([]activitypub.Object, error) {
+	filename := filepath.Join(d.FSRoot, "objects", "queue.db")
+	if _, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) {
+		// Nothing has been queued yet.
+		return nil, nil
+	}
+	queuedb, err := ndb.Open(filename)
 	if err != nil {
-		log.Println(err)
-		return returnstream
+		return nil, err
 	}
+	// Either of these may not exist yet if nothing has been processed
+	// or nothing has failed.
 	processedb, _ := ndb.Open(filepath.Join(d.FSRoot, "objects", "processed.db"))
-	go func() {
-		records := ndbdb.Search("type", "Follow")
-		for _, r := range records {
-			var obj activitypub.Object
-			for _, tuple := range r {
-				switch tuple.Attr {
-				case "id":
-					obj.Id = tuple.Val
-				case "type":
-					obj.Type = tuple.Val
-				case "cachepath":
-					bytes, err := os.ReadFile(filepath.Join(d.FSRoot, "objects", tuple.Val))
-
-					if err != nil {
-						log.Println(err)
-					}
-					obj.RawBytes = bytes
-				}
-			}
-			if processedb != nil {
-				processed := processedb.Search("id", obj.Id)
-				if len(processed) != 0 {
-					continue
-				}
-			}
-			if obj.RawBytes != nil {
-				wg.Add(1)
-				objstream <- obj
+	faileddb, _ := ndb.Open(filepath.Join(d.FSRoot, "objects", "failed.db"))
+
+	objects, err := d.objectIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []activitypub.Object
+	seen := make(map[string]bool)
+	for _, record := range queuedb.Search("id", "") {
+		var id, objtype string
+		for _, tuple := range record {
+			switch tuple.Attr {
+			case "id":
+				id = tuple.Val
+			case "type":
+				objtype = tuple.Val
 			}
 		}
-		records = ndbdb.Search("type", "Undo")
-		for _, r := range records {
-			var obj activitypub.Object
-			for _, tuple := range r {
-				switch tuple.Attr {
-				case "id":
-					obj.Id = tuple.Val
-				case "type":
-					obj.Type = tuple.Val
-				case "cachepath":
-					bytes, err := os.ReadFile(filepath.Join(d.FSRoot, "objects", tuple.Val))
-
-					if err != nil {
-						log.Println(err)
-					}
-					obj.RawBytes = bytes
-				}
-			}
-			if processedb != nil {
-				processed := processedb.Search("id", obj.Id)
-				if len(processed) != 0 {
-					continue
-				}
-			}
-			if obj.RawBytes != nil {
-				wg.Add(1)
-				objstream <- obj
-			}
+		if id == "" || seen[id] {
+			continue
 		}
-		wg.Done()
-	}()
-	return returnstream
+		seen[id] = true
+		if len(processedb.Search("id", id)) != 0 {
+			continue
+		}
+		if maxattempts > 0 && len(faileddb.Search("id", id)) >= maxattempts {
+			continue
+		}
+		bytes, err := d.readObject(objects[id])
+		if err != nil {
+			log.Println(id, err)
+			continue
+		}
+		result = append(result, activitypub.Object{Id: id, Type: objtype, RawBytes: bytes})
+	}
+	return result, nil
+}
+
+func (d *FileSystemDB) IsQueued(id string) bool {
+	queuedb, err := ndb.Open(filepath.Join(d.FSRoot, "objects", "queue.db"))
+	if err != nil {
+		return false
+	}
+	return len(queuedb.Search("id", id)) > 0
+}
+
+func (d *FileSystemDB) MarkProcessed(id string) error {
+	f, err := os.OpenFile(filepath.Join(d.FSRoot, "objects", "processed.db"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "\nid=%s time=%s\n", id, time.Now().Format(time.RFC3339))
+	return err
+}
+
+func (d *FileSystemDB) MarkFailed(id string, reason error) (int, error) {
+	filename := filepath.Join(d.FSRoot, "objects", "failed.db")
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	msg := strings.Replace(reason.Error(), `"`, "'", -1)
+	msg = strings.Join(strings.Fields(msg), " ")
+	if _, err := fmt.Fprintf(f, "\nid=%s time=%s error=\"%s\"\n", id, time.Now().Format(time.RFC3339), msg); err != nil {
+		return 0, err
+	}
+	faileddb, err := ndb.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	return len(faileddb.Search("id", id)), nil
 }
+
 func (d *FileSystemDB) AddFollower(pagename string, request activitypub.Follow) error {
 	filename := filepath.Join(d.FSRoot, pages.Root, pagename, "followers.db")
 	followdb, err := ndb.Open(filename)
 
 	if records := followdb.Search("acceptedFrom", request.Id); len(records) != 0 {
-		return fmt.Errorf("Request already processed")
+		// Already added, so there's nothing to do if an activity
+		// is being retried.
+		return nil
 	}
 	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
 	if err != nil {
@@ -129,7 +145,68 @@ func (d *FileSystemDB) AddFollower(pagename string, request activitypub.Follow)
 	return nil
 }
 
-func (d *FileSystemDB) UndoFollow(pagename string, undo activitypub.Undo) error {
+// followsBy returns the ids of the accepted Follow activities from actor
+// for each page.
+func (d *FileSystemDB) followsBy(actor string) (map[string][]string, error) {
+	names, err := d.ListPages()
+	if err != nil {
+		return nil, err
+	}
+	follows := make(map[string][]string)
+	for _, pagename := range names {
+		requests, err := d.GetPageFollowRequests(pagename)
+		if err != nil {
+			return nil, err
+		}
+		for _, request := range requests {
+			if request.Actor == actor {
+				follows[pagename] = append(follows[pagename], request.Id)
+			}
+		}
+	}
+	return follows, nil
+}
+
+func (d *FileSystemDB) RemoveFollower(actor string, activity activitypub.BaseProperties) error {
+	follows, err := d.followsBy(actor)
+	if err != nil {
+		return err
+	}
+	for _, ids := range follows {
+		for _, id := range ids {
+			original := activitypub.BaseProperties{Id: id, Type: "Follow", Actor: actor}
+			if err := d.UndoActivity(original, activitypub.Undo{BaseProperties: activity}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *FileSystemDB) MoveFollower(from, to string, move activitypub.BaseProperties) error {
+	follows, err := d.followsBy(from)
+	if err != nil {
+		return err
+	}
+	for pagename := range follows {
+		follow := activitypub.Follow{
+			BaseProperties: activitypub.BaseProperties{
+				Id:    move.Id + "#" + pagename,
+				Type:  "Follow",
+				Actor: to,
+			},
+		}
+		if err := d.AddFollower(pagename, follow); err != nil {
+			return err
+		}
+	}
+	return d.RemoveFollower(from, move)
+}
+
+func (d *FileSystemDB) UndoActivity(original activitypub.BaseProperties, undo activitypub.Undo) error {
+	if d.isUndone(original.Id) {
+		return nil
+	}
 	filename := filepath.Join(d.FSRoot, "undo.db")
 	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
 	if err != nil {
@@ -137,7 +214,7 @@ func (d *FileSystemDB) UndoFollow(pagename string, undo activitypub.Undo) error
 	}
 	defer f.Close()
 
-	record := fmt.Sprintf("\nid=%s type=Undo\n", undo.Object.Id)
+	record := fmt.Sprintf("\nid=%s type=%s actor=%s undo=%s\n", original.Id, original.Type, original.Actor, undo.Id)
 	if _, err := f.WriteString(record); err != nil {
 		return err
 	}
@@ -152,7 +229,8 @@ func (d *FileSystemDB) AddPageNote(pagename string, note activitypub.Note) error
 		for _, r := range records {
 			for _, tuple := range r {
 				if tuple.Attr == "pagename" && tuple.Val == pagename {
-					return fmt.Errorf("Already added to database")
+					// Already added
+					return nil
 				}
 			}
 		}
@@ -173,9 +251,112 @@ func (d *FileSystemDB) AddPageNote(pagename string, note activitypub.Note) error
 		Type:     "Note",
 		RawBytes: bytes,
 	})
+}
+
+func (d *FileSystemDB) AddReaction(object string, activity activitypub.BaseProperties) error {
+	filename := filepath.Join(d.FSRoot, "reactions.db")
+	if reactiondb, err := ndb.Open(filename); err == nil {
+		if len(reactiondb.Search("id", activity.Id)) != 0 {
+			// Already added
+			return nil
+		}
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	record := fmt.Sprintf("\nid=%s type=%s actor=%s object=%s\n", activity.Id, activity.Type, activity.Actor, object)
+	if _, err := f.WriteString(record); err != nil {
+		return err
+	}
 	return nil
 }
 
+func (d *FileSystemDB) GetReactions(object, activitytype string) ([]activitypub.BaseProperties, error) {
+	filename := filepath.Join(d.FSRoot, "reactions.db")
+	if _, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	reactiondb, err := ndb.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	var result []activitypub.BaseProperties
+	for _, record := range reactiondb.Search("object", object) {
+		var activity activitypub.BaseProperties
+		for _, tuple := range record {
+			switch tuple.Attr {
+			case "id":
+				activity.Id = tuple.Val
+			case "type":
+				activity.Type = tuple.Val
+			case "actor":
+				activity.Actor = tuple.Val
+			}
+		}
+		if activity.Type != activitytype || d.isUndone(activity.Id) {
+			continue
+		}
+		result = append(result, activity)
+	}
+	return result, nil
+}
+
+func (d *FileSystemDB) GetNote(id string) (*activitypub.Note, error) {
+	notedb, err := ndb.Open(filepath.Join(d.FSRoot, "notes.db"))
+	if err != nil {
+		return nil, NotFound
+	}
+	if len(notedb.Search("id", id)) == 0 {
+		return nil, NotFound
+	}
+	raw, err := d.GetObject(id)
+	if err != nil {
+		return nil, err
+	}
+	var note activitypub.Note
+	if err := json.Unmarshal(raw.RawBytes, &note); err != nil {
+		return nil, err
+	}
+	return &note, nil
+}
+
+func (d *FileSystemDB) UpdateNote(note activitypub.Note) error {
+	if _, err := d.GetNote(note.Id); err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(note)
+	if err != nil {
+		return err
+	}
+	return d.UpdateObject(activitypub.Object{
+		Id:       note.Id,
+		Type:     note.Type,
+		RawBytes: bytes,
+	})
+}
+
+func (d *FileSystemDB) DeleteNote(id string) error {
+	note, err := d.GetNote(id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return d.UpdateNote(activitypub.Note{
+		BaseProperties: activitypub.BaseProperties{
+			Id:   note.Id,
+			Type: "Tombstone",
+		},
+		InReplyTo: note.InReplyTo,
+		To:        note.To,
+		Cc:        note.Cc,
+		Published: note.Published,
+		Deleted:   &now,
+	})
+}
+
 func (d *FileSystemDB) GetPageNotes(pagename string) ([]activitypub.Note, error) {
 	filename := filepath.Join(d.FSRoot, "notes.db")
 	notedb, err := ndb.Open(filename)
@@ -1,7 +1,222 @@
 package filesystemdb
 
 import (
+	"fmt"
+	"os"
+	"testing"
+
 	"fediwiki/activitypub"
 )
 
 var _ activitypub.ActivityDatabase = &FileSystemDB{}
+
+func TestInboxQueue(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "inboxqueue")
+	if err != nil {
+		t.Fatal("Could not create temp dir for test")
+	}
+	defer os.RemoveAll(tmpdir)
+	db := FileSystemDB{FSRoot: tmpdir}
+
+	if objs, err := db.UnprocessedObjects(0); err != nil || len(objs) != 0 {
+		t.Fatalf("Unexpected unprocessed objects in empty database: %v %v", objs, err)
+	}
+
+	for _, id := range []string{"https://example.com/1", "https://example.com/2"} {
+		obj := activitypub.Object{Id: id, Type: "Follow", RawBytes: []byte(`{"id":"` + id + `"}`)}
+		if err := db.SaveObject(obj); err != nil {
+			t.Fatal(err)
+		}
+		if db.IsQueued(id) {
+			t.Errorf("%v should not be queued before QueueObject", id)
+		}
+		if err := db.QueueObject(obj); err != nil {
+			t.Fatal(err)
+		}
+		if !db.IsQueued(id) {
+			t.Errorf("%v should be queued", id)
+		}
+	}
+	if objs, err := db.UnprocessedObjects(0); err != nil || len(objs) != 2 || objs[0].Type != "Follow" {
+		t.Fatalf("Expected 2 unprocessed Follows, got %v %v", objs, err)
+	}
+
+	if err := db.MarkProcessed("https://example.com/1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		attempts, err := db.MarkFailed("https://example.com/2", fmt.Errorf("Could not \"connect\"\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempts != i {
+			t.Errorf("Unexpected number of attempts: got %v want %v", attempts, i)
+		}
+	}
+	objs, err := db.UnprocessedObjects(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 || objs[0].Id != "https://example.com/2" || string(objs[0].RawBytes) != `{"id":"https://example.com/2"}` {
+		t.Errorf("Unexpected unprocessed objects: %v", objs)
+	}
+	if objs, err := db.UnprocessedObjects(2); err != nil || len(objs) != 0 {
+		t.Errorf("Object should have been given up on after 2 attempts: %v %v", objs, err)
+	}
+}
+
+func TestQueueUpdatedObject(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "inboxqueue")
+	if err != nil {
+		t.Fatal("Could not create temp dir for test")
+	}
+	defer os.RemoveAll(tmpdir)
+	db := FileSystemDB{FSRoot: tmpdir}
+
+	// Saved, for instance when it was fetched, before it arrived in the
+	// inbox with a different body.
+	id := "https://example.com/1"
+	if err := db.SaveObject(activitypub.Object{Id: id, Type: "Follow", RawBytes: []byte(`{"id":"` + id + `","old":true}`)}); err != nil {
+		t.Fatal(err)
+	}
+	received := activitypub.Object{Id: id, Type: "Follow", RawBytes: []byte(`{"id":"` + id + `"}`)}
+	if err := db.UpdateObject(received); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueueObject(received); err != nil {
+		t.Fatal(err)
+	}
+	objs, err := db.UnprocessedObjects(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 || string(objs[0].RawBytes) != string(received.RawBytes) {
+		t.Errorf("Expected the received copy to be queued, got %v", objs)
+	}
+}
+
+func TestUpdateDeleteNote(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "notes")
+	if err != nil {
+		t.Fatal("Could not create temp dir for test")
+	}
+	defer os.RemoveAll(tmpdir)
+	db := FileSystemDB{FSRoot: tmpdir}
+
+	if _, err := db.GetNote("https://example.com/note/1"); err != NotFound {
+		t.Errorf("Unexpected error for missing note: %v", err)
+	}
+	note := activitypub.Note{
+		BaseProperties: activitypub.BaseProperties{Id: "https://example.com/note/1", Type: "Note"},
+		AttributedTo:   "https://example.com/user",
+		Content:        "Hello",
+	}
+	if err := db.AddPageNote("Foo", note); err != nil {
+		t.Fatal(err)
+	}
+	note.Content = "Hello, world"
+	if err := db.UpdateNote(note); err != nil {
+		t.Fatal(err)
+	}
+	notes, err := db.GetPageNotes("Foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].Content != "Hello, world" {
+		t.Errorf("Note was not updated: %v", notes)
+	}
+
+	if err := db.DeleteNote(note.Id); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := db.GetNote(note.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted.Type != "Tombstone" || deleted.Content != "" || deleted.AttributedTo != "" || deleted.Deleted == nil {
+		t.Errorf("Note was not replaced by a tombstone: %v", deleted)
+	}
+}
+
+func TestReactions(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "reactions")
+	if err != nil {
+		t.Fatal("Could not create temp dir for test")
+	}
+	defer os.RemoveAll(tmpdir)
+	db := FileSystemDB{FSRoot: tmpdir}
+
+	object := "https://example.com/pages/Foo"
+	like := activitypub.BaseProperties{Id: "https://example.org/like/1", Type: "Like", Actor: "https://example.org/user"}
+	announce := activitypub.BaseProperties{Id: "https://example.org/announce/1", Type: "Announce", Actor: "https://example.org/user"}
+	for _, activity := range []activitypub.BaseProperties{like, like, announce} {
+		if err := db.AddReaction(object, activity); err != nil {
+			t.Fatal(err)
+		}
+	}
+	likes, err := db.GetReactions(object, "Like")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(likes) != 1 || likes[0].Id != like.Id || likes[0].Actor != like.Actor {
+		t.Errorf("Unexpected likes: %v", likes)
+	}
+	if shares, err := db.GetReactions(object, "Announce"); err != nil || len(shares) != 1 {
+		t.Errorf("Unexpected shares: %v %v", shares, err)
+	}
+	if likes, err := db.GetReactions("https://example.com/pages/Bar", "Like"); err != nil || len(likes) != 0 {
+		t.Errorf("Unexpected likes of other page: %v %v", likes, err)
+	}
+
+	undo := activitypub.Undo{
+		BaseProperties: activitypub.BaseProperties{Id: "https://example.org/undo/1", Type: "Undo", Actor: like.Actor},
+		Object:         activitypub.ObjectReference{Id: like.Id},
+	}
+	if err := db.UndoActivity(like, undo); err != nil {
+		t.Fatal(err)
+	}
+	if likes, err := db.GetReactions(object, "Like"); err != nil || len(likes) != 0 {
+		t.Errorf("Expected no likes after undo: %v %v", likes, err)
+	}
+}
+
+func TestReports(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "reports")
+	if err != nil {
+		t.Fatal("Could not create temp dir for test")
+	}
+	defer os.RemoveAll(tmpdir)
+	db := FileSystemDB{FSRoot: tmpdir}
+
+	if reports, err := db.GetReports(); err != nil || len(reports) != 0 {
+		t.Fatalf("Unexpected reports in empty database: %v %v", reports, err)
+	}
+	raw := `{"id":"https://example.org/flag/1","type":"Flag","actor":"https://example.org/actor","object":["https://example.net/spammer"],"content":"Spam on your wiki"}`
+	obj := activitypub.Object{Id: "https://example.org/flag/1", Type: "Flag", RawBytes: []byte(raw)}
+	if err := db.SaveObject(obj); err != nil {
+		t.Fatal(err)
+	}
+	flag := activitypub.Flag{BaseProperties: activitypub.BaseProperties{Id: obj.Id, Type: "Flag", Actor: "https://example.org/actor"}}
+	for i := 0; i < 2; i++ {
+		if err := db.AddReport(flag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reports, err := db.GetReports()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Flag.Content != "Spam on your wiki" || len(reports[0].Flag.Object) != 1 || reports[0].ResolvedBy != "" {
+		t.Fatalf("Unexpected reports: %v", reports)
+	}
+
+	if err := db.ResolveReport("https://example.org/flag/2", "@admin@example.com"); err == nil {
+		t.Error("Expected error resolving unknown report")
+	}
+	if err := db.ResolveReport(obj.Id, "@admin@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if reports, err := db.GetReports(); err != nil || len(reports) != 1 || reports[0].ResolvedBy != "@admin@example.com" {
+		t.Errorf("Report was not resolved: %v %v", reports, err)
+	}
+}
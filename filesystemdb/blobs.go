@@ -0,0 +1,211 @@
+package filesystemdb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"path/filepath"
+)
+
+var HashMismatch error = errors.New("Hash mismatch")
+
+// Blobs which were written more recently than this are never garbage
+// collected, so that a page being saved while the collector is running
+// doesn't lose its content before its revision manifest is written.
+const blobGracePeriod = time.Hour
+
+// A revision manifest is the content of a file in a page's history
+// directory. The revision ID is the sha256 of the manifest, and the
+// manifest refers to the sha256 of each blob that makes up the page.
+type revisionManifest struct {
+	Title   string
+	Summary string
+	Content string
+	Parent  string
+}
+
+func (m revisionManifest) String() string {
+	if m.Parent == "" {
+		return fmt.Sprintf("title=%s summary=%s content=%s\n", m.Title, m.Summary, m.Content)
+	}
+	return fmt.Sprintf("title=%s summary=%s content=%s parent=%s\n", m.Title, m.Summary, m.Content, m.Parent)
+}
+
+func parseRevisionManifest(data []byte) (revisionManifest, error) {
+	var m revisionManifest
+	for _, field := range strings.Fields(string(data)) {
+		pieces := strings.SplitN(field, "=", 2)
+		if len(pieces) != 2 {
+			return m, fmt.Errorf("Invalid revision manifest")
+		}
+		switch pieces[0] {
+		case "title":
+			m.Title = pieces[1]
+		case "summary":
+			m.Summary = pieces[1]
+		case "content":
+			m.Content = pieces[1]
+		case "parent":
+			m.Parent = pieces[1]
+		}
+	}
+	if m.Title == "" || m.Summary == "" || m.Content == "" {
+		return m, fmt.Errorf("Incomplete revision manifest")
+	}
+	return m, nil
+}
+
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func isHash(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func (d *FileSystemDB) blobPath(hash string) string {
+	return filepath.Join(d.FSRoot, "blobs", hash[:2], hash)
+}
+
+// putBlob stores data in the blob store and returns its hash. If a blob
+// with the same content already exists it is reused.
+func (d *FileSystemDB) putBlob(data []byte) (string, error) {
+	hash := hashBytes(data)
+	filename := d.blobPath(hash)
+	if _, err := os.Stat(filename); err == nil {
+		// Touch it so that the garbage collector doesn't remove it
+		// before the manifest that refers to it is written.
+		now := time.Now()
+		os.Chtimes(filename, now, now)
+		return hash, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0775); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "blob")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0444); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return hash, nil
+}
+
+// getBlob retrieves a blob from the blob store and verifies that its
+// content matches its hash.
+func (d *FileSystemDB) getBlob(hash string) ([]byte, error) {
+	if !isHash(hash) {
+		return nil, BadId
+	}
+	data, err := os.ReadFile(d.blobPath(hash))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, NotFound
+		}
+		return nil, err
+	}
+	if hashBytes(data) != hash {
+		return nil, HashMismatch
+	}
+	return data, nil
+}
+
+// readManifest reads the revision manifest for revision of pagename and
+// verifies that it hashes to the revision ID.
+func (d *FileSystemDB) readManifest(pagename, revision string) (revisionManifest, error) {
+	data, err := os.ReadFile(filepath.Join(d.FSRoot, "pages", pagename, "history", revision))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return revisionManifest{}, NotFound
+		}
+		return revisionManifest{}, err
+	}
+	if hashBytes(data) != revision {
+		return revisionManifest{}, HashMismatch
+	}
+	return parseRevisionManifest(data)
+}
+
+// CollectGarbage removes blobs which are not referenced by the revision
+// manifest of any page and returns the number of blobs removed.
+func (d *FileSystemDB) CollectGarbage() (int, error) {
+	referenced := make(map[string]bool)
+
+	manifests, err := filepath.Glob(filepath.Join(d.FSRoot, "pages", "*", "history", "*"))
+	if err != nil {
+		return 0, err
+	}
+	for _, filename := range manifests {
+		if !isHash(filepath.Base(filename)) {
+			// Revisions saved before content addressing are
+			// directories with random IDs and don't use blobs.
+			continue
+		}
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return 0, err
+		}
+		m, err := parseRevisionManifest(data)
+		if err != nil {
+			// Refuse to collect anything if we can't tell what's
+			// referenced.
+			return 0, fmt.Errorf("%s: %v", filename, err)
+		}
+		referenced[m.Title] = true
+		referenced[m.Summary] = true
+		referenced[m.Content] = true
+	}
+
+	removed := 0
+	blobdir := filepath.Join(d.FSRoot, "blobs")
+	err = filepath.WalkDir(blobdir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) && path == blobdir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if entry.IsDir() || !isHash(entry.Name()) || referenced[entry.Name()] {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if time.Since(info.ModTime()) < blobGracePeriod {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
@@ -0,0 +1,146 @@
+package filesystemdb
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"path/filepath"
+
+	"fediwiki/activitypub"
+	"fediwiki/pages"
+)
+
+func countBlobs(t *testing.T, root string) int {
+	t.Helper()
+	blobs, err := filepath.Glob(filepath.Join(root, "blobs", "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(blobs)
+}
+
+func TestContentAddressedRevisions(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "revisionstest")
+	if err != nil {
+		t.Fatal("Could not create temp dir for test")
+	}
+	defer os.RemoveAll(tmpdir)
+	db := FileSystemDB{FSRoot: tmpdir}
+
+	page := pages.Page{
+		PageName: "Foo",
+		Title:    "Foo title",
+		Summary:  "yay",
+		Content:  "hoooray",
+	}
+	rev1, err := db.SavePage(page, activitypub.Actor{}, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countBlobs(t, tmpdir); n != 3 {
+		t.Errorf("Unexpected number of blobs: want 3 got %v", n)
+	}
+
+	page.Content = "changed"
+	rev2, err := db.SavePage(page, activitypub.Actor{}, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countBlobs(t, tmpdir); n != 4 {
+		t.Errorf("Title and summary were not deduplicated: want 4 blobs got %v", n)
+	}
+
+	// Reverting shouldn't store anything new, but is still a new revision
+	page.Content = "hoooray"
+	rev3, err := db.SavePage(page, activitypub.Actor{}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countBlobs(t, tmpdir); n != 4 {
+		t.Errorf("Revert was not deduplicated: want 4 blobs got %v", n)
+	}
+	if rev3.RevisionID == rev1.RevisionID {
+		t.Error("Revert reused the revision ID of the original")
+	}
+
+	latest, err := db.GetPage("Foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Content != "hoooray" || latest.Title != "Foo title" || latest.Summary != "yay" {
+		t.Errorf("Unexpected latest page: %v", latest)
+	}
+	parent, err := db.GetPageRevisionParent("Foo", rev3.RevisionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent.Content != "changed" {
+		t.Errorf("Unexpected parent content: want changed got %v", parent.Content)
+	}
+	if _, err := db.GetPageRevisionParent("Foo", rev1.RevisionID); err != NotFound {
+		t.Errorf("Unexpected error for first revision parent: want NotFound got %v", err)
+	}
+
+	// Corrupt the content blob of the second revision
+	m, err := db.readManifest("Foo", rev2.RevisionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := db.blobPath(m.Content)
+	if err := os.Chmod(blob, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(blob, []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetPageRevision("Foo", rev2.RevisionID); err != HashMismatch {
+		t.Errorf("Unexpected error for corrupted revision: want HashMismatch got %v", err)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "gctest")
+	if err != nil {
+		t.Fatal("Could not create temp dir for test")
+	}
+	defer os.RemoveAll(tmpdir)
+	db := FileSystemDB{FSRoot: tmpdir}
+
+	if _, err := db.SavePage(pages.Page{PageName: "Foo", Title: "Foo", Content: "content"}, activitypub.Actor{}, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	orphan, err := db.putBlob([]byte("nobody refers to me"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is old enough to be collected yet
+	if removed, err := db.CollectGarbage(); err != nil || removed != 0 {
+		t.Errorf("Unexpected result collecting new blobs: want 0, nil got %v, %v", removed, err)
+	}
+
+	old := time.Now().Add(-2 * blobGracePeriod)
+	blobs, err := filepath.Glob(filepath.Join(tmpdir, "blobs", "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blob := range blobs {
+		if err := os.Chtimes(blob, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removed, err := db.CollectGarbage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("Unexpected number of blobs removed: want 1 got %v", removed)
+	}
+	if _, err := os.Stat(db.blobPath(orphan)); err == nil {
+		t.Error("Orphaned blob was not removed")
+	}
+	if _, err := db.GetPage("Foo"); err != nil {
+		t.Errorf("Could not read page after garbage collection: %v", err)
+	}
+}
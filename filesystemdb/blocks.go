@@ -0,0 +1,115 @@
+package filesystemdb
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"path/filepath"
+
+	"fediwiki/activitypub"
+
+	"github.com/mischief/ndb"
+)
+
+func (d *FileSystemDB) Block(block activitypub.Block) error {
+	var record string
+	switch {
+	case block.Domain != "" && block.Actor == "":
+		record = "domain=" + strings.ToLower(block.Domain)
+	case block.Actor != "" && block.Domain == "":
+		record = "actor=" + block.Actor
+	default:
+		return fmt.Errorf("Block must have a domain or an actor")
+	}
+	d.rewriteMu.Lock()
+	defer d.rewriteMu.Unlock()
+	filename := filepath.Join(d.FSRoot, "blocks.db")
+	// Replace any existing block, so that the reason is updated.
+	attr, val, _ := strings.Cut(record, "=")
+	if err := removeRecords(filename, attr, val); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if block.Reason != "" {
+		record += " reason=" + ndbQuote(block.Reason)
+	}
+	_, err = fmt.Fprintf(f, "\n%s\n", record)
+	return err
+}
+
+func (d *FileSystemDB) Unblock(target string) error {
+	d.rewriteMu.Lock()
+	defer d.rewriteMu.Unlock()
+	filename := filepath.Join(d.FSRoot, "blocks.db")
+	if err := removeRecords(filename, "domain", strings.ToLower(target)); err != nil {
+		return err
+	}
+	return removeRecords(filename, "actor", target)
+}
+
+func (d *FileSystemDB) GetBlocks() ([]activitypub.Block, error) {
+	filename := filepath.Join(d.FSRoot, "blocks.db")
+	if _, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	blockdb, err := ndb.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	var blocks []activitypub.Block
+	for _, attr := range []string{"domain", "actor"} {
+		for _, record := range blockdb.Search(attr, "") {
+			var block activitypub.Block
+			for _, tuple := range record {
+				switch tuple.Attr {
+				case "domain":
+					block.Domain = tuple.Val
+				case "actor":
+					block.Actor = tuple.Val
+				case "reason":
+					block.Reason = tuple.Val
+				}
+			}
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks, nil
+}
+
+func (d *FileSystemDB) IsDomainBlocked(domain string) bool {
+	blockdb, err := ndb.Open(filepath.Join(d.FSRoot, "blocks.db"))
+	if err != nil {
+		return false
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for domain != "" {
+		if len(blockdb.Search("domain", domain)) != 0 {
+			return true
+		}
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok {
+			break
+		}
+		domain = parent
+	}
+	return false
+}
+
+func (d *FileSystemDB) IsBlocked(actorid string) bool {
+	u, err := url.Parse(actorid)
+	if err == nil && d.IsDomainBlocked(u.Hostname()) {
+		return true
+	}
+	blockdb, err := ndb.Open(filepath.Join(d.FSRoot, "blocks.db"))
+	if err != nil {
+		return false
+	}
+	return len(blockdb.Search("actor", actorid)) != 0
+}
@@ -0,0 +1,64 @@
+package filesystemdb
+
+import (
+	"os"
+	"testing"
+
+	"fediwiki/activitypub"
+)
+
+func TestBlocks(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "blocks")
+	if err != nil {
+		t.Fatal("Could not create temp dir for test")
+	}
+	defer os.RemoveAll(tmpdir)
+	db := FileSystemDB{FSRoot: tmpdir}
+
+	if db.IsBlocked("https://example.org/users/foo") {
+		t.Error("Actor blocked in empty database")
+	}
+	if err := db.Block(activitypub.Block{Domain: "Example.org", Reason: "Spam and more"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Block(activitypub.Block{Actor: "https://example.net/users/troll"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Block(activitypub.Block{}); err == nil {
+		t.Error("Expected error for empty block")
+	}
+
+	tests := []struct {
+		Actor string
+		Want  bool
+	}{
+		{"https://example.org/users/foo", true},
+		{"https://social.example.org/users/foo", true},
+		{"https://notexample.org/users/foo", false},
+		{"https://example.net/users/troll", true},
+		{"https://example.net/users/friend", false},
+	}
+	for _, tc := range tests {
+		if got := db.IsBlocked(tc.Actor); got != tc.Want {
+			t.Errorf("IsBlocked(%v): got %v want %v", tc.Actor, got, tc.Want)
+		}
+	}
+
+	blocks, err := db.GetBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 || blocks[0].Domain != "example.org" || blocks[0].Reason != "Spam and more" || blocks[1].Actor != "https://example.net/users/troll" {
+		t.Errorf("Unexpected blocks: %v", blocks)
+	}
+
+	if err := db.Unblock("example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if db.IsBlocked("https://example.org/users/foo") {
+		t.Error("Domain still blocked after unblock")
+	}
+	if !db.IsBlocked("https://example.net/users/troll") {
+		t.Error("Unblocking a domain removed actor block")
+	}
+}
@@ -2,7 +2,6 @@ package filesystemdb
 
 import (
 	"crypto"
-	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -11,6 +10,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"path/filepath"
@@ -29,10 +29,14 @@ var BadId error = errors.New("Bad id")
 
 type FileSystemDB struct {
 	FSRoot string
+
+	// rewriteMu serializes writes to ndb files which are rewritten
+	// rather than only appended to, so that concurrent rewrites don't
+	// lose each other's records.
+	rewriteMu sync.Mutex
 }
 
 func (db *FileSystemDB) GetPage(pagename string) (*pages.Page, error) {
-	var p pages.Page
 	if pagename == "" {
 		return nil, fmt.Errorf("No page name")
 	}
@@ -42,8 +46,15 @@ func (db *FileSystemDB) GetPage(pagename string) (*pages.Page, error) {
 	}
 	latest, err := os.ReadFile(filepath.Join(filesdir, "latest"))
 	if err == nil {
-		filesdir = filepath.Join(filesdir, "history", string(latest))
+		return db.GetPageRevision(pagename, string(latest))
 	}
+	return readLegacyRevision(pagename, filesdir)
+}
+
+// readLegacyRevision reads a revision which was saved as a directory of
+// files before revisions were content addressed.
+func readLegacyRevision(pagename, filesdir string) (*pages.Page, error) {
+	p := pages.Page{PageName: pagename}
 	if _, err := os.Stat(filepath.Join(filesdir, "content.md")); errors.Is(err, os.ErrNotExist) {
 		return nil, NotFound
 	}
@@ -70,8 +81,8 @@ func (db *FileSystemDB) GetPage(pagename string) (*pages.Page, error) {
 
 	return &p, nil
 }
+
 func (db *FileSystemDB) GetPageRevision(pagename, revision string) (*pages.Page, error) {
-	var p pages.Page
 	if pagename == "" {
 		return nil, fmt.Errorf("No page name")
 	}
@@ -79,71 +90,101 @@ func (db *FileSystemDB) GetPageRevision(pagename, revision string) (*pages.Page,
 	if !strings.HasPrefix(filesdir, db.FSRoot+"/pages") {
 		return nil, fmt.Errorf("Invalid page name")
 	}
-	if _, err := os.Stat(filepath.Join(filesdir, "content.md")); errors.Is(err, os.ErrNotExist) {
-		return nil, NotFound
+	if !isHash(revision) {
+		return readLegacyRevision(pagename, filesdir)
 	}
-	content, err := os.ReadFile(filepath.Join(filesdir, "content.md"))
+	manifest, err := db.readManifest(pagename, revision)
 	if err != nil {
 		return nil, err
 	}
-	p.Content = string(content)
+	title, err := db.getBlob(manifest.Title)
+	if err != nil {
+		return nil, err
+	}
+	summary, err := db.getBlob(manifest.Summary)
+	if err != nil {
+		return nil, err
+	}
+	content, err := db.getBlob(manifest.Content)
+	if err != nil {
+		return nil, err
+	}
+	return &pages.Page{
+		PageName: pagename,
+		Title:    string(title),
+		Summary:  string(summary),
+		Content:  string(content),
+	}, nil
+}
 
-	if _, err := os.Stat(filepath.Join(filesdir, "title.txt")); err == nil {
-		content, err := os.ReadFile(filepath.Join(filesdir, "title.txt"))
-		if err != nil {
-			return nil, err
-		}
-		p.Title = string(content)
+func (db *FileSystemDB) GetPageRevisionParent(pagename, revision string) (*pages.Page, error) {
+	if pagename == "" {
+		return nil, fmt.Errorf("No page name")
 	}
-	if _, err := os.Stat(filepath.Join(filesdir, "summary.md")); err == nil {
-		content, err := os.ReadFile(filepath.Join(filesdir, "summary.md"))
+	filesdir := filepath.Join(db.FSRoot, "pages", pagename, "history", revision)
+	if !strings.HasPrefix(filesdir, db.FSRoot+"/pages") {
+		return nil, fmt.Errorf("Invalid page name")
+	}
+	var parent string
+	if isHash(revision) {
+		manifest, err := db.readManifest(pagename, revision)
 		if err != nil {
 			return nil, err
 		}
-		p.Summary = string(content)
+		parent = manifest.Parent
+	} else if bytes, err := os.ReadFile(filepath.Join(filesdir, "parentversion")); err == nil {
+		parent = string(bytes)
 	}
-
-	return &p, nil
+	if parent == "" {
+		return nil, NotFound
+	}
+	return db.GetPageRevision(pagename, parent)
 }
-func (db *FileSystemDB) GetPageRevisionParent(pagename, revision string) (*pages.Page, error) {
-	return nil, fmt.Errorf("Not implemented")
+
+func normalizeNewlines(s string) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	s = strings.Replace(s, "\n\r", "\n", -1)
+	return strings.Replace(s, "\r", "\n", -1)
 }
+
 func (db *FileSystemDB) SavePage(p pages.Page, prof activitypub.Actor, editor string) (*pages.Revision, error) {
+	return db.SavePageRevision(p, prof, pages.Revision{Editor: editor})
+}
+
+func (db *FileSystemDB) SavePageRevision(p pages.Page, prof activitypub.Actor, rev pages.Revision) (*pages.Revision, error) {
 	if p.PageName == "" {
 		return nil, fmt.Errorf("No page name")
 	}
 	basedir := filepath.Join(db.FSRoot, "pages", p.PageName)
-
-	var idrand [36]byte
-	if _, err := rand.Read(idrand[:]); err != nil {
-		return nil, err
+	if !strings.HasPrefix(basedir, db.FSRoot+"/pages") {
+		return nil, fmt.Errorf("Invalid page name")
 	}
-	savedir := filepath.Join(basedir, "history", base64.URLEncoding.EncodeToString(idrand[:]))
 
-	if err := os.MkdirAll(savedir, 0777); err != nil {
+	var manifest revisionManifest
+	var err error
+	if manifest.Title, err = db.putBlob([]byte(p.Title)); err != nil {
 		return nil, err
 	}
-	content := string(p.Content)
-	content = strings.Replace(content, "\r\n", "\n", -1)
-	content = strings.Replace(content, "\n\r", "\n", -1)
-	content = strings.Replace(content, "\r", "\n", -1)
-	if err := os.WriteFile(savedir+"/content.md", []byte(content), 0664); err != nil {
+	if manifest.Summary, err = db.putBlob([]byte(normalizeNewlines(p.Summary))); err != nil {
 		return nil, err
 	}
-	content = string(p.Summary)
-	content = strings.Replace(content, "\r\n", "\n", -1)
-	content = strings.Replace(content, "\n\r", "\n", -1)
-	content = strings.Replace(content, "\r", "\n", -1)
-	if err := os.WriteFile(savedir+"/summary.md", []byte(content), 0664); err != nil {
+	if manifest.Content, err = db.putBlob([]byte(normalizeNewlines(p.Content))); err != nil {
 		return nil, err
 	}
-	if err := os.WriteFile(savedir+"/title.txt", []byte(p.Title), 0664); err != nil {
+	if bytes, err := os.ReadFile(filepath.Join(basedir, "latest")); err == nil {
+		manifest.Parent = string(bytes)
+	}
+
+	manifestbytes := []byte(manifest.String())
+	revid := hashBytes(manifestbytes)
+	if err := os.MkdirAll(filepath.Join(basedir, "history"), 0775); err != nil {
 		return nil, err
 	}
-	var parentstring string
-	if bytes, err := os.ReadFile(filepath.Join(basedir, "latest")); err == nil {
-		parentstring = string(bytes)
-		if err := os.WriteFile(filepath.Join(savedir, "parentversion"), bytes, 0664); err != nil {
+	manifestfile := filepath.Join(basedir, "history", revid)
+	if _, err := os.Stat(manifestfile); errors.Is(err, os.ErrNotExist) {
+		// If it already exists, it's identical since the name is
+		// the hash of the content.
+		if err := os.WriteFile(manifestfile, manifestbytes, 0444); err != nil {
 			return nil, err
 		}
 	}
@@ -155,23 +196,60 @@ func (db *FileSystemDB) SavePage(p pages.Page, prof activitypub.Actor, editor st
 	defer f.Close()
 
 	savetime := time.Now()
-	if parentstring != "" {
-		fmt.Fprintf(f, "id=%s time=%s editor=%s parent=%s pagename=%s\n", base64.URLEncoding.EncodeToString(idrand[:]), savetime.Format(time.RFC3339), editor, parentstring, p.PageName)
-	} else {
-		fmt.Fprintf(f, "id=%s time=%s editor=%s pagename=%s\n", base64.URLEncoding.EncodeToString(idrand[:]), savetime.Format(time.RFC3339), editor, p.PageName)
+	if rev.EditTime != nil {
+		savetime = *rev.EditTime
+	}
+	editor := rev.Editor
+	if strings.ContainsAny(editor, " \t\n\"") {
+		editor = strings.Join(strings.Fields(strings.Replace(editor, `"`, "", -1)), "_")
+	}
+	record := fmt.Sprintf("id=%s time=%s editor=%s", revid, savetime.Format(time.RFC3339), editor)
+	if manifest.Parent != "" {
+		record += " parent=" + manifest.Parent
+	}
+	record += " pagename=" + p.PageName
+	if rev.Origin != "" {
+		record += " origin=" + ndbQuote(rev.Origin)
 	}
+	fmt.Fprintf(f, "%s\n", record)
 
-	if err := os.WriteFile(basedir+"/latest", []byte(base64.URLEncoding.EncodeToString(idrand[:])), 0664); err != nil {
+	if err := os.WriteFile(basedir+"/latest", []byte(revid), 0664); err != nil {
 		return nil, err
 	}
 	return &pages.Revision{
 		PageName:   p.PageName,
-		RevisionID: base64.URLEncoding.EncodeToString(idrand[:]),
+		RevisionID: revid,
 		Editor:     editor,
 		EditTime:   &savetime,
+		Origin:     rev.Origin,
 	}, nil
 }
 
+func (db *FileSystemDB) ListPages() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(db.FSRoot, "pages"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var result []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		// A page actor may have been created without a page being
+		// saved if saving failed, so make sure there's content.
+		dir := filepath.Join(db.FSRoot, "pages", entry.Name())
+		if _, err := os.Stat(filepath.Join(dir, "latest")); err == nil {
+			result = append(result, entry.Name())
+		} else if _, err := os.Stat(filepath.Join(dir, "content.md")); err == nil {
+			result = append(result, entry.Name())
+		}
+	}
+	return result, nil
+}
+
 func (db *FileSystemDB) GetClient(hostname string) (oauth.Client, error) {
 	oauthdb, err := ndb.Open(db.FSRoot + "/oauthclients.db")
 	if err != nil {
@@ -296,6 +374,8 @@ func (db *FileSystemDB) GetPageRevisions(pagename string) ([]pages.Revision, err
 				rev.Editor = tuple.Val
 			case "pagename":
 				rev.PageName = tuple.Val
+			case "origin":
+				rev.Origin = tuple.Val
 			}
 
 		}
@@ -362,6 +442,43 @@ func (d *FileSystemDB) GetObject(id string) (*activitypub.Object, error) {
 	return &rv, nil
 
 }
+
+// objectIndex returns the cachepath of every stored object by id, so that
+// many objects can be read without parsing and searching objects.db for
+// each of them.
+func (d *FileSystemDB) objectIndex() (map[string]string, error) {
+	filename := filepath.Join(d.FSRoot, "objects", "objects.db")
+	if _, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	odb, err := ndb.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]string)
+	for _, record := range odb.Search("id", "") {
+		var id, cachepath string
+		for _, tuple := range record {
+			switch tuple.Attr {
+			case "id":
+				id = tuple.Val
+			case "cachepath":
+				cachepath = tuple.Val
+			}
+		}
+		index[id] = cachepath
+	}
+	return index, nil
+}
+
+// readObject reads the raw bytes of an object from its cachepath.
+func (d *FileSystemDB) readObject(cachepath string) ([]byte, error) {
+	if cachepath == "" {
+		return nil, NotFound
+	}
+	return os.ReadFile(filepath.Join(d.FSRoot, "objects", cachepath))
+}
+
 func (d *FileSystemDB) SaveObject(obj activitypub.Object) error {
 	if !strings.HasPrefix(obj.Id, "https://") {
 		return BadId
@@ -388,39 +505,47 @@ func (d *FileSystemDB) SaveObject(obj activitypub.Object) error {
 	return nil
 }
 
-func (d *FileSystemDB) GetKey(keyid string) (crypto.PublicKey, error) {
+// KeyCacheExpiry is how long a remote actor's key is cached before it's
+// fetched again.
+var KeyCacheExpiry = 24 * time.Hour
+
+// GetKey returns the most recently fetched copy of a remote key, unless
+// it's older than KeyCacheExpiry.
+func (d *FileSystemDB) GetKey(keyid string) (crypto.PublicKey, string, error) {
 	ndbDir := filepath.Join(d.FSRoot, "keys")
 	ndb, err := ndb.Open(filepath.Join(ndbDir, "knownkeys.db"))
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	records := ndb.Search("keyid", keyid)
 	if len(records) == 0 {
-		return nil, fmt.Errorf("No records found")
+		return nil, "", fmt.Errorf("No records found")
 	}
 
-	var data []byte
-	var owner string
-	for _, record := range records {
-		for _, tuple := range record {
-			switch tuple.Attr {
-			case "owner":
-				owner = tuple.Val
-			case "cachepath":
-				filedata, err := os.ReadFile(filepath.Join(ndbDir, tuple.Val))
-				if err != nil {
-					return nil, err
-				}
-				data = filedata
-			default:
-			}
-		}
-		if owner != "" && data != nil {
-			break
+	var owner, cachepath string
+	var fetched time.Time
+	for _, tuple := range records[len(records)-1] {
+		switch tuple.Attr {
+		case "owner":
+			owner = tuple.Val
+		case "cachepath":
+			cachepath = tuple.Val
+		case "fetched":
+			// Keys cached before the fetch time was recorded have a
+			// zero time, so are always expired.
+			fetched, _ = time.Parse(time.RFC3339, tuple.Val)
 		}
 	}
-	return httpsig.ParsePemKey(keyid, owner, data, nil)
+	if time.Since(fetched) > KeyCacheExpiry {
+		return nil, "", fmt.Errorf("Cached key %v expired", keyid)
+	}
+	data, err := os.ReadFile(filepath.Join(ndbDir, cachepath))
+	if err != nil {
+		return nil, "", err
+	}
+	key, err := httpsig.ParsePemKey(keyid, owner, data, nil)
+	return key, owner, err
 }
 
 func (d *FileSystemDB) SaveKey(keyid, owner string, pembytes []byte) error {
@@ -442,7 +567,7 @@ func (d *FileSystemDB) SaveKey(keyid, owner string, pembytes []byte) error {
 	if err := os.WriteFile(fullkeyfilename, pembytes, 0644); err != nil {
 		return err
 	}
-	record := fmt.Sprintf("\nkeyid=%s owner=%s cachepath=%s\n", keyid, owner, keyfilename)
+	record := fmt.Sprintf("\nkeyid=%s owner=%s cachepath=%s fetched=%s\n", keyid, owner, keyfilename, time.Now().Format(time.RFC3339))
 
 	if _, err := f.WriteString(record); err != nil {
 		return err
@@ -459,13 +584,11 @@ func (d *FileSystemDB) GetForeignActor(id string) (*activitypub.Actor, error) {
 	if len(records) == 0 {
 		return nil, NotFound
 	}
-	if len(records) > 1 {
-		return nil, fmt.Errorf("Too many records in database")
-	}
 	var cachepath string
 	// The tuple has most of the things we need, but it doesn't have the key
-	// so we just look for cachepath and parse the whole thing
-	for _, tuple := range records[0] {
+	// so we just look for cachepath and parse the whole thing. Older
+	// databases may have duplicates, the last one is the most recent.
+	for _, tuple := range records[len(records)-1] {
 		switch tuple.Attr {
 		case "cachepath":
 			cachepath = tuple.Val
@@ -492,12 +615,90 @@ func (d *FileSystemDB) GetForeignActor(id string) (*activitypub.Actor, error) {
 	return &actor, nil
 }
 
+// ActorCacheExpiry is how long a cached foreign actor is used before it
+// should be fetched again.
+var ActorCacheExpiry = 24 * time.Hour
+
+// ndbQuote quotes val if it contains characters which would otherwise
+// end an ndb value.
+func ndbQuote(val string) string {
+	val = strings.Replace(val, `"`, "", -1)
+	if strings.ContainsAny(val, " \t\n=") {
+		return `"` + strings.Join(strings.Fields(val), " ") + `"`
+	}
+	return val
+}
+
+// removeRecords rewrites the ndb file without any records whose first
+// tuple is attr=val. The caller must hold the database's rewriteMu.
+func removeRecords(filename, attr, val string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var b strings.Builder
+	var skipping bool
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if line != "" && line[0] != ' ' && line[0] != '\t' && line[0] != '\n' {
+			// The start of a new record.
+			skipping = strings.HasPrefix(line, attr+"="+val+" ") || strings.TrimSpace(line) == attr+"="+val
+		}
+		if !skipping {
+			b.WriteString(line)
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0664); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+func (d *FileSystemDB) IsActorStale(id string) bool {
+	actordb, err := ndb.Open(filepath.Join(d.FSRoot, "actors.db"))
+	if err != nil {
+		return true
+	}
+	records := actordb.Search("id", id)
+	if len(records) == 0 {
+		return true
+	}
+	var fetched time.Time
+	for _, tuple := range records[len(records)-1] {
+		if tuple.Attr == "fetched" {
+			fetched, _ = time.Parse(time.RFC3339, tuple.Val)
+		}
+	}
+	return time.Since(fetched) > ActorCacheExpiry
+}
+
+// StoreActor caches a foreign actor, replacing any previously cached copy.
 func (d *FileSystemDB) StoreActor(actor activitypub.Actor, raw []byte) error {
 	filename := filepath.Join(d.FSRoot, "actors.db")
 	cachedir := filepath.Join(d.FSRoot, "actors")
 	if err := os.MkdirAll(cachedir, 0755); err != nil {
 		return err
 	}
+	d.rewriteMu.Lock()
+	defer d.rewriteMu.Unlock()
+	if err := removeRecords(filename, "id", actor.Id); err != nil {
+		return err
+	}
 	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
 	if err != nil {
 		return err
@@ -507,13 +708,13 @@ func (d *FileSystemDB) StoreActor(actor activitypub.Actor, raw []byte) error {
 	record := fmt.Sprintf("\nid=%s type=%s\n", actor.Id, actor.Type)
 	record = fmt.Sprintf("%s\tinbox=%s outbox=%s\n", record, actor.Inbox, actor.Outbox)
 	record = fmt.Sprintf("%s\tfollowing=%s followers=%s\n", record, actor.Following, actor.Followers)
-	record = fmt.Sprintf("%s\tpreferredUsername=%s\n", record, actor.PreferredUsername)
-	record = fmt.Sprintf("%s\tname=%s\n", record, actor.Name)
+	record = fmt.Sprintf("%s\tpreferredUsername=%s\n", record, ndbQuote(actor.PreferredUsername))
+	record = fmt.Sprintf("%s\tname=%s\n", record, ndbQuote(actor.Name))
 	if actor.ProfileIcon != "" {
 		record = fmt.Sprintf("%s\tprofileIcon=%s\n", record, actor.ProfileIcon)
 	}
 	fname := base64.URLEncoding.EncodeToString([]byte(actor.Id))
-	record = fmt.Sprintf("%s\tcachepath=%s", record, fname)
+	record = fmt.Sprintf("%s\tcachepath=%s fetched=%s\n", record, fname, time.Now().Format(time.RFC3339))
 
 	if err := os.WriteFile(filepath.Join(cachedir, fname), raw, 0644); err != nil {
 		return err
@@ -523,3 +724,17 @@ func (d *FileSystemDB) StoreActor(actor activitypub.Actor, raw []byte) error {
 	}
 	return nil
 }
+
+// RemoveActor removes a foreign actor from the cache.
+func (d *FileSystemDB) RemoveActor(id string) error {
+	d.rewriteMu.Lock()
+	defer d.rewriteMu.Unlock()
+	if err := removeRecords(filepath.Join(d.FSRoot, "actors.db"), "id", id); err != nil {
+		return err
+	}
+	err := os.Remove(filepath.Join(d.FSRoot, "actors", base64.URLEncoding.EncodeToString([]byte(id))))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
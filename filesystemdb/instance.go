@@ -0,0 +1,82 @@
+package filesystemdb
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+
+	"path/filepath"
+
+	"fediwiki/activitypub"
+)
+
+// The instance actor represents the wiki as a whole rather than any page.
+// Its key signs requests which aren't on behalf of a page, such as fetching
+// remote actors.
+
+func (d *FileSystemDB) GetInstanceActor() (*activitypub.Actor, crypto.PrivateKey, error) {
+	dir := filepath.Join(d.FSRoot, "instance")
+	bytes, err := os.ReadFile(filepath.Join(dir, "actor.json"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, NotFound
+		}
+		return nil, nil, err
+	}
+	var actor activitypub.Actor
+	if err := json.Unmarshal(bytes, &actor); err != nil {
+		return nil, nil, err
+	}
+	privkey, err := readPrivateKey(filepath.Join(dir, "private.pem"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &actor, privkey, nil
+}
+
+func (d *FileSystemDB) NewInstanceActor(domain string, private crypto.PrivateKey, public crypto.PublicKey) (*activitypub.Actor, error) {
+	id := "https://" + domain + "/actor"
+	keybytes, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	block := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: keybytes})
+	actor := &activitypub.Actor{
+		Context:           activitypub.JSONLDContext{"https://www.w3.org/ns/activitystreams", "https://w3id.org/security/v1"},
+		Id:                id,
+		Type:              "Application",
+		PreferredUsername: domain,
+		Name:              domain,
+		Inbox:             "https://" + domain + "/inbox",
+		Outbox:            id + "/outbox",
+		Endpoints:         &activitypub.Endpoints{SharedInbox: "https://" + domain + "/inbox"},
+		PublicKey: activitypub.PublicKey{
+			Id:           id + "#main-key",
+			Owner:        id,
+			PublicKeyPem: string(block),
+		},
+	}
+
+	dir := filepath.Join(d.FSRoot, "instance")
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return nil, err
+	}
+	bytes, err := json.Marshal(actor)
+	if err != nil {
+		return nil, err
+	}
+	privkeybytes, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "private.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privkeybytes}), 0400); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "actor.json"), bytes, 0664); err != nil {
+		return nil, err
+	}
+	return actor, nil
+}
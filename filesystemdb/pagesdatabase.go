@@ -2,17 +2,22 @@ package filesystemdb
 
 import (
 	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"log"
+	"net/url"
 	"os"
 	"strings"
 
 	"path/filepath"
 
 	"fediwiki/activitypub"
+	"fediwiki/httpsig"
 	"fediwiki/pages"
 
 	"github.com/mischief/ndb"
@@ -36,6 +41,12 @@ func (db *FileSystemDB) GetPageActor(page string) (*activitypub.Actor, error) {
 	if err := json.Unmarshal(bytes, &p); err != nil {
 		return nil, err
 	}
+	if p.Endpoints == nil {
+		// Actors created before there was a shared inbox.
+		if u, err := url.Parse(p.Id); err == nil {
+			p.Endpoints = &activitypub.Endpoints{SharedInbox: "https://" + u.Host + "/inbox"}
+		}
+	}
 	return &p, nil
 }
 
@@ -47,8 +58,12 @@ func (db *FileSystemDB) NewPageActor(p pages.Page, domain string, private crypto
 		return nil, err
 	}
 	block := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: keybytes})
+	edpublic, edprivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
 	prof := &activitypub.Actor{
-		Context:           activitypub.JSONLDContext{"https://www.w3.org/ns/activitystreams", "https://w3id.org/security/v1"},
+		Context:           activitypub.JSONLDContext{"https://www.w3.org/ns/activitystreams", "https://w3id.org/security/v1", "https://w3id.org/security/multikey/v1"},
 		Id:                id,
 		Type:              "Service",
 		PreferredUsername: p.PageName,
@@ -56,11 +71,13 @@ func (db *FileSystemDB) NewPageActor(p pages.Page, domain string, private crypto
 		Summary:           p.Summary,
 		Inbox:             pageurl + "/inbox",
 		Outbox:            pageurl + "/outbox",
+		Endpoints:         &activitypub.Endpoints{SharedInbox: "https://" + domain + "/inbox"},
 		PublicKey: activitypub.PublicKey{
 			Id:           id + "#main-key",
 			Owner:        id,
 			PublicKeyPem: string(block),
 		},
+		AssertionMethod: []activitypub.Multikey{assertionKey(id, edpublic)},
 	}
 	filedir := filepath.Join(db.FSRoot, pages.Root, p.PageName)
 	if !strings.HasPrefix(filedir, db.FSRoot+pages.Root) {
@@ -81,43 +98,167 @@ func (db *FileSystemDB) NewPageActor(p pages.Page, domain string, private crypto
 	if err != nil {
 		return nil, err
 	}
+	edprivbytes, err := x509.MarshalPKCS8PrivateKey(edprivate)
+	if err != nil {
+		return nil, err
+	}
 	if err := os.WriteFile(filepath.Join(filedir, "private.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privkeybytes}), 0400); err != nil {
 		return nil, err
 	}
+	if err := os.WriteFile(filepath.Join(filedir, "ed25519.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edprivbytes}), 0400); err != nil {
+		return nil, err
+	}
 	if err := os.WriteFile(filename, bytes, 0664); err != nil {
 		return nil, err
 	}
 	return prof, nil
 }
 
+// assertionKey returns the Multikey which publishes the page actor's
+// Ed25519 key, used for RFC 9421 signatures.
+func assertionKey(actorid string, public ed25519.PublicKey) activitypub.Multikey {
+	return activitypub.Multikey{
+		Id:                 actorid + "#ed25519-key",
+		Type:               "Multikey",
+		Controller:         actorid,
+		PublicKeyMultibase: httpsig.EncodeMultikey(public),
+	}
+}
+
+func (d *FileSystemDB) GetAssertionKey(pagename string) (string, crypto.PrivateKey, error) {
+	actor, err := d.GetPageActor(pagename)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(actor.AssertionMethod) == 0 {
+		// Created before page actors had an Ed25519 key.
+		return "", nil, NotFound
+	}
+	privkey, err := readPrivateKey(filepath.Join(d.FSRoot, pages.Root, pagename, "ed25519.pem"))
+	if err != nil {
+		return "", nil, err
+	}
+	return actor.AssertionMethod[0].Id, privkey, nil
+}
+
 func (d *FileSystemDB) GetPrivateKey(pagename string) (*activitypub.Actor, crypto.PrivateKey, error) {
 	actor, err := d.GetPageActor(pagename)
 	if err != nil {
 		return nil, nil, err
 	}
-	pagedir := filepath.Join(d.FSRoot, pages.Root, pagename)
-	privkeybytes, err := os.ReadFile(filepath.Join(pagedir, "private.pem"))
+	privkey, err := readPrivateKey(filepath.Join(d.FSRoot, pages.Root, pagename, "private.pem"))
 	if err != nil {
 		return nil, nil, err
 	}
+	return actor, privkey, nil
+}
+
+func (d *FileSystemDB) RotatePageKey(pagename string, private crypto.PrivateKey, public crypto.PublicKey) (*activitypub.Actor, error) {
+	actor, err := d.GetPageActor(pagename)
+	if err != nil {
+		return nil, err
+	}
+	keybytes, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	actor.PublicKey.PublicKeyPem = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: keybytes}))
+	// The Ed25519 key is rotated with it, and actors created before
+	// they had one get one.
+	oldAssertionMethod := actor.AssertionMethod
+	edpublic, edprivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	edprivbytes, err := x509.MarshalPKCS8PrivateKey(edprivate)
+	if err != nil {
+		return nil, err
+	}
+	actor.AssertionMethod = []activitypub.Multikey{assertionKey(actor.Id, edpublic)}
+	hasMultikeyContext := false
+	for _, c := range actor.Context {
+		if c == "https://w3id.org/security/multikey/v1" {
+			hasMultikeyContext = true
+		}
+	}
+	if !hasMultikeyContext {
+		actor.Context = append(actor.Context, "https://w3id.org/security/multikey/v1")
+	}
+	bytes, err := json.Marshal(actor)
+	if err != nil {
+		return nil, err
+	}
+	privkeybytes, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write every file next to the one it replaces before renaming
+	// any, so that a failed write leaves the old keys in place. The
+	// private keys are read only, so they need to be replaced rather
+	// than written over.
+	pagedir := filepath.Join(d.FSRoot, pages.Root, pagename)
+	actorfile := filepath.Join(pagedir, "actor.json")
+	keyfile := filepath.Join(pagedir, "private.pem")
+	oldactor, err := os.ReadFile(actorfile)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(actorfile+".new", bytes, 0664); err != nil {
+		return nil, err
+	}
+	defer os.Remove(actorfile + ".new")
+	if err := os.WriteFile(keyfile+".new", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privkeybytes}), 0400); err != nil {
+		return nil, err
+	}
+	defer os.Remove(keyfile + ".new")
+	edkeyfile := filepath.Join(pagedir, "ed25519.pem")
+	if err := os.WriteFile(edkeyfile+".new", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edprivbytes}), 0400); err != nil {
+		return nil, err
+	}
+	defer os.Remove(edkeyfile + ".new")
+	if err := os.Rename(actorfile+".new", actorfile); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(keyfile+".new", keyfile); err != nil {
+		// Put back the old public key so that it matches the
+		// private key again.
+		if err := os.WriteFile(actorfile, oldactor, 0664); err != nil {
+			log.Println(err)
+		}
+		return nil, err
+	}
+	if err := os.Rename(edkeyfile+".new", edkeyfile); err != nil {
+		// Keep the new RSA key, but put back the old Ed25519 one.
+		actor.AssertionMethod = oldAssertionMethod
+		if bytes, err := json.Marshal(actor); err != nil {
+			log.Println(err)
+		} else if err := os.WriteFile(actorfile, bytes, 0664); err != nil {
+			log.Println(err)
+		}
+		return nil, err
+	}
+	return actor, nil
+}
+
+func readPrivateKey(filename string) (crypto.PrivateKey, error) {
+	privkeybytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
 
 	pemblock, _ := pem.Decode(privkeybytes)
+	if pemblock == nil {
+		return nil, fmt.Errorf("No PEM block in key")
+	}
 
 	switch pemblock.Type {
 	case "PRIVATE KEY":
-		privkey, err := x509.ParsePKCS8PrivateKey(pemblock.Bytes)
-		if err != nil {
-			return nil, nil, err
-		}
-		return actor, privkey, nil
+		return x509.ParsePKCS8PrivateKey(pemblock.Bytes)
 	case "RSA PRIVATE KEY":
-		privkey, err := x509.ParsePKCS1PrivateKey(pemblock.Bytes)
-		if err != nil {
-			return nil, nil, err
-		}
-		return actor, privkey, nil
+		return x509.ParsePKCS1PrivateKey(pemblock.Bytes)
 	default:
-		return nil, nil, fmt.Errorf("Unknown key type")
+		return nil, fmt.Errorf("Unknown key type")
 	}
 }
 
@@ -139,28 +280,67 @@ func (d *FileSystemDB) GetPageFollowers(pagename string, actors activitypub.Acto
 	records := followdb.Search("accepted", "true")
 	var result []activitypub.Actor = nil
 	for _, record := range records {
-		var actor activitypub.Actor
-		var acceptId string
+		var actorId, acceptId string
 		for _, t := range record {
 			switch t.Attr {
 			case "id":
-				a2, err := actors.GetForeignActor(t.Val)
-				if err != nil {
-					return nil, err
-				}
-				actor = *a2
+				actorId = t.Val
 			case "acceptedFrom":
 				acceptId = t.Val
 			}
 		}
-		if d.isUndone(acceptId) == false {
-			result = append(result, actor)
+		if d.isUndone(acceptId) || d.IsBlocked(actorId) {
+			continue
+		}
+		actor, err := actors.GetForeignActor(actorId)
+		if err != nil {
+			return nil, err
 		}
+		result = append(result, *actor)
 	}
 
 	return result, nil
 }
 
+func (d *FileSystemDB) GetPageFollowRequests(pagename string) ([]activitypub.Follow, error) {
+	pagedir := filepath.Join(d.FSRoot, pages.Root, pagename)
+	dbname := filepath.Join(pagedir, "followers.db")
+	if _, err := os.Stat(pagedir); errors.Is(err, os.ErrNotExist) {
+		return nil, NotFound
+	}
+	if _, err := os.Stat(dbname); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	var pageactor string
+	if actor, err := d.GetPageActor(pagename); err == nil {
+		pageactor = actor.Id
+	}
+
+	followdb, err := ndb.Open(dbname)
+	if err != nil {
+		return nil, err
+	}
+	var result []activitypub.Follow
+	for _, record := range followdb.Search("accepted", "true") {
+		follow := activitypub.Follow{
+			BaseProperties: activitypub.BaseProperties{Type: "Follow"},
+			Object:         pageactor,
+		}
+		for _, t := range record {
+			switch t.Attr {
+			case "id":
+				follow.Actor = t.Val
+			case "acceptedFrom":
+				follow.Id = t.Val
+			}
+		}
+		if !d.isUndone(follow.Id) {
+			result = append(result, follow)
+		}
+	}
+	return result, nil
+}
+
 func (d *FileSystemDB) isUndone(id string) bool {
 	filename := filepath.Join(d.FSRoot, "undo.db")
 	if _, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) {
@@ -1,13 +1,25 @@
 package filesystemdb
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"os"
+	"sync"
 	"testing"
+	"time"
+
+	"path/filepath"
 
 	"fediwiki/activitypub"
+	"fediwiki/httpsig"
 	"fediwiki/pages"
+
+	"github.com/mischief/ndb"
 )
 
 var _ pages.PagesDatabase = &FileSystemDB{}
@@ -40,6 +52,9 @@ func TestNewPageActor(t *testing.T) {
 	if actor.Name != page.Title {
 		t.Error("Actor name not equal to page title")
 	}
+	if len(actor.AssertionMethod) != 1 || actor.AssertionMethod[0].Id != actor.Id+"#ed25519-key" {
+		t.Errorf("Unexpected assertionMethod %v", actor.AssertionMethod)
+	}
 }
 
 type testActorDB map[string]activitypub.Actor
@@ -55,6 +70,14 @@ func (db testActorDB) StoreActor(actor activitypub.Actor, raw []byte) error {
 	db[actor.Id] = actor
 	return nil
 }
+func (db testActorDB) IsActorStale(id string) bool {
+	_, ok := db[id]
+	return !ok
+}
+func (db testActorDB) RemoveActor(id string) error {
+	delete(db, id)
+	return nil
+}
 func TestGetFollowers(t *testing.T) {
 	tmpdir, err := os.MkdirTemp("", "pagesfollowers")
 	if err != nil {
@@ -126,9 +149,9 @@ func TestGetFollowers(t *testing.T) {
 			Type:  "Undo",
 			Actor: "Bar",
 		},
-		Object: followReq,
+		Object: activitypub.ObjectReference{Id: followReq.Id, Type: "Follow"},
 	}
-	if err := db.UndoFollow("Foo", undo); err != nil {
+	if err := db.UndoActivity(followReq.BaseProperties, undo); err != nil {
 		t.Error(err)
 	}
 	followers, err = db.GetPageFollowers("Foo", testActors)
@@ -139,3 +162,259 @@ func TestGetFollowers(t *testing.T) {
 		t.Errorf("Expected 0 followers after undo, got %v", len(followers))
 	}
 }
+
+func TestInstanceActor(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "instance")
+	if err != nil {
+		t.Fatal("Could not create temp dir for test")
+	}
+	defer os.RemoveAll(tmpdir)
+	db := FileSystemDB{FSRoot: tmpdir}
+
+	if _, _, err := db.GetInstanceActor(); err != NotFound {
+		t.Errorf("Unexpected error before instance actor was created: %v", err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.NewInstanceActor("example.com", key, &key.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	actor, privkey, err := db.GetInstanceActor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actor.Id != "https://example.com/actor" || actor.Type != "Application" {
+		t.Errorf("Unexpected instance actor: %v", actor)
+	}
+	if !key.Equal(privkey) {
+		t.Error("Private key was not preserved")
+	}
+}
+
+func TestRotatePageKey(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "rotatekey")
+	if err != nil {
+		t.Fatal("Could not create temp dir for test")
+	}
+	defer os.RemoveAll(tmpdir)
+	db := FileSystemDB{FSRoot: tmpdir}
+	page := pages.Page{PageName: "Foo", Title: "Foo title"}
+
+	oldkey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := db.NewPageActor(page, "example.com", oldkey, &oldkey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldkeyid, oldedkey, err := db.GetAssertionKey("Foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newkey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.RotatePageKey("Foo", newkey, &newkey.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	actor, privkey, err := db.GetPrivateKey("Foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !newkey.Equal(privkey) {
+		t.Error("Private key was not rotated")
+	}
+	if actor.PublicKey.PublicKeyPem == old.PublicKey.PublicKeyPem {
+		t.Error("Public key was not rotated")
+	}
+	if actor.PublicKey.Id != old.PublicKey.Id || actor.Id != old.Id {
+		t.Error("Actor ids should not change when rotating key")
+	}
+	keyid, edkey, err := db.GetAssertionKey("Foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyid != oldkeyid || keyid != actor.AssertionMethod[0].Id {
+		t.Errorf("Unexpected assertion key id %v", keyid)
+	}
+	if edkey.(ed25519.PrivateKey).Equal(oldedkey) {
+		t.Error("Ed25519 key was not rotated")
+	}
+	public := edkey.(ed25519.PrivateKey).Public().(ed25519.PublicKey)
+	if actor.AssertionMethod[0].PublicKeyMultibase != httpsig.EncodeMultikey(public) {
+		t.Error("Published Ed25519 key does not match private key")
+	}
+	for _, name := range []string{"actor.json.new", "private.pem.new", "ed25519.pem.new"} {
+		if _, err := os.Stat(filepath.Join(tmpdir, pages.Root, "Foo", name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%v was left behind: %v", name, err)
+		}
+	}
+}
+
+func TestKeyCacheExpiry(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "keycache")
+	if err != nil {
+		t.Fatal("Could not create temp dir for test")
+	}
+	defer os.RemoveAll(tmpdir)
+	db := FileSystemDB{FSRoot: tmpdir}
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keybytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveKey("https://example.com/actor#main-key", "https://example.com/actor", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: keybytes})); err != nil {
+		t.Fatal(err)
+	}
+	if _, owner, err := db.GetKey("https://example.com/actor#main-key"); err != nil || owner != "https://example.com/actor" {
+		t.Errorf("Could not get cached key: %v %v", owner, err)
+	}
+
+	defer func(expiry time.Duration) { KeyCacheExpiry = expiry }(KeyCacheExpiry)
+	KeyCacheExpiry = -time.Minute
+	if _, _, err := db.GetKey("https://example.com/actor#main-key"); err == nil {
+		t.Error("Expected expired key to not be returned")
+	}
+}
+
+func TestMoveFollower(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "movefollower")
+	if err != nil {
+		t.Fatal("Could not create temp dir for test")
+	}
+	defer os.RemoveAll(tmpdir)
+	db := FileSystemDB{FSRoot: tmpdir}
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Foo", "Bar"} {
+		page := pages.Page{PageName: name, Title: name, Content: "content"}
+		actor, err := db.NewPageActor(page, "example.com", key, &key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.SavePage(page, *actor, "editor"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	follow := activitypub.Follow{
+		BaseProperties: activitypub.BaseProperties{Id: "https://example.org/follow/1", Type: "Follow", Actor: "https://example.org/old"},
+	}
+	if err := db.AddFollower("Foo", follow); err != nil {
+		t.Fatal(err)
+	}
+	testActors := testActorDB{
+		"https://example.org/old": activitypub.Actor{Id: "https://example.org/old"},
+		"https://example.net/new": activitypub.Actor{Id: "https://example.net/new"},
+	}
+
+	move := activitypub.BaseProperties{Id: "https://example.org/move/1", Type: "Move", Actor: "https://example.org/old"}
+	if err := db.MoveFollower("https://example.org/old", "https://example.net/new", move); err != nil {
+		t.Fatal(err)
+	}
+	followers, err := db.GetPageFollowers("Foo", testActors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(followers) != 1 || followers[0].Id != "https://example.net/new" {
+		t.Errorf("Follow was not moved: %v", followers)
+	}
+	if followers, err := db.GetPageFollowers("Bar", testActors); err != nil || len(followers) != 0 {
+		t.Errorf("Unexpected followers of other page: %v %v", followers, err)
+	}
+
+	del := activitypub.BaseProperties{Id: "https://example.net/delete/1", Type: "Delete", Actor: "https://example.net/new"}
+	if err := db.RemoveFollower("https://example.net/new", del); err != nil {
+		t.Fatal(err)
+	}
+	delete(testActors, "https://example.net/new")
+	if followers, err := db.GetPageFollowers("Foo", testActors); err != nil || len(followers) != 0 {
+		t.Errorf("Expected no followers after delete: %v %v", followers, err)
+	}
+}
+
+func TestStoreActor(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "storeactor")
+	if err != nil {
+		t.Fatal("Could not create temp dir for test")
+	}
+	defer os.RemoveAll(tmpdir)
+	db := FileSystemDB{FSRoot: tmpdir}
+
+	if !db.IsActorStale("https://example.org/user") {
+		t.Error("Unknown actor should be stale")
+	}
+	for _, name := range []string{"First Name", "Second Name"} {
+		actor := activitypub.Actor{Id: "https://example.org/user", Type: "Person", Name: name}
+		if err := db.StoreActor(actor, []byte(`{"id": "https://example.org/user", "name": "`+name+`"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.StoreActor(activitypub.Actor{Id: "https://example.org/other"}, []byte(`{"id": "https://example.org/other"}`)); err != nil {
+		t.Fatal(err)
+	}
+	actordb, err := ndb.Open(filepath.Join(tmpdir, "actors.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := actordb.Search("id", "https://example.org/user"); len(records) != 1 {
+		t.Errorf("Expected 1 record for actor, got %d", len(records))
+	}
+	actor, err := db.GetForeignActor("https://example.org/user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actor.Name != "Second Name" {
+		t.Errorf("Unexpected name %v", actor.Name)
+	}
+	if db.IsActorStale("https://example.org/user") {
+		t.Error("Actor should not be stale after being stored")
+	}
+
+	if err := db.RemoveActor("https://example.org/user"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetForeignActor("https://example.org/user"); err != NotFound {
+		t.Errorf("Expected removed actor to not be found, got %v", err)
+	}
+	if _, err := db.GetForeignActor("https://example.org/other"); err != nil {
+		t.Errorf("Other actor was removed: %v", err)
+	}
+}
+
+func TestStoreActorConcurrently(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "storeactor")
+	if err != nil {
+		t.Fatal("Could not create temp dir for test")
+	}
+	defer os.RemoveAll(tmpdir)
+	db := &FileSystemDB{FSRoot: tmpdir}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("https://example.org/user%d", i)
+			if err := db.StoreActor(activitypub.Actor{Id: id}, []byte(`{"id": "`+id+`"}`)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 20; i++ {
+		if _, err := db.GetForeignActor(fmt.Sprintf("https://example.org/user%d", i)); err != nil {
+			t.Errorf("Actor %d was lost: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package filesystemdb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"path/filepath"
+
+	"fediwiki/pages"
+
+	"github.com/mischief/ndb"
+)
+
+func (d *FileSystemDB) proposalDir(pagename string) (string, error) {
+	pagedir := filepath.Join(d.FSRoot, pages.Root, pagename)
+	if pagename == "" || !strings.HasPrefix(pagedir, d.FSRoot+pages.Root) {
+		return "", fmt.Errorf("Invalid page name")
+	}
+	return filepath.Join(pagedir, "proposals"), nil
+}
+
+func (d *FileSystemDB) writeProposal(dir string, proposal pages.Proposal) error {
+	bytes, err := json.Marshal(proposal)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, proposal.Id+".json.new")
+	if err := os.WriteFile(tmp, bytes, 0664); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, proposal.Id+".json"))
+}
+
+func (d *FileSystemDB) AddProposal(proposal pages.Proposal) (*pages.Proposal, error) {
+	dir, err := d.proposalDir(proposal.PageName)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return nil, err
+	}
+	var idrand [4]byte
+	if _, err := rand.Read(idrand[:]); err != nil {
+		return nil, err
+	}
+	if proposal.Created.IsZero() {
+		proposal.Created = time.Now()
+	}
+	proposal.Id = proposal.Created.UTC().Format("20060102150405") + "-" + hex.EncodeToString(idrand[:])
+	proposal.Status = pages.ProposalOpen
+	if err := d.writeProposal(dir, proposal); err != nil {
+		return nil, err
+	}
+	return &proposal, nil
+}
+
+func (d *FileSystemDB) GetProposals(pagename string) ([]pages.Proposal, error) {
+	dir, err := d.proposalDir(pagename)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var result []pages.Proposal
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		proposal, err := d.GetProposal(pagename, strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *proposal)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Created.Before(result[j].Created)
+	})
+	return result, nil
+}
+
+func (d *FileSystemDB) GetProposal(pagename, id string) (*pages.Proposal, error) {
+	dir, err := d.proposalDir(pagename)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" || strings.ContainsAny(id, "/.") {
+		return nil, NotFound
+	}
+	bytes, err := os.ReadFile(filepath.Join(dir, id+".json"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, NotFound
+		}
+		return nil, err
+	}
+	var proposal pages.Proposal
+	if err := json.Unmarshal(bytes, &proposal); err != nil {
+		return nil, err
+	}
+	return &proposal, nil
+}
+
+func (d *FileSystemDB) SetProposalStatus(pagename, id, status string) error {
+	proposal, err := d.GetProposal(pagename, id)
+	if err != nil {
+		return err
+	}
+	dir, err := d.proposalDir(pagename)
+	if err != nil {
+		return err
+	}
+	proposal.Status = status
+	return d.writeProposal(dir, *proposal)
+}
+
+func (d *FileSystemDB) upstreamFile(pagename string) (string, error) {
+	dir, err := d.proposalDir(pagename)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(dir), "upstream.db"), nil
+}
+
+func (d *FileSystemDB) writeUpstream(pagename, actor, article, version string) error {
+	filename, err := d.upstreamFile(pagename)
+	if err != nil {
+		return err
+	}
+	record := fmt.Sprintf("actor=%s article=%s", ndbQuote(actor), ndbQuote(article))
+	if version != "" {
+		record += " version=" + version
+	}
+	return os.WriteFile(filename, []byte(record+"\n"), 0664)
+}
+
+func (d *FileSystemDB) SetUpstream(pagename, actor, article string) error {
+	d.rewriteMu.Lock()
+	defer d.rewriteMu.Unlock()
+	if err := d.writeUpstream(pagename, actor, article, ""); err != nil {
+		return err
+	}
+	// Keep an index of every page's upstream, so that finding the
+	// pages forked from an actor doesn't need to look at every page.
+	if err := d.indexUpstreams(); err != nil {
+		return err
+	}
+	filename := filepath.Join(d.FSRoot, "upstreams.db")
+	if err := removeRecords(filename, "page", pagename); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "\npage=%s actor=%s\n", pagename, ndbQuote(actor))
+	return err
+}
+
+// indexUpstreams creates upstreams.db from the upstream of every page if
+// it doesn't exist yet, for pages which were forked before it did. The
+// caller must hold rewriteMu.
+func (d *FileSystemDB) indexUpstreams() error {
+	filename := filepath.Join(d.FSRoot, "upstreams.db")
+	if _, err := os.Stat(filename); !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	pagelist, err := d.ListPages()
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, pagename := range pagelist {
+		if actor, _, err := d.GetUpstream(pagename); err == nil && actor != "" {
+			fmt.Fprintf(&b, "\npage=%s actor=%s\n", pagename, ndbQuote(actor))
+		}
+	}
+	return os.WriteFile(filename, []byte(b.String()), 0664)
+}
+
+// readUpstream returns the tuples of the page's upstream.db.
+func (d *FileSystemDB) readUpstream(pagename string) (actor, article, version string, err error) {
+	filename, err := d.upstreamFile(pagename)
+	if err != nil {
+		return "", "", "", err
+	}
+	if _, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) {
+		return "", "", "", nil
+	}
+	upstreamdb, err := ndb.Open(filename)
+	if err != nil {
+		return "", "", "", err
+	}
+	for _, record := range upstreamdb.Search("actor", "") {
+		for _, tuple := range record {
+			switch tuple.Attr {
+			case "actor":
+				actor = tuple.Val
+			case "article":
+				article = tuple.Val
+			case "version":
+				version = tuple.Val
+			}
+		}
+	}
+	return actor, article, version, nil
+}
+
+func (d *FileSystemDB) GetUpstream(pagename string) (actor, article string, err error) {
+	actor, article, _, err = d.readUpstream(pagename)
+	return actor, article, err
+}
+
+func (d *FileSystemDB) SetUpstreamVersion(pagename, version string) error {
+	d.rewriteMu.Lock()
+	defer d.rewriteMu.Unlock()
+	actor, article, _, err := d.readUpstream(pagename)
+	if err != nil {
+		return err
+	}
+	if actor == "" {
+		return NotFound
+	}
+	return d.writeUpstream(pagename, actor, article, version)
+}
+
+func (d *FileSystemDB) GetUpstreamVersion(pagename string) (string, error) {
+	_, _, version, err := d.readUpstream(pagename)
+	return version, err
+}
+
+func (d *FileSystemDB) GetDownstreamPages(upstream string) ([]string, error) {
+	filename := filepath.Join(d.FSRoot, "upstreams.db")
+	if _, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) {
+		d.rewriteMu.Lock()
+		err := d.indexUpstreams()
+		d.rewriteMu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	upstreamdb, err := ndb.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, record := range upstreamdb.Search("actor", upstream) {
+		for _, tuple := range record {
+			if tuple.Attr == "page" {
+				result = append(result, tuple.Val)
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,112 @@
+package filesystemdb
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fediwiki/pages"
+)
+
+func TestProposals(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "proposals")
+	if err != nil {
+		t.Fatal("Could not create temp dir for test")
+	}
+	defer os.RemoveAll(tmpdir)
+	db := FileSystemDB{FSRoot: tmpdir}
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := pages.Page{PageName: "Foo", Title: "Foo", Content: "content"}
+	actor, err := db.NewPageActor(page, "example.com", key, &key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err := db.SavePageRevision(page, *actor, pages.Revision{Editor: "fork", Origin: "https://example.org/pages/Foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revs, err := db.GetPageRevisions("Foo"); err != nil || len(revs) != 1 || revs[0].Origin != "https://example.org/pages/Foo" {
+		t.Errorf("Revision origin was not saved: %v %v", revs, err)
+	}
+
+	if err := db.SetUpstream("Foo", "https://example.org/pages/Foo/actor", "https://example.org/pages/Foo"); err != nil {
+		t.Fatal(err)
+	}
+	if actor, article, err := db.GetUpstream("Foo"); err != nil || actor != "https://example.org/pages/Foo/actor" || article != "https://example.org/pages/Foo" {
+		t.Errorf("Unexpected upstream: %v %v %v", actor, article, err)
+	}
+	if downstream, err := db.GetDownstreamPages("https://example.org/pages/Foo/actor"); err != nil || len(downstream) != 1 || downstream[0] != "Foo" {
+		t.Errorf("Unexpected downstream pages: %v %v", downstream, err)
+	}
+	if downstream, err := db.GetDownstreamPages("https://example.org/pages/Bar/actor"); err != nil || len(downstream) != 0 {
+		t.Errorf("Unexpected downstream pages: %v %v", downstream, err)
+	}
+
+	if version, err := db.GetUpstreamVersion("Foo"); err != nil || version != "" {
+		t.Errorf("Unexpected upstream version: %v %v", version, err)
+	}
+	if err := db.SetUpstreamVersion("Foo", page.Version()); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := db.GetUpstreamVersion("Foo"); err != nil || version != page.Version() {
+		t.Errorf("Unexpected upstream version: %v %v", version, err)
+	}
+	if actor, article, err := db.GetUpstream("Foo"); err != nil || actor != "https://example.org/pages/Foo/actor" || article != "https://example.org/pages/Foo" {
+		t.Errorf("Setting the version changed the upstream: %v %v %v", actor, article, err)
+	}
+	if err := db.SetUpstreamVersion("Bar", page.Version()); err != NotFound {
+		t.Errorf("Expected not found for page without upstream, got %v", err)
+	}
+
+	// Pages forked before upstreams.db existed are found too.
+	if err := os.Remove(filepath.Join(tmpdir, "upstreams.db")); err != nil {
+		t.Fatal(err)
+	}
+	if downstream, err := db.GetDownstreamPages("https://example.org/pages/Foo/actor"); err != nil || len(downstream) != 1 || downstream[0] != "Foo" {
+		t.Errorf("Unexpected downstream pages after reindexing: %v %v", downstream, err)
+	}
+	if err := db.SetUpstream("Foo", "https://example.net/pages/Foo/actor", "https://example.net/pages/Foo"); err != nil {
+		t.Fatal(err)
+	}
+	if downstream, err := db.GetDownstreamPages("https://example.org/pages/Foo/actor"); err != nil || len(downstream) != 0 {
+		t.Errorf("Unexpected downstream pages of old upstream: %v %v", downstream, err)
+	}
+	if err := db.SetUpstream("Foo", "https://example.org/pages/Foo/actor", "https://example.org/pages/Foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	if proposals, err := db.GetProposals("Foo"); err != nil || len(proposals) != 0 {
+		t.Fatalf("Unexpected proposals: %v %v", proposals, err)
+	}
+	proposed := pages.Page{PageName: "Foo", Title: "Foo", Content: "new content"}
+	p, err := db.AddProposal(pages.Proposal{PageName: "Foo", Actor: "https://example.org/pages/Foo/actor", Parent: rev.RevisionID, Page: proposed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Id == "" || p.Status != pages.ProposalOpen {
+		t.Errorf("Unexpected new proposal: %v", p)
+	}
+	got, err := db.GetProposal("Foo", p.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Page != proposed || got.Parent != rev.RevisionID {
+		t.Errorf("Unexpected proposal: %v", got)
+	}
+	if _, err := db.GetProposal("Foo", "../../actor"); err == nil {
+		t.Error("Expected error for invalid proposal id")
+	}
+
+	if err := db.SetProposalStatus("Foo", p.Id, pages.ProposalRejected); err != nil {
+		t.Fatal(err)
+	}
+	if proposals, err := db.GetProposals("Foo"); err != nil || len(proposals) != 1 || proposals[0].Status != pages.ProposalRejected {
+		t.Errorf("Status was not updated: %v %v", proposals, err)
+	}
+}
@@ -0,0 +1,107 @@
+package filesystemdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"path/filepath"
+
+	"fediwiki/activitypub"
+
+	"github.com/mischief/ndb"
+)
+
+func (d *FileSystemDB) AddReport(flag activitypub.Flag) error {
+	filename := filepath.Join(d.FSRoot, "reports.db")
+	if reportdb, err := ndb.Open(filename); err == nil {
+		if len(reportdb.Search("report", flag.Id)) != 0 {
+			// Already added
+			return nil
+		}
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	record := fmt.Sprintf("\nreport=%s actor=%s received=%s\n", flag.Id, flag.Actor, time.Now().UTC().Format(time.RFC3339))
+	if _, err := f.WriteString(record); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *FileSystemDB) GetReports() ([]activitypub.Report, error) {
+	filename := filepath.Join(d.FSRoot, "reports.db")
+	if _, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	reportdb, err := ndb.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := d.objectIndex()
+	if err != nil {
+		return nil, err
+	}
+	resolvedBy := make(map[string]string)
+	for _, resolved := range reportdb.Search("resolved", "") {
+		var id, by string
+		for _, tuple := range resolved {
+			switch tuple.Attr {
+			case "resolved":
+				id = tuple.Val
+			case "by":
+				by = tuple.Val
+			}
+		}
+		resolvedBy[id] = by
+	}
+	var result []activitypub.Report
+	for _, record := range reportdb.Search("report", "") {
+		var report activitypub.Report
+		for _, tuple := range record {
+			switch tuple.Attr {
+			case "report":
+				report.Flag.Id = tuple.Val
+			case "actor":
+				report.Flag.Actor = tuple.Val
+			case "received":
+				if t, err := time.Parse(time.RFC3339, tuple.Val); err == nil {
+					report.Received = t
+				}
+			}
+		}
+		if raw, err := d.readObject(objects[report.Flag.Id]); err == nil {
+			if err := json.Unmarshal(raw, &report.Flag); err != nil {
+				return nil, err
+			}
+		}
+		report.ResolvedBy = resolvedBy[report.Flag.Id]
+		result = append(result, report)
+	}
+	return result, nil
+}
+
+func (d *FileSystemDB) ResolveReport(id, admin string) error {
+	filename := filepath.Join(d.FSRoot, "reports.db")
+	reportdb, err := ndb.Open(filename)
+	if err != nil || len(reportdb.Search("report", id)) == 0 {
+		return NotFound
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0664)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	record := fmt.Sprintf("\nresolved=%s by=%s\n", id, ndbQuote(admin))
+	if _, err := f.WriteString(record); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package httpsig
+
+import (
+	"crypto"
+	"net/http"
+	"time"
+
+	"github.com/go-fed/httpsig"
+)
+
+// A SigningKey is used to sign outbound GET requests, so that remote
+// objects can be fetched from servers which require authorized fetch
+// (Mastodon's "secure mode").
+type SigningKey struct {
+	KeyId      string
+	PrivateKey crypto.PrivateKey
+}
+
+// FetchKey signs requests made by Get. It's normally the instance actor's
+// key. If it's nil, requests are unsigned.
+var FetchKey *SigningKey
+
+// Client is used to make the requests made by Get. It has a timeout
+// because objects are sometimes fetched while responding to a request.
+var Client = &http.Client{Timeout: 10 * time.Second}
+
+// Get fetches url, asking for the given content type(s), signing the
+// request with FetchKey.
+func Get(url, accept string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	if key := FetchKey; key != nil {
+		if err := signGet(key, req); err != nil {
+			return nil, err
+		}
+	}
+	return Client.Do(req)
+}
+
+func signGet(key *SigningKey, r *http.Request) error {
+	prefs := []httpsig.Algorithm{httpsig.RSA_SHA256}
+	headersToSign := []string{httpsig.RequestTarget, "date", "host", "accept"}
+	signer, _, err := httpsig.NewSigner(prefs, httpsig.DigestSha256, headersToSign, httpsig.Signature, 60*60)
+	if err != nil {
+		return err
+	}
+	return signer.SignRequest(key.PrivateKey, key.KeyId, r, nil)
+}
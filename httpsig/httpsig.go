@@ -1,20 +1,31 @@
 package httpsig
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-fed/httpsig"
 )
 
 type KeyStore interface {
-	GetKey(keyid string) (crypto.PublicKey, error)
+	// GetKey returns a cached key and its owner.
+	GetKey(keyid string) (crypto.PublicKey, string, error)
 	SaveKey(keyid, owner string, pemBytes []byte) error
 }
 
@@ -26,74 +37,379 @@ type actorKeyObject struct {
 		Owner        string `json:"owner"`
 		PublicKeyPem string `json:"publicKeyPem"`
 	} `json:"publicKey"`
+	AssertionMethod []multikey `json:"assertionMethod"`
+
+	// Set if the key id refers to a Multikey rather than an actor.
+	multikey
 }
 
-func Validate(r *http.Request, keycache KeyStore) error {
-	verifier, err := httpsig.NewVerifier(r)
+// findKey returns the PEM encoded key with the given id and its owner
+// from the fetched actor or key. The owner must be on the same host as the
+// key, so that nobody can publish a key claiming to belong to someone
+// else's actor.
+func (a actorKeyObject) findKey(keyId string) ([]byte, string, error) {
+	var pemKey []byte
+	var owner string
+	var err error
+	switch {
+	case a.PublicKey.Id == keyId:
+		pemKey, owner = []byte(a.PublicKey.PublicKeyPem), a.PublicKey.Owner
+	case a.multikey.Id == keyId && a.multikey.Type == "Multikey":
+		pemKey, err = multikeyToPem(a.multikey.PublicKeyMultibase)
+		owner = a.multikey.Controller
+	default:
+		for _, key := range a.AssertionMethod {
+			if key.Id == keyId && key.Type == "Multikey" {
+				pemKey, err = multikeyToPem(key.PublicKeyMultibase)
+				owner = key.Controller
+				break
+			}
+		}
+		if pemKey == nil && err == nil {
+			return nil, "", fmt.Errorf("Could not retrieve %v, got %v", keyId, a.PublicKey.Id)
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if err := checkKeyOrigin(keyId, owner); err != nil {
+		return nil, "", err
+	}
+	return pemKey, owner, nil
+}
+
+// checkKeyOrigin returns an error unless the key's owner is on the same
+// host as the key.
+func checkKeyOrigin(keyId, owner string) error {
+	keyURL, err := url.Parse(keyId)
 	if err != nil {
 		return err
 	}
-	algorithm, err := getAlgorithm(r.Header.Get("Signature"))
+	ownerURL, err := url.Parse(owner)
 	if err != nil {
 		return err
 	}
+	if owner == "" || ownerURL.Scheme != keyURL.Scheme || !strings.EqualFold(ownerURL.Host, keyURL.Host) {
+		return fmt.Errorf("%w: key %v claims to be owned by %v", WrongOwner, keyId, owner)
+	}
+	return nil
+}
+
+var (
+	MissingHeader  error = errors.New("Required header not signed")
+	DigestMismatch error = errors.New("Digest does not match body")
+	DateOutOfRange error = errors.New("Date is outside of allowed clock skew")
+	Replayed       error = errors.New("Signature has already been used")
+	WrongOwner     error = errors.New("Key owner does not match actor")
+)
+
+// MaxClockSkew is how far the Date of a signed request may be from the
+// current time.
+var MaxClockSkew = 5 * time.Minute
+
+// Validate validates the HTTP signature of r and returns the owner of the
+// key which signed it. Both draft-cavage and RFC 9421 signatures are
+// supported. The signature must identify the request and cover its date
+// (and digest, if there's a body), the digest must match the body and the
+// date must be within MaxClockSkew. The body of r is left unread.
+func Validate(r *http.Request, keycache KeyStore) (string, error) {
+	var body []byte
+	if r.Body != nil && r.Method != "GET" && r.Method != "HEAD" {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			return "", err
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(b))
+		body = b
+	}
+	if r.Header.Get("Signature-Input") != "" {
+		return validateRFC9421(r, body, keycache)
+	}
+
+	params := signatureParams(r.Header.Get("Signature"))
+	if params == nil {
+		return "", fmt.Errorf("%w: signature", MissingHeader)
+	}
+	if err := checkSignedHeaders(r, params["headers"]); err != nil {
+		return "", err
+	}
+	if err := checkDate(r.Header.Get("Date"), time.Now()); err != nil {
+		return "", err
+	}
+	if body != nil {
+		if err := checkDigest(r.Header.Get("Digest"), body); err != nil {
+			return "", err
+		}
+	}
 
-	pubkey, err := getKey(verifier.KeyId(), keycache)
+	verifier, err := httpsig.NewVerifier(r)
 	if err != nil {
-		return err
+		return "", err
 	}
-	if err := verifier.Verify(pubkey, algorithm); err != nil {
+	owner, err := verifyKey(verifier.KeyId(), keycache, func(pubkey crypto.PublicKey) error {
+		algorithm, err := getAlgorithm(params["algorithm"], pubkey)
+		if err != nil {
+			return err
+		}
+		return verifier.Verify(pubkey, algorithm)
+	})
+	if err != nil {
 		log.Println(err)
+		return "", err
+	}
+	if seen.check(params["signature"], time.Now()) {
+		return "", Replayed
+	}
+	return owner, nil
+}
+
+// CheckOwner returns an error if the owner of the key which signed a
+// request isn't the actor of the activity it contained.
+func CheckOwner(owner, actor string) error {
+	if owner == "" || owner != actor {
+		return fmt.Errorf("%w: key owned by %v, actor is %v", WrongOwner, owner, actor)
+	}
+	return nil
+}
+
+// signatureParams parses the parameters of a draft-cavage Signature
+// header. It returns nil if there's no header.
+func signatureParams(header string) map[string]string {
+	if header == "" {
+		return nil
+	}
+	params := make(map[string]string)
+	for _, piece := range strings.Split(header, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(piece), "=")
+		if !ok {
+			continue
+		}
+		params[key] = strings.Trim(val, `"`)
+	}
+	return params
+}
+
+func checkSignedHeaders(r *http.Request, headers string) error {
+	if headers == "" {
+		// The default when no headers are specified.
+		headers = "date"
+	}
+	signed := make(map[string]bool)
+	for _, h := range strings.Fields(strings.ToLower(headers)) {
+		signed[h] = true
+	}
+	required := []string{"(request-target)", "host", "date"}
+	if r.Method == "POST" {
+		required = append(required, "digest")
+	}
+	for _, h := range required {
+		if !signed[h] {
+			return fmt.Errorf("%w: %v", MissingHeader, h)
+		}
+	}
+	return nil
+}
+
+func checkDate(header string, now time.Time) error {
+	if header == "" {
+		return fmt.Errorf("%w: date", MissingHeader)
+	}
+	date, err := http.ParseTime(header)
+	if err != nil {
 		return err
 	}
-	log.Println("Validated sig")
+	if skew := now.Sub(date); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return fmt.Errorf("%w: %v", DateOutOfRange, header)
+	}
 	return nil
 }
 
-func getKey(keyId string, keycache KeyStore) (crypto.PublicKey, error) {
-	if key, err := keycache.GetKey(keyId); err == nil {
-		return key, nil
+func checkDigest(header string, body []byte) error {
+	if header == "" {
+		return fmt.Errorf("%w: digest", MissingHeader)
+	}
+	sum := sha256.Sum256(body)
+	expected := base64.StdEncoding.EncodeToString(sum[:])
+	for _, digest := range strings.Split(header, ",") {
+		algorithm, val, ok := strings.Cut(strings.TrimSpace(digest), "=")
+		if ok && strings.EqualFold(algorithm, "SHA-256") {
+			if val != expected {
+				return DigestMismatch
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: no SHA-256 digest", DigestMismatch)
+}
+
+// replayCache remembers signatures which have been used within the
+// allowed clock skew, so that captured requests can't be replayed. It's
+// only kept in memory, so it isn't effective when running as a CGI
+// script. The inbox also ignores activities it's already received.
+type replayCache struct {
+	sync.Mutex
+	signatures map[string]time.Time
+	// Expired signatures are removed at most once per MaxClockSkew
+	// rather than on every request.
+	nextPrune time.Time
+}
+
+var seen = replayCache{signatures: make(map[string]time.Time)}
+
+// check records signature and returns true if it had already been seen.
+func (c *replayCache) check(signature string, now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+	if now.After(c.nextPrune) {
+		for sig, expires := range c.signatures {
+			if now.After(expires) {
+				delete(c.signatures, sig)
+			}
+		}
+		c.nextPrune = now.Add(MaxClockSkew)
+	}
+	if expires, ok := c.signatures[signature]; ok && !now.After(expires) {
+		return true
 	}
+	// Anything older than this would be rejected by checkDate.
+	c.signatures[signature] = now.Add(2 * MaxClockSkew)
+	return false
+}
+
+// keyRefetches remembers when keys which failed to verify a signature
+// were last fetched again, so that bad signatures can't make us fetch the
+// same key over and over.
+type keyRefetches struct {
+	sync.Mutex
+	next map[string]keyRefetch
+}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", keyId, nil)
+type keyRefetch struct {
+	at   time.Time
+	wait time.Duration
+}
+
+// How long to wait before fetching a key again after a refetched key
+// failed to verify a signature. The wait doubles each time it fails again.
+const (
+	MinKeyRefetchWait = time.Minute
+	MaxKeyRefetchWait = 6 * time.Hour
+)
+
+// maxKeyRefetches is how many keys' failures are remembered.
+const maxKeyRefetches = 10000
+
+var refetches = keyRefetches{next: make(map[string]keyRefetch)}
+
+// allowed returns true if the key with the given id may be fetched again.
+func (k *keyRefetches) allowed(keyId string, now time.Time) bool {
+	k.Lock()
+	defer k.Unlock()
+	return !now.Before(k.next[keyId].at)
+}
+
+// failed records that the refetched key with the given id didn't verify a
+// signature.
+func (k *keyRefetches) failed(keyId string, now time.Time) {
+	k.Lock()
+	defer k.Unlock()
+	wait := 2 * k.next[keyId].wait
+	if wait < MinKeyRefetchWait {
+		wait = MinKeyRefetchWait
+	} else if wait > MaxKeyRefetchWait {
+		wait = MaxKeyRefetchWait
+	}
+	if _, ok := k.next[keyId]; !ok && len(k.next) >= maxKeyRefetches {
+		k.prune(now)
+	}
+	k.next[keyId] = keyRefetch{at: now.Add(wait), wait: wait}
+}
+
+// prune forgets keys which haven't failed again for longer than the
+// longest wait, and then arbitrary keys until there's room for more.
+func (k *keyRefetches) prune(now time.Time) {
+	for id, refetch := range k.next {
+		if now.Sub(refetch.at) > MaxKeyRefetchWait {
+			delete(k.next, id)
+		}
+	}
+	for id := range k.next {
+		if len(k.next) < maxKeyRefetches*3/4 {
+			break
+		}
+		delete(k.next, id)
+	}
+}
+
+// succeeded forgets any failures of the key with the given id.
+func (k *keyRefetches) succeeded(keyId string) {
+	k.Lock()
+	defer k.Unlock()
+	delete(k.next, keyId)
+}
+
+// verifyKey calls verify with the key with the given id and returns the
+// key's owner. If verification fails with a cached key, the key is fetched
+// again in case it's been rotated, unless that was already tried recently.
+func verifyKey(keyId string, keycache KeyStore, verify func(crypto.PublicKey) error) (string, error) {
+	if key, owner, err := keycache.GetKey(keyId); err == nil {
+		err := verify(key)
+		if err == nil {
+			return owner, nil
+		}
+		if !refetches.allowed(keyId, time.Now()) {
+			return "", err
+		}
+		log.Printf("Could not verify with cached key %v, refetching\n", keyId)
+	}
+	key, owner, err := fetchKey(keyId, keycache)
 	if err != nil {
-		return nil, err
+		refetches.failed(keyId, time.Now())
+		return "", err
+	}
+	if err := verify(key); err != nil {
+		refetches.failed(keyId, time.Now())
+		return "", err
 	}
+	refetches.succeeded(keyId)
+	return owner, nil
+}
 
-	req.Header.Add("Accept", `application/ld+json; profile="https://www.w3.org/ns/activitystreams"`)
-	resp, err := client.Do(req)
+// fetchKey fetches the key with the given id and saves it in keycache.
+func fetchKey(keyId string, keycache KeyStore) (crypto.PublicKey, string, error) {
+	resp, err := Get(keyId, `application/ld+json; profile="https://www.w3.org/ns/activitystreams"`)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer resp.Body.Close()
 	decoder := json.NewDecoder(resp.Body)
 	var actor actorKeyObject
 	if err := decoder.Decode(&actor); err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	if actor.PublicKey.Id != keyId {
-		return nil, fmt.Errorf("Could not retrieve %v, got %v", keyId, actor.PublicKey.Id)
+	pemKey, owner, err := actor.findKey(keyId)
+	if err != nil {
+		return nil, "", err
 	}
-	return ParsePemKey(keyId, actor.PublicKey.Owner, []byte(actor.PublicKey.PublicKeyPem), keycache)
+	key, err := ParsePemKey(keyId, owner, pemKey, keycache)
+	return key, owner, err
 }
 
-// httpsig doesn't like the algorithm header, but we do.
-func getAlgorithm(header string) (httpsig.Algorithm, error) {
-	pieces := strings.Split(header, ",")
-	for _, s := range pieces {
-		if !strings.HasPrefix(s, "algorithm=") {
-			continue
-		}
-		val := strings.Replace(s, "algorithm=", "", 1)
-		val = val[1 : len(val)-1]
-		if val == "hs2019" {
-			fmt.Printf("Warning: hs2019\n")
-			return "rsa-sha256", nil
+// httpsig doesn't like the algorithm parameter, but we do. hs2019 (or no
+// algorithm) means that it's determined by the key.
+func getAlgorithm(algorithm string, key crypto.PublicKey) (httpsig.Algorithm, error) {
+	switch algorithm {
+	case "", "hs2019":
+		switch key.(type) {
+		case *rsa.PublicKey:
+			return httpsig.RSA_SHA256, nil
+		case ed25519.PublicKey:
+			return httpsig.ED25519, nil
 		}
-		return httpsig.Algorithm(val), nil
+		return "", fmt.Errorf("Could not determine algorithm for %T", key)
 	}
-	return "", fmt.Errorf("Could not determine algorithm")
+	return httpsig.Algorithm(algorithm), nil
 }
 
 func ParsePemKey(keyId, owner string, pemKey []byte, keycache KeyStore) (crypto.PublicKey, error) {
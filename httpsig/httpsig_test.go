@@ -0,0 +1,280 @@
+package httpsig
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-fed/httpsig"
+)
+
+type testKeyStore map[string]crypto.PublicKey
+
+func (ks testKeyStore) GetKey(keyid string) (crypto.PublicKey, string, error) {
+	key, ok := ks[keyid]
+	if !ok {
+		return nil, "", errors.New("Not found")
+	}
+	return key, "https://example.com/actor", nil
+}
+
+func (ks testKeyStore) SaveKey(keyid, owner string, pemBytes []byte) error {
+	return nil
+}
+
+func signedPost(t *testing.T, key *rsa.PrivateKey, body []byte, date time.Time, headers []string) *http.Request {
+	req, err := http.NewRequest("POST", "https://example.org/inbox", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Host", "example.org")
+	req.Header.Set("Date", date.UTC().Format(http.TimeFormat))
+	signer, _, err := httpsig.NewSigner([]httpsig.Algorithm{httpsig.RSA_SHA256}, httpsig.DigestSha256, headers, httpsig.Signature, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.SignRequest(key, "https://example.com/actor#main-key", req, body); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestValidate(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := testKeyStore{"https://example.com/actor#main-key": &key.PublicKey}
+	body := []byte(`{"type": "Follow"}`)
+	allHeaders := []string{httpsig.RequestTarget, "date", "digest", "host"}
+
+	req := signedPost(t, key, body, time.Now(), allHeaders)
+	owner, err := Validate(req, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner != "https://example.com/actor" {
+		t.Errorf("Unexpected owner %v", owner)
+	}
+	if _, err := Validate(req, keys); !errors.Is(err, Replayed) {
+		t.Errorf("Expected replayed signature to be rejected, got %v", err)
+	}
+
+	req = signedPost(t, key, body, time.Now(), allHeaders)
+	req.Body = http.NoBody
+	if _, err := Validate(req, keys); !errors.Is(err, DigestMismatch) {
+		t.Errorf("Expected digest mismatch, got %v", err)
+	}
+
+	req = signedPost(t, key, body, time.Now().Add(-time.Hour), allHeaders)
+	if _, err := Validate(req, keys); !errors.Is(err, DateOutOfRange) {
+		t.Errorf("Expected old date to be rejected, got %v", err)
+	}
+
+	req = signedPost(t, key, body, time.Now(), []string{httpsig.RequestTarget, "date", "host"})
+	if _, err := Validate(req, keys); !errors.Is(err, MissingHeader) {
+		t.Errorf("Expected unsigned digest to be rejected, got %v", err)
+	}
+}
+
+func TestCheckDigest(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello"))
+	digest := "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+	if err := checkDigest(digest, []byte("hello")); err != nil {
+		t.Error(err)
+	}
+	if err := checkDigest(digest, []byte("goodbye")); !errors.Is(err, DigestMismatch) {
+		t.Errorf("Expected mismatch, got %v", err)
+	}
+	if err := checkDigest("", []byte("hello")); !errors.Is(err, MissingHeader) {
+		t.Errorf("Expected missing header, got %v", err)
+	}
+}
+
+func TestCheckOwner(t *testing.T) {
+	if err := CheckOwner("https://example.com/actor", "https://example.com/actor"); err != nil {
+		t.Error(err)
+	}
+	if err := CheckOwner("https://example.com/actor", "https://example.com/other"); !errors.Is(err, WrongOwner) {
+		t.Errorf("Expected wrong owner, got %v", err)
+	}
+}
+
+func TestRFC9421(t *testing.T) {
+	rsakey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edpublic, edprivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := testKeyStore{
+		"https://example.com/actor#main-key":    &rsakey.PublicKey,
+		"https://example.com/actor#ed25519-key": edpublic,
+	}
+	body := []byte(`{"type": "Follow"}`)
+	for keyid, key := range map[string]crypto.PrivateKey{
+		"https://example.com/actor#main-key":    rsakey,
+		"https://example.com/actor#ed25519-key": edprivate,
+	} {
+		req, err := http.NewRequest("POST", "https://example.org/inbox", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/activity+json")
+		if err := SignRFC9421(req, body, key, keyid); err != nil {
+			t.Fatal(err)
+		}
+		if owner, err := Validate(req, keys); err != nil || owner != "https://example.com/actor" {
+			t.Errorf("%v: could not validate: %v %v", keyid, owner, err)
+		}
+
+		req.Body = io.NopCloser(bytes.NewReader([]byte(`{"type": "Undo"}`)))
+		if _, err := Validate(req, keys); !errors.Is(err, DigestMismatch) {
+			t.Errorf("%v: expected digest mismatch, got %v", keyid, err)
+		}
+	}
+}
+
+func TestMultikey(t *testing.T) {
+	// From FEP-521a
+	pemKey, err := multikeyToPem("z6MkrJVnaZkeFzdQyMZu1cgjg7k1pZZ6pvBQ7XJPt4swbTQ2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParsePemKey("key", "owner", pemKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := key.(ed25519.PublicKey); !ok {
+		t.Errorf("Expected ed25519 key, got %T", key)
+	}
+	if _, err := multikeyToPem("zQ3shokFTS3brHcDQrn82RUDfCZESWL1ZdCEJwekUDPQiYBme"); err == nil {
+		t.Error("Expected error for secp256k1 key")
+	}
+}
+
+func TestEncodeMultikey(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey, err := multikeyToPem(EncodeMultikey(public))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParsePemKey("key", "owner", pemKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !public.Equal(key) {
+		t.Error("Multikey did not round trip")
+	}
+	// Leading zero bytes are encoded as 1s.
+	if got := encodeBase58([]byte{0, 0, 1}); got != "112" {
+		t.Errorf("Unexpected base58 encoding %v", got)
+	}
+}
+
+func TestFindKeyOwner(t *testing.T) {
+	var actor actorKeyObject
+	actor.PublicKey.Id = "https://example.com/actor#main-key"
+	actor.PublicKey.PublicKeyPem = "key"
+
+	actor.PublicKey.Owner = "https://example.com/actor"
+	if _, owner, err := actor.findKey("https://example.com/actor#main-key"); err != nil || owner != "https://example.com/actor" {
+		t.Errorf("Expected owner https://example.com/actor, got %v %v", owner, err)
+	}
+
+	// A key hosted anywhere could claim to be owned by any actor.
+	actor.PublicKey.Owner = "https://victim.example/actor"
+	if _, _, err := actor.findKey("https://example.com/actor#main-key"); !errors.Is(err, WrongOwner) {
+		t.Errorf("Expected wrong owner for forged owner, got %v", err)
+	}
+	actor.PublicKey.Owner = ""
+	if _, _, err := actor.findKey("https://example.com/actor#main-key"); !errors.Is(err, WrongOwner) {
+		t.Errorf("Expected wrong owner for missing owner, got %v", err)
+	}
+	if _, _, err := actor.findKey("https://example.com/actor#other-key"); err == nil {
+		t.Error("Expected error for unknown key")
+	}
+}
+
+func TestKeyRefetchBackoff(t *testing.T) {
+	refetches := keyRefetches{next: make(map[string]keyRefetch)}
+	keyId := "https://example.com/actor#main-key"
+	now := time.Now()
+	if !refetches.allowed(keyId, now) {
+		t.Error("Expected refetch to be allowed before any failure")
+	}
+	refetches.failed(keyId, now)
+	if refetches.allowed(keyId, now.Add(MinKeyRefetchWait/2)) {
+		t.Error("Expected refetch to be refused right after a failure")
+	}
+	if !refetches.allowed(keyId, now.Add(MinKeyRefetchWait)) {
+		t.Error("Expected refetch to be allowed after waiting")
+	}
+	now = now.Add(MinKeyRefetchWait)
+	refetches.failed(keyId, now)
+	if refetches.allowed(keyId, now.Add(MinKeyRefetchWait)) {
+		t.Error("Expected wait to double after another failure")
+	}
+	for i := 0; i < 20; i++ {
+		refetches.failed(keyId, now)
+	}
+	if !refetches.allowed(keyId, now.Add(MaxKeyRefetchWait)) {
+		t.Error("Expected wait to be capped")
+	}
+	refetches.succeeded(keyId)
+	if !refetches.allowed(keyId, now) {
+		t.Error("Expected refetch to be allowed after success")
+	}
+}
+
+func TestReplayCacheExpiry(t *testing.T) {
+	cache := replayCache{signatures: make(map[string]time.Time)}
+	now := time.Now()
+	if cache.check("a", now) {
+		t.Error("Expected new signature not to have been seen")
+	}
+	if !cache.check("a", now.Add(MaxClockSkew)) {
+		t.Error("Expected signature to have been seen")
+	}
+	later := now.Add(3 * MaxClockSkew)
+	if cache.check("b", later) {
+		t.Error("Expected new signature not to have been seen")
+	}
+	if _, ok := cache.signatures["a"]; ok {
+		t.Error("Expected expired signature to be removed")
+	}
+	if cache.check("a", later) {
+		t.Error("Expected expired signature to be accepted again")
+	}
+}
+
+func TestKeyRefetchLimit(t *testing.T) {
+	refetches := keyRefetches{next: make(map[string]keyRefetch)}
+	now := time.Now()
+	for i := 0; i < 2*maxKeyRefetches; i++ {
+		refetches.failed(fmt.Sprintf("https://example.com/actor%d#main-key", i), now)
+	}
+	if len(refetches.next) > maxKeyRefetches {
+		t.Errorf("Expected at most %d keys to be remembered, got %d", maxKeyRefetches, len(refetches.next))
+	}
+	keyId := "https://example.com/actor#main-key"
+	refetches.failed(keyId, now)
+	if refetches.allowed(keyId, now) {
+		t.Error("Expected the latest failure to be remembered")
+	}
+}
@@ -0,0 +1,101 @@
+package httpsig
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// A Multikey is a key in the format used by FEP-521a, which actors list
+// in their assertionMethod. Only Ed25519 keys are supported.
+type multikey struct {
+	Id                 string `json:"id"`
+	Type               string `json:"type"`
+	Controller         string `json:"controller"`
+	PublicKeyMultibase string `json:"publicKeyMultibase"`
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func decodeBase58(s string) ([]byte, error) {
+	var result []byte
+	for _, c := range s {
+		carry := strings.IndexRune(base58Alphabet, c)
+		if carry < 0 {
+			return nil, fmt.Errorf("Invalid base58 character %q", c)
+		}
+		for i := len(result) - 1; i >= 0; i-- {
+			carry += int(result[i]) * 58
+			result[i] = byte(carry)
+			carry >>= 8
+		}
+		for carry > 0 {
+			result = append([]byte{byte(carry)}, result...)
+			carry >>= 8
+		}
+	}
+	// Leading 1s are leading zero bytes.
+	for _, c := range s {
+		if c != '1' {
+			break
+		}
+		result = append([]byte{0}, result...)
+	}
+	return result, nil
+}
+
+func encodeBase58(b []byte) string {
+	var digits []byte
+	for _, c := range b {
+		carry := int(c)
+		for i := range digits {
+			carry += int(digits[i]) << 8
+			digits[i] = byte(carry % 58)
+			carry /= 58
+		}
+		for carry > 0 {
+			digits = append(digits, byte(carry%58))
+			carry /= 58
+		}
+	}
+	var result strings.Builder
+	// Leading zero bytes are leading 1s.
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		result.WriteByte('1')
+	}
+	for i := len(digits) - 1; i >= 0; i-- {
+		result.WriteByte(base58Alphabet[digits[i]])
+	}
+	return result.String()
+}
+
+// EncodeMultikey returns the publicKeyMultibase of an Ed25519 public key.
+func EncodeMultikey(key ed25519.PublicKey) string {
+	return "z" + encodeBase58(append([]byte{0xed, 0x01}, key...))
+}
+
+// multikeyToPem converts an Ed25519 Multikey to a PEM encoded public key,
+// which is the format keys are cached in.
+func multikeyToPem(multibase string) ([]byte, error) {
+	if !strings.HasPrefix(multibase, "z") {
+		return nil, fmt.Errorf("Unsupported multibase encoding")
+	}
+	decoded, err := decodeBase58(multibase[1:])
+	if err != nil {
+		return nil, err
+	}
+	// The multicodec prefix for an ed25519-pub key is the varint 0xed.
+	if len(decoded) != 2+ed25519.PublicKeySize || decoded[0] != 0xed || decoded[1] != 0x01 {
+		return nil, fmt.Errorf("Unsupported multikey type")
+	}
+	keybytes, err := x509.MarshalPKIXPublicKey(ed25519.PublicKey(decoded[2:]))
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: keybytes}), nil
+}
@@ -0,0 +1,334 @@
+package httpsig
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RFC 9421 HTTP Message Signatures use the Signature-Input header to
+// describe which components of the message were signed, and a Signature
+// header with the signature itself. Only the parts of the RFC which are
+// used by fediverse software are supported.
+
+var UnsupportedSignature error = errors.New("Unsupported signature")
+
+// component returns the value of a covered component of r.
+func component(r *http.Request, name string) (string, error) {
+	switch name {
+	case "@method":
+		return strings.ToUpper(r.Method), nil
+	case "@target-uri":
+		if r.URL.IsAbs() {
+			return r.URL.String(), nil
+		}
+		return "https://" + strings.ToLower(r.Host) + r.URL.RequestURI(), nil
+	case "@authority":
+		if r.Host != "" {
+			return strings.ToLower(r.Host), nil
+		}
+		return strings.ToLower(r.URL.Host), nil
+	case "@scheme":
+		if r.URL.Scheme != "" {
+			return r.URL.Scheme, nil
+		}
+		return "https", nil
+	case "@request-target":
+		return r.URL.RequestURI(), nil
+	case "@path":
+		if path := r.URL.EscapedPath(); path != "" {
+			return path, nil
+		}
+		return "/", nil
+	case "@query":
+		return "?" + r.URL.RawQuery, nil
+	}
+	if strings.HasPrefix(name, "@") {
+		return "", fmt.Errorf("%w: component %v", UnsupportedSignature, name)
+	}
+	values := r.Header.Values(name)
+	if len(values) == 0 && name == "host" {
+		values = []string{r.Host}
+	}
+	if len(values) == 0 {
+		return "", fmt.Errorf("%w: %v", MissingHeader, name)
+	}
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+	return strings.Join(values, ", "), nil
+}
+
+// signatureBase builds the signature base of r for the given covered
+// components and serialized signature parameters.
+func signatureBase(r *http.Request, covered []string, params string) (string, error) {
+	var b strings.Builder
+	for _, name := range covered {
+		val, err := component(r, name)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "\"%s\": %s\n", name, val)
+	}
+	fmt.Fprintf(&b, "\"@signature-params\": %s", params)
+	return b.String(), nil
+}
+
+// splitDictionary splits a structured field dictionary into its members,
+// ignoring commas inside strings and inner lists.
+func splitDictionary(header string) map[string]string {
+	members := make(map[string]string)
+	var quoted bool
+	var depth, start int
+	add := func(member string) {
+		key, val, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if ok {
+			members[key] = val
+		}
+	}
+	for i, c := range header {
+		switch {
+		case c == '"' && (i == 0 || header[i-1] != '\\'):
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			add(header[start:i])
+			start = i + 1
+		}
+	}
+	add(header[start:])
+	return members
+}
+
+// signatureInput is a parsed member of the Signature-Input header.
+type signatureInput struct {
+	Covered []string
+	Params  map[string]string
+	// Raw is the serialization used for @signature-params.
+	Raw string
+}
+
+func parseSignatureInput(raw string) (*signatureInput, error) {
+	raw = strings.TrimSpace(raw)
+	if !strings.HasPrefix(raw, "(") {
+		return nil, fmt.Errorf("%w: bad Signature-Input", UnsupportedSignature)
+	}
+	end := strings.Index(raw, ")")
+	if end < 0 {
+		return nil, fmt.Errorf("%w: bad Signature-Input", UnsupportedSignature)
+	}
+	input := &signatureInput{Raw: raw, Params: make(map[string]string)}
+	for _, item := range strings.Fields(raw[1:end]) {
+		if !strings.HasPrefix(item, `"`) || !strings.HasSuffix(item, `"`) || len(item) < 2 {
+			// Component parameters such as ;sf aren't supported.
+			return nil, fmt.Errorf("%w: component %v", UnsupportedSignature, item)
+		}
+		input.Covered = append(input.Covered, strings.ToLower(item[1:len(item)-1]))
+	}
+	for _, param := range strings.Split(raw[end+1:], ";") {
+		key, val, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if ok {
+			input.Params[key] = strings.Trim(val, `"`)
+		}
+	}
+	return input, nil
+}
+
+func (s signatureInput) covers(name string) bool {
+	for _, c := range s.Covered {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCovered checks that the components which identify the request
+// were signed.
+func (s signatureInput) checkCovered(r *http.Request) error {
+	if !s.covers("@method") {
+		return fmt.Errorf("%w: @method", MissingHeader)
+	}
+	if !s.covers("@target-uri") && !(s.covers("@authority") && (s.covers("@path") || s.covers("@request-target"))) {
+		return fmt.Errorf("%w: @target-uri", MissingHeader)
+	}
+	if r.Method == "POST" && !s.covers("content-digest") {
+		return fmt.Errorf("%w: content-digest", MissingHeader)
+	}
+	return nil
+}
+
+func (s signatureInput) checkCreated(now time.Time) error {
+	created, err := strconv.ParseInt(s.Params["created"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: created", MissingHeader)
+	}
+	if skew := now.Sub(time.Unix(created, 0)); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return fmt.Errorf("%w: created %v", DateOutOfRange, created)
+	}
+	if expires, err := strconv.ParseInt(s.Params["expires"], 10, 64); err == nil && now.Unix() > expires {
+		return fmt.Errorf("%w: expired %v", DateOutOfRange, expires)
+	}
+	return nil
+}
+
+// checkContentDigest checks an RFC 9530 Content-Digest header.
+func checkContentDigest(header string, body []byte) error {
+	if header == "" {
+		return fmt.Errorf("%w: content-digest", MissingHeader)
+	}
+	for algorithm, val := range splitDictionary(header) {
+		val = strings.Trim(val, ":")
+		var expected []byte
+		switch strings.ToLower(algorithm) {
+		case "sha-256":
+			sum := sha256.Sum256(body)
+			expected = sum[:]
+		case "sha-512":
+			sum := sha512.Sum512(body)
+			expected = sum[:]
+		default:
+			continue
+		}
+		if val != base64.StdEncoding.EncodeToString(expected) {
+			return DigestMismatch
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: no supported content-digest", DigestMismatch)
+}
+
+// verifySignature verifies sig over base with key. If alg is empty, it's
+// determined by the type of key.
+func verifySignature(key crypto.PublicKey, alg string, base, sig []byte) error {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg {
+		case "", "rsa-v1_5-sha256":
+			sum := sha256.Sum256(base)
+			return rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig)
+		case "rsa-pss-sha512":
+			sum := sha512.Sum512(base)
+			return rsa.VerifyPSS(k, crypto.SHA512, sum[:], sig, &rsa.PSSOptions{SaltLength: 64})
+		}
+	case ed25519.PublicKey:
+		if alg == "" || alg == "ed25519" {
+			if !ed25519.Verify(k, base, sig) {
+				return fmt.Errorf("Invalid ed25519 signature")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: algorithm %v for key type %T", UnsupportedSignature, alg, key)
+}
+
+// validateRFC9421 validates the signatures of r which are in both the
+// Signature-Input and Signature headers, returning the owner of the key
+// for the first valid one. body is the already read body of r.
+func validateRFC9421(r *http.Request, body []byte, keycache KeyStore) (string, error) {
+	inputs := splitDictionary(r.Header.Get("Signature-Input"))
+	signatures := splitDictionary(r.Header.Get("Signature"))
+	lastErr := fmt.Errorf("%w: signature", MissingHeader)
+	for label, raw := range inputs {
+		encoded, ok := signatures[label]
+		if !ok {
+			continue
+		}
+		owner, err := validateRFC9421Member(r, body, raw, encoded, keycache)
+		if err == nil {
+			return owner, nil
+		}
+		lastErr = err
+	}
+	return "", lastErr
+}
+
+func validateRFC9421Member(r *http.Request, body []byte, raw, encoded string, keycache KeyStore) (string, error) {
+	input, err := parseSignatureInput(raw)
+	if err != nil {
+		return "", err
+	}
+	if err := input.checkCovered(r); err != nil {
+		return "", err
+	}
+	if err := input.checkCreated(time.Now()); err != nil {
+		return "", err
+	}
+	if input.covers("content-digest") {
+		if err := checkContentDigest(r.Header.Get("Content-Digest"), body); err != nil {
+			return "", err
+		}
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.Trim(encoded, ":"))
+	if err != nil {
+		return "", err
+	}
+	base, err := signatureBase(r, input.Covered, input.Raw)
+	if err != nil {
+		return "", err
+	}
+	owner, err := verifyKey(input.Params["keyid"], keycache, func(pubkey crypto.PublicKey) error {
+		return verifySignature(pubkey, input.Params["alg"], []byte(base), sig)
+	})
+	if err != nil {
+		return "", err
+	}
+	if seen.check(encoded, time.Now()) {
+		return "", Replayed
+	}
+	return owner, nil
+}
+
+// SignRFC9421 signs r, which has the given body, with an RFC 9421
+// signature. The request's method, target URI, and (if there's a body)
+// its content type and digest are signed.
+func SignRFC9421(r *http.Request, body []byte, key crypto.PrivateKey, keyid string) error {
+	covered := []string{"@method", "@target-uri"}
+	if body != nil {
+		sum := sha256.Sum256(body)
+		r.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+		covered = append(covered, "content-type", "content-digest")
+	}
+	var alg string
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		alg = "rsa-v1_5-sha256"
+	case ed25519.PrivateKey:
+		alg = "ed25519"
+	default:
+		return fmt.Errorf("%w: key type %T", UnsupportedSignature, key)
+	}
+	params := fmt.Sprintf(`("%s");created=%d;keyid="%s";alg="%s"`, strings.Join(covered, `" "`), time.Now().Unix(), keyid, alg)
+	base, err := signatureBase(r, covered, params)
+	if err != nil {
+		return err
+	}
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256([]byte(base))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(base))
+	}
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Signature-Input", "sig1="+params)
+	r.Header.Set("Signature", "sig1=:"+base64.StdEncoding.EncodeToString(sig)+":")
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"fediwiki/activitypub"
 	"fediwiki/outbox"
@@ -61,21 +62,60 @@ func HandleFollow(pagesdb pages.PagesDatabase, actordb activitypub.ActorDatabase
 	})
 }
 
-func HandleUndo(db activitypub.ActivityDatabase, request activitypub.Undo) error {
-	pagename, err := pages.GetPageNameFromActorId(request.Object.Object)
+// HandleUndo undoes an activity which was previously received from the
+// same actor.
+func HandleUndo(objectDB activitypub.ObjectDatabase, db activitypub.ActivityDatabase, request activitypub.Undo) error {
+	// Use the copy that we received rather than anything embedded in
+	// the Undo, so that the actor can't be spoofed.
+	if !objectDB.HasObject(request.Object.Id) {
+		log.Println("Undo of unknown object", request.Object.Id)
+		return nil
+	}
+	obj, err := objectDB.GetObject(request.Object.Id)
 	if err != nil {
 		return err
 	}
-	if err := db.UndoFollow(pagename, request); err != nil {
+	var original activitypub.BaseProperties
+	if err := json.Unmarshal(obj.RawBytes, &original); err != nil {
 		return err
 	}
-	return nil
+	if request.Actor == "" || original.Actor != request.Actor {
+		return fmt.Errorf("%w: %v can not undo %v", Unauthorized, request.Actor, original.Id)
+	}
+	switch original.Type {
+	case "Follow", "Like", "Announce":
+	case "Create":
+		var c activitypub.CreateNote
+		if err := json.Unmarshal(obj.RawBytes, &c); err != nil {
+			return err
+		}
+		if c.Object.Type != "Note" {
+			return fmt.Errorf("%w: Undo Create %v", Unhandled, c.Object.Type)
+		}
+		note, err := authorizeNote(db, request.Actor, c.Object.Id)
+		if err != nil {
+			return err
+		}
+		if note != nil {
+			if err := db.DeleteNote(note.Id); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%w: Undo %v", Unhandled, original.Type)
+	}
+	return db.UndoActivity(original, request)
 }
 
 func HandleCreateNote(db activitypub.ActivityDatabase, incoming activitypub.CreateNote) error {
 	if incoming.Type != "Create" || incoming.Object.Type != "Note" {
 		return fmt.Errorf("Bad create note")
 	}
+	// Updates and Deletes of the note are authorized by its author, so
+	// the sender can't attribute it to anyone else.
+	if incoming.Actor == "" || incoming.Object.AttributedTo != incoming.Actor {
+		return fmt.Errorf("%w: %v can not create a note attributed to %v", Unauthorized, incoming.Actor, incoming.Object.AttributedTo)
+	}
 
 	for _, to := range incoming.Object.To {
 		pname, err := pages.GetPageNameFromActorId(to)
@@ -93,14 +133,296 @@ func HandleCreateNote(db activitypub.ActivityDatabase, incoming activitypub.Crea
 			}
 		}
 	}
+	// Replies to a page, one of its revisions or a note posted from its
+	// talk page belong to that page's discussion even if the page isn't
+	// addressed.
+	if incoming.Object.InReplyTo != nil {
+		pname, _, err := pages.GetPageNameFromObjectId(*incoming.Object.InReplyTo)
+		if err != nil {
+			pname, err = pages.GetPageNameFromNoteId(*incoming.Object.InReplyTo)
+		}
+		if err == nil {
+			if err := db.AddPageNote(pname, incoming.Object); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
-func Process(objectDB activitypub.ObjectDatabase, pagesdb pages.PagesDatabase, actorDb activitypub.ActorDatabase, activityDb activitypub.ActivityDatabase, incoming activitypub.Object) error {
-	if objectDB != nil {
-		if err := objectDB.SaveObject(incoming); err != nil {
+// authorizeNote checks that actor is the author of the stored note with
+// the given id. It returns the stored note, or nil if we don't have a
+// copy of it or it's already been deleted.
+func authorizeNote(db activitypub.ActivityDatabase, actor, id string) (*activitypub.Note, error) {
+	note, err := db.GetNote(id)
+	if err != nil {
+		// It was never added to a talk page, so there's nothing to
+		// do.
+		log.Println(id, err)
+		return nil, nil
+	}
+	if note.Type == "Tombstone" {
+		// Don't resurrect deleted notes.
+		return nil, nil
+	}
+	if actor == "" || note.AttributedTo != actor {
+		return nil, fmt.Errorf("%w: %v is not the author of %v", Unauthorized, actor, id)
+	}
+	return note, nil
+}
+
+func HandleUpdateNote(db activitypub.ActivityDatabase, incoming activitypub.UpdateNote) error {
+	if incoming.Type != "Update" || incoming.Object.Type != "Note" {
+		return fmt.Errorf("Bad update note")
+	}
+	note, err := authorizeNote(db, incoming.Actor, incoming.Object.Id)
+	if note == nil || err != nil {
+		return err
+	}
+	if incoming.Object.AttributedTo != note.AttributedTo {
+		return fmt.Errorf("%w: can not change author of %v", Unauthorized, note.Id)
+	}
+	return db.UpdateNote(incoming.Object)
+}
+
+func HandleDelete(db activitypub.ActivityDatabase, incoming activitypub.Delete) error {
+	note, err := authorizeNote(db, incoming.Actor, incoming.Object.Id)
+	if note == nil || err != nil {
+		return err
+	}
+	return db.DeleteNote(note.Id)
+}
+
+// HandleReaction records a Like or Announce of a page's Article or one
+// of its revisions' diff notes.
+func HandleReaction(db activitypub.ActivityDatabase, activity activitypub.BaseProperties, object activitypub.ObjectReference) error {
+	if _, _, err := pages.GetPageNameFromObjectId(object.Id); err != nil {
+		return fmt.Errorf("%w: %v of %v", Unhandled, activity.Type, object.Id)
+	}
+	if activity.Actor == "" {
+		return fmt.Errorf("Bad %v", activity.Type)
+	}
+	return db.AddReaction(object.Id, activity)
+}
+
+// HandleUpstreamChange proposes merging the current version of an
+// upstream page into each local page forked from it, after the upstream
+// page actor announces that it was edited. Nothing happens if the actor
+// isn't the upstream of any page. Versions which have already been seen,
+// and versions which are the same as the local page, aren't proposed.
+func HandleUpstreamChange(pagesdb pages.PagesDatabase, pagedb pages.Persister, actor, activityid string) error {
+	downstream, err := pagesdb.GetDownstreamPages(actor)
+	if err != nil {
+		return err
+	}
+	var failed int
+	var firsterr error
+	for _, pagename := range downstream {
+		if err := proposeUpstreamChange(pagesdb, pagedb, pagename, actor, activityid); err != nil {
+			log.Printf("Could not propose upstream change to %v: %v\n", pagename, err)
+			failed++
+			if firsterr == nil {
+				firsterr = err
+			}
+		}
+	}
+	if firsterr != nil {
+		return fmt.Errorf("%d of %d downstream pages failed: %w", failed, len(downstream), firsterr)
+	}
+	return nil
+}
+
+// proposeUpstreamChange proposes the current version of the page's
+// upstream as a change to the page, unless it's already been seen.
+func proposeUpstreamChange(pagesdb pages.PagesDatabase, pagedb pages.Persister, pagename, actor, activityid string) error {
+	_, articleurl, err := pagesdb.GetUpstream(pagename)
+	if err != nil {
+		return err
+	}
+	article, err := outbox.FetchArticle(articleurl)
+	if err != nil {
+		return err
+	}
+	if article.AttributedTo != actor {
+		return fmt.Errorf("%w: %v is not attributed to %v", Unauthorized, articleurl, actor)
+	}
+	page := pages.PageFromArticle(pagename, *article)
+	version := page.Version()
+	if seen, err := pagesdb.GetUpstreamVersion(pagename); err != nil || seen == version {
+		return err
+	}
+	if current, err := pagedb.GetPage(pagename); err == nil && current.Version() == version {
+		return pagesdb.SetUpstreamVersion(pagename, version)
+	}
+	if _, err := pagesdb.AddProposal(pages.Proposal{
+		PageName: pagename,
+		Actor:    actor,
+		Activity: activityid,
+		Origin:   article.Id,
+		Summary:  "Changes from " + article.Id,
+		Page:     page,
+	}); err != nil {
+		return err
+	}
+	return pagesdb.SetUpstreamVersion(pagename, version)
+}
+
+// isRevisionNote returns true if the note is the diff note which a
+// fediwiki page actor sends when its page is edited, rather than a note
+// posted to its talk page.
+func isRevisionNote(actor string, note activitypub.Note) bool {
+	return strings.HasPrefix(note.Id, strings.TrimSuffix(actor, "/actor")+"/history/")
+}
+
+// offerTarget returns the local page which an Offer targets, given either
+// the page's actor or its Article.
+func offerTarget(target string) (string, error) {
+	if pagename, err := pages.GetPageNameFromActorId(target); err == nil {
+		return pagename, nil
+	}
+	pagename, revision, err := pages.GetPageNameFromObjectId(target)
+	if err != nil || revision != "" {
+		return "", fmt.Errorf("%w: Offer to %v", Unhandled, target)
+	}
+	return pagename, nil
+}
+
+// HandleOffer saves an Offer of a change to a page as a proposal, which
+// is answered when an editor merges or rejects it.
+func HandleOffer(pagesdb pages.PagesDatabase, pagedb pages.Persister, incoming activitypub.Offer) error {
+	if !activitypub.ValidId(incoming.Actor) {
+		return fmt.Errorf("%w: Offer from invalid actor %q", Unhandled, incoming.Actor)
+	}
+	pagename, err := offerTarget(incoming.Target.Id)
+	if err != nil {
+		return err
+	}
+	current, err := pagedb.GetPage(pagename)
+	if err != nil {
+		return fmt.Errorf("%w: Offer to unknown page %v", Unhandled, pagename)
+	}
+	var object activitypub.ObjectReference
+	if err := json.Unmarshal(incoming.Object, &object); err != nil {
+		return err
+	}
+
+	proposal := pages.Proposal{
+		PageName: pagename,
+		Actor:    incoming.Actor,
+		Activity: incoming.Id,
+		Summary:  incoming.Summary,
+		Offer:    true,
+	}
+	if revs, err := pagedb.GetPageRevisions(pagename); err == nil && len(revs) > 0 {
+		proposal.Parent = revs[len(revs)-1].RevisionID
+	}
+	switch object.Type {
+	case "Article":
+		var article activitypub.Article
+		if err := json.Unmarshal(incoming.Object, &article); err != nil {
 			return err
 		}
+		if article.AttributedTo != "" && article.AttributedTo != incoming.Actor {
+			return fmt.Errorf("%w: %v can not offer an Article by %v", Unauthorized, incoming.Actor, article.AttributedTo)
+		}
+		proposal.Page = pages.PageFromArticle(pagename, article)
+		if proposal.Page.Title == "" {
+			proposal.Page.Title = current.Title
+		}
+		if proposal.Summary == "" {
+			proposal.Summary = article.Summary
+		}
+	case "Patch":
+		var patch activitypub.Patch
+		if err := json.Unmarshal(incoming.Object, &patch); err != nil {
+			return err
+		}
+		if patch.AttributedTo != "" && patch.AttributedTo != incoming.Actor {
+			return fmt.Errorf("%w: %v can not offer a Patch by %v", Unauthorized, incoming.Actor, patch.AttributedTo)
+		}
+		if proposal.Page, err = current.ApplyPatch(patch.Content); err != nil {
+			return fmt.Errorf("%w: %v", Unhandled, err)
+		}
+		if proposal.Summary == "" {
+			proposal.Summary = patch.Summary
+		}
+	default:
+		return fmt.Errorf("%w: Offer of %v", Unhandled, object.Type)
+	}
+	if proposal.Summary == "" {
+		proposal.Summary = "Proposed by " + incoming.Actor
+	}
+	_, err = pagesdb.AddProposal(proposal)
+	return err
+}
+
+// HandleFlag adds a report from a remote moderator to the moderation
+// queue.
+func HandleFlag(db activitypub.ActivityDatabase, incoming activitypub.Flag) error {
+	if incoming.Actor == "" || len(incoming.Object) == 0 {
+		return fmt.Errorf("Bad Flag")
+	}
+	return db.AddReport(incoming)
+}
+
+// HandleUpdateActor replaces the cached copy of an actor which has
+// updated its own profile.
+func HandleUpdateActor(actorDb activitypub.ActorDatabase, incoming activitypub.Update) error {
+	var actor activitypub.Actor
+	if err := json.Unmarshal(incoming.Object, &actor); err != nil {
+		return err
+	}
+	if incoming.Actor == "" || actor.Id != incoming.Actor {
+		return fmt.Errorf("%w: %v can not update %v", Unauthorized, incoming.Actor, actor.Id)
+	}
+	return actorDb.StoreActor(actor, incoming.Object)
+}
+
+// HandleDeleteActor removes an actor which has deleted itself from the
+// followers of every page.
+func HandleDeleteActor(actorDb activitypub.ActorDatabase, db activitypub.ActivityDatabase, incoming activitypub.Delete) error {
+	if incoming.Actor == "" || incoming.Object.Id != incoming.Actor {
+		return fmt.Errorf("%w: %v can not delete %v", Unauthorized, incoming.Actor, incoming.Object.Id)
+	}
+	if err := db.RemoveFollower(incoming.Actor, incoming.BaseProperties); err != nil {
+		return err
+	}
+	return actorDb.RemoveActor(incoming.Actor)
+}
+
+// HandleMove transfers the follows of an actor which has moved to its
+// new account. The new account must list the old one in alsoKnownAs.
+func HandleMove(actorDb activitypub.ActorDatabase, db activitypub.ActivityDatabase, incoming activitypub.Move) error {
+	if incoming.Actor == "" || incoming.Object != incoming.Actor {
+		return fmt.Errorf("%w: %v can not move %v", Unauthorized, incoming.Actor, incoming.Object)
+	}
+	target, err := outbox.FetchActor(actorDb, incoming.Target)
+	if err != nil {
+		return err
+	}
+	var aliased bool
+	for _, aka := range target.AlsoKnownAs {
+		if aka == incoming.Actor {
+			aliased = true
+		}
+	}
+	if !aliased {
+		return fmt.Errorf("%w: %v is not also known as %v", Unauthorized, target.Id, incoming.Actor)
+	}
+	return db.MoveFollower(incoming.Actor, target.Id, incoming.BaseProperties)
+}
+
+// Process handles an inbound activity. The activity must already have
+// been saved to objectDB by the caller, so that it can be retried if
+// processing fails.
+func Process(objectDB activitypub.ObjectDatabase, pagesdb pages.PagesDatabase, pagedb pages.Persister, actorDb activitypub.ActorDatabase, activityDb activitypub.ActivityDatabase, incoming activitypub.Object) error {
+	// The sender may have been blocked while the activity was queued.
+	var base activitypub.BaseProperties
+	if err := json.Unmarshal(incoming.RawBytes, &base); err != nil {
+		return err
+	}
+	if activityDb.IsBlocked(base.Actor) {
+		return fmt.Errorf("%w: %v is blocked", Unauthorized, base.Actor)
 	}
 	switch incoming.Type {
 	case "Follow":
@@ -116,7 +438,7 @@ func Process(objectDB activitypub.ObjectDatabase, pagesdb pages.PagesDatabase, a
 		if err := json.Unmarshal(incoming.RawBytes, &u); err != nil {
 			return err
 		}
-		if err := HandleUndo(activityDb, u); err != nil {
+		if err := HandleUndo(objectDB, activityDb, u); err != nil {
 			return err
 		}
 	case "Create":
@@ -125,13 +447,102 @@ func Process(objectDB activitypub.ObjectDatabase, pagesdb pages.PagesDatabase, a
 			return err
 		}
 		if c.Object.Type != "Note" {
-			return fmt.Errorf("Unhandled create type %v", c.Object.Type)
+			return fmt.Errorf("%w: Create %v", Unhandled, c.Object.Type)
 		}
 		if err := HandleCreateNote(activityDb, c); err != nil {
 			return err
 		}
+		if isRevisionNote(c.Actor, c.Object) {
+			if err := HandleUpstreamChange(pagesdb, pagedb, c.Actor, c.Id); err != nil {
+				return err
+			}
+		}
+	case "Like":
+		var l activitypub.Like
+		if err := json.Unmarshal(incoming.RawBytes, &l); err != nil {
+			return err
+		}
+		if err := HandleReaction(activityDb, l.BaseProperties, l.Object); err != nil {
+			return err
+		}
+	case "Announce":
+		var a activitypub.Announce
+		if err := json.Unmarshal(incoming.RawBytes, &a); err != nil {
+			return err
+		}
+		if err := HandleReaction(activityDb, a.BaseProperties, a.Object); err != nil {
+			return err
+		}
+	case "Update":
+		var u activitypub.Update
+		if err := json.Unmarshal(incoming.RawBytes, &u); err != nil {
+			return err
+		}
+		var object activitypub.ObjectReference
+		if err := json.Unmarshal(u.Object, &object); err != nil {
+			return err
+		}
+		switch object.Type {
+		case "Note":
+			var un activitypub.UpdateNote
+			if err := json.Unmarshal(incoming.RawBytes, &un); err != nil {
+				return err
+			}
+			if err := HandleUpdateNote(activityDb, un); err != nil {
+				return err
+			}
+		case "Person", "Service", "Application", "Group", "Organization":
+			if err := HandleUpdateActor(actorDb, u); err != nil {
+				return err
+			}
+		case "Article":
+			if err := HandleUpstreamChange(pagesdb, pagedb, u.Actor, u.Id); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: Update %v", Unhandled, object.Type)
+		}
+	case "Delete":
+		var d activitypub.Delete
+		if err := json.Unmarshal(incoming.RawBytes, &d); err != nil {
+			return err
+		}
+		if d.Object.Id == d.Actor {
+			if err := HandleDeleteActor(actorDb, activityDb, d); err != nil {
+				return err
+			}
+		} else if err := HandleDelete(activityDb, d); err != nil {
+			return err
+		}
+	case "Move":
+		var m activitypub.Move
+		if err := json.Unmarshal(incoming.RawBytes, &m); err != nil {
+			return err
+		}
+		if err := HandleMove(actorDb, activityDb, m); err != nil {
+			return err
+		}
+	case "Offer":
+		var o activitypub.Offer
+		if err := json.Unmarshal(incoming.RawBytes, &o); err != nil {
+			return err
+		}
+		if err := HandleOffer(pagesdb, pagedb, o); err != nil {
+			return err
+		}
+	case "Accept":
+		// Accepts of the Follows sent by forked pages to their
+		// upstream need no action.
+	case "Flag":
+		var f activitypub.Flag
+		if err := json.Unmarshal(incoming.RawBytes, &f); err != nil {
+			return err
+		}
+		if err := HandleFlag(activityDb, f); err != nil {
+			return err
+		}
 	default:
-		return fmt.Errorf("Unhandled object type %v", incoming.Type)
+		return fmt.Errorf("%w: %v", Unhandled, incoming.Type)
 	}
 	return nil
 }
@@ -0,0 +1,355 @@
+package inbox
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"fediwiki/activitypub"
+	"fediwiki/filesystemdb"
+	"fediwiki/httpsig"
+	"fediwiki/pages"
+)
+
+const (
+	author = "https://example.org/users/author"
+	other  = "https://example.net/users/other"
+	noteId = "https://example.org/notes/1"
+)
+
+func newTestDB(t *testing.T) *filesystemdb.FileSystemDB {
+	t.Setenv("fediwikidomain", "wiki.example")
+	tmpdir, err := os.MkdirTemp("", "inbox")
+	if err != nil {
+		t.Fatal("Could not create temp dir for test")
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpdir) })
+	return &filesystemdb.FileSystemDB{FSRoot: tmpdir}
+}
+
+func testNote(attributedTo string) activitypub.Note {
+	return activitypub.Note{
+		BaseProperties: activitypub.BaseProperties{Id: noteId, Type: "Note"},
+		To:             []string{"https://wiki.example/pages/Foo/actor"},
+		AttributedTo:   attributedTo,
+		Content:        "Hello",
+	}
+}
+
+func createTestNote(t *testing.T, db *filesystemdb.FileSystemDB) {
+	create := activitypub.CreateNote{
+		BaseProperties: activitypub.BaseProperties{Id: noteId + "#create", Type: "Create", Actor: author},
+		Object:         testNote(author),
+	}
+	if err := HandleCreateNote(db, create); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleCreateNote(t *testing.T) {
+	tests := []struct {
+		Actor        string
+		AttributedTo string
+		Unauthorized bool
+	}{
+		{author, author, false},
+		{other, author, true},
+		{"", "", true},
+	}
+	for i, tc := range tests {
+		db := newTestDB(t)
+		create := activitypub.CreateNote{
+			BaseProperties: activitypub.BaseProperties{Id: noteId + "#create", Type: "Create", Actor: tc.Actor},
+			Object:         testNote(tc.AttributedTo),
+		}
+		err := HandleCreateNote(db, create)
+		if tc.Unauthorized {
+			if !errors.Is(err, Unauthorized) {
+				t.Errorf("case %d: expected unauthorized, got %v", i, err)
+			}
+			if _, err := db.GetNote(noteId); err == nil {
+				t.Errorf("case %d: unauthorized note was added", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d: %v", i, err)
+		}
+		if _, err := db.GetNote(noteId); err != nil {
+			t.Errorf("case %d: note was not added: %v", i, err)
+		}
+	}
+}
+
+func TestHandleUpdateNote(t *testing.T) {
+	tests := []struct {
+		Actor        string
+		AttributedTo string
+		Unauthorized bool
+	}{
+		{author, author, false},
+		{other, author, true},
+		{other, other, true},
+		{author, other, true},
+	}
+	for i, tc := range tests {
+		db := newTestDB(t)
+		createTestNote(t, db)
+		update := activitypub.UpdateNote{
+			BaseProperties: activitypub.BaseProperties{Id: noteId + "#update", Type: "Update", Actor: tc.Actor},
+			Object:         testNote(tc.AttributedTo),
+		}
+		update.Object.Content = "Updated"
+		err := HandleUpdateNote(db, update)
+		note, dberr := db.GetNote(noteId)
+		if dberr != nil {
+			t.Fatal(dberr)
+		}
+		if tc.Unauthorized {
+			if !errors.Is(err, Unauthorized) {
+				t.Errorf("case %d: expected unauthorized, got %v", i, err)
+			}
+			if note.Content != "Hello" {
+				t.Errorf("case %d: unauthorized update changed content to %v", i, note.Content)
+			}
+			continue
+		}
+		if err != nil || note.Content != "Updated" {
+			t.Errorf("case %d: update failed: %v %v", i, note.Content, err)
+		}
+	}
+}
+
+func TestHandleDelete(t *testing.T) {
+	tests := []struct {
+		Actor        string
+		Unauthorized bool
+	}{
+		{author, false},
+		{other, true},
+		{"", true},
+	}
+	for i, tc := range tests {
+		db := newTestDB(t)
+		createTestNote(t, db)
+		del := activitypub.Delete{
+			BaseProperties: activitypub.BaseProperties{Id: noteId + "#delete", Type: "Delete", Actor: tc.Actor},
+			Object:         activitypub.ObjectReference{Id: noteId},
+		}
+		err := HandleDelete(db, del)
+		note, dberr := db.GetNote(noteId)
+		if dberr != nil {
+			t.Fatal(dberr)
+		}
+		if tc.Unauthorized {
+			if !errors.Is(err, Unauthorized) {
+				t.Errorf("case %d: expected unauthorized, got %v", i, err)
+			}
+			if note.Type != "Note" {
+				t.Errorf("case %d: unauthorized delete replaced note with %v", i, note.Type)
+			}
+			continue
+		}
+		if err != nil || note.Type != "Tombstone" {
+			t.Errorf("case %d: delete failed: %v %v", i, note.Type, err)
+		}
+	}
+}
+
+func TestHandleUndo(t *testing.T) {
+	tests := []struct {
+		Actor        string
+		Unauthorized bool
+	}{
+		{author, false},
+		{other, true},
+		{"", true},
+	}
+	for i, tc := range tests {
+		db := newTestDB(t)
+		like := activitypub.Like{
+			BaseProperties: activitypub.BaseProperties{Id: "https://example.org/likes/1", Type: "Like", Actor: author},
+			Object:         activitypub.ObjectReference{Id: "https://wiki.example/pages/Foo"},
+		}
+		raw, err := json.Marshal(like)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SaveObject(activitypub.Object{Id: like.Id, Type: like.Type, RawBytes: raw}); err != nil {
+			t.Fatal(err)
+		}
+		if err := HandleReaction(db, like.BaseProperties, like.Object); err != nil {
+			t.Fatal(err)
+		}
+		undo := activitypub.Undo{
+			BaseProperties: activitypub.BaseProperties{Id: like.Id + "#undo", Type: "Undo", Actor: tc.Actor},
+			// The embedded copy claims to be from the sender, which
+			// must not be trusted.
+			Object: activitypub.ObjectReference{Id: like.Id, Type: "Like"},
+		}
+		err = HandleUndo(db, db, undo)
+		likes, dberr := db.GetReactions(like.Object.Id, "Like")
+		if dberr != nil {
+			t.Fatal(dberr)
+		}
+		if tc.Unauthorized {
+			if !errors.Is(err, Unauthorized) {
+				t.Errorf("case %d: expected unauthorized, got %v", i, err)
+			}
+			if len(likes) != 1 {
+				t.Errorf("case %d: unauthorized undo removed like", i)
+			}
+			continue
+		}
+		if err != nil || len(likes) != 0 {
+			t.Errorf("case %d: undo failed: %v %v", i, likes, err)
+		}
+	}
+}
+
+func TestHandleUndoMissing(t *testing.T) {
+	db := newTestDB(t)
+	undo := activitypub.Undo{
+		BaseProperties: activitypub.BaseProperties{Id: "https://example.org/likes/1#undo", Type: "Undo", Actor: author},
+		Object:         activitypub.ObjectReference{Id: "https://example.org/likes/1", Type: "Like"},
+	}
+	// Nothing to undo if we never received it.
+	if err := HandleUndo(db, db, undo); err != nil {
+		t.Errorf("Expected undo of unknown object to be ignored, got %v", err)
+	}
+	// But a stored copy which can't be read should be retried.
+	if err := db.SaveObject(activitypub.Object{Id: undo.Object.Id, Type: "Like", RawBytes: []byte("{")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := HandleUndo(db, db, undo); err == nil {
+		t.Error("Expected error for unparseable object")
+	}
+}
+
+func TestHandleMove(t *testing.T) {
+	var newActor activitypub.Actor
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(newActor)
+	}))
+	defer server.Close()
+	defaultClient := httpsig.Client
+	httpsig.Client = server.Client()
+	defer func() { httpsig.Client = defaultClient }()
+
+	tests := []struct {
+		Actor        string
+		Object       string
+		AlsoKnownAs  []string
+		Unauthorized bool
+	}{
+		{author, author, []string{author}, false},
+		{other, author, []string{author}, true},
+		{author, author, nil, true},
+		{author, author, []string{other}, true},
+	}
+	for i, tc := range tests {
+		db := newTestDB(t)
+		newActor = activitypub.Actor{Id: server.URL + "/users/new", Type: "Person", AlsoKnownAs: tc.AlsoKnownAs}
+		move := activitypub.Move{
+			BaseProperties: activitypub.BaseProperties{Id: author + "#move", Type: "Move", Actor: tc.Actor},
+			Object:         tc.Object,
+			Target:         newActor.Id,
+		}
+		err := HandleMove(db, db, move)
+		if tc.Unauthorized {
+			if !errors.Is(err, Unauthorized) {
+				t.Errorf("case %d: expected unauthorized, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d: %v", i, err)
+		}
+	}
+}
+
+func TestHandleUpstreamChange(t *testing.T) {
+	var article activitypub.Article
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(article)
+	}))
+	defer server.Close()
+	defaultClient := httpsig.Client
+	httpsig.Client = server.Client()
+	defer func() { httpsig.Client = defaultClient }()
+
+	db := newTestDB(t)
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := pages.Page{PageName: "Foo", Title: "Foo", Content: "content"}
+	actor, err := db.NewPageActor(page, "wiki.example", key, &key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SavePageRevision(page, *actor, pages.Revision{Editor: "fork"}); err != nil {
+		t.Fatal(err)
+	}
+	upstream := server.URL + "/pages/Foo/actor"
+	if err := db.SetUpstream("Foo", upstream, server.URL+"/pages/Foo"); err != nil {
+		t.Fatal(err)
+	}
+	article = activitypub.Article{
+		BaseProperties: activitypub.BaseProperties{Id: server.URL + "/pages/Foo", Type: "Article"},
+		Name:           "Foo",
+		Source:         &activitypub.Source{Content: "content", MediaType: "text/markdown"},
+		AttributedTo:   upstream,
+	}
+
+	tests := []struct {
+		Name      string
+		Content   string
+		Reject    bool
+		Proposals int
+	}{
+		{"same as local page", "content", false, 0},
+		{"changed", "new content", false, 1},
+		{"already proposed", "new content", false, 1},
+		{"already rejected", "new content", true, 1},
+		{"changed again", "newer content", false, 2},
+	}
+	for _, tc := range tests {
+		article.Source.Content = tc.Content
+		if tc.Reject {
+			proposals, err := db.GetProposals("Foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range proposals {
+				if err := db.SetProposalStatus("Foo", p.Id, pages.ProposalRejected); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := HandleUpstreamChange(db, db, upstream, upstream+"#create"); err != nil {
+			t.Errorf("%v: %v", tc.Name, err)
+		}
+		if proposals, err := db.GetProposals("Foo"); err != nil || len(proposals) != tc.Proposals {
+			t.Errorf("%v: expected %d proposals, got %v %v", tc.Name, tc.Proposals, len(proposals), err)
+		}
+	}
+
+	article.AttributedTo = server.URL + "/pages/Other/actor"
+	article.Source.Content = "forged content"
+	if err := HandleUpstreamChange(db, db, upstream, upstream+"#create"); !errors.Is(err, Unauthorized) {
+		t.Errorf("Expected unauthorized for article attributed to someone else, got %v", err)
+	}
+
+	if isRevisionNote(upstream, activitypub.Note{BaseProperties: activitypub.BaseProperties{Id: server.URL + "/pages/Foo/talk/1"}}) {
+		t.Error("Talk page note treated as a revision")
+	}
+	if !isRevisionNote(upstream, activitypub.Note{BaseProperties: activitypub.BaseProperties{Id: server.URL + "/pages/Foo/history/1/diff"}}) {
+		t.Error("Diff note not treated as a revision")
+	}
+}
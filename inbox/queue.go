@@ -0,0 +1,151 @@
+package inbox
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"fediwiki/activitypub"
+)
+
+// The number of times processing an activity is attempted before giving
+// up on it until it's replayed manually.
+const MaxAttempts = 8
+
+// The delay before the first retry of an activity which couldn't be
+// processed. The delay doubles after each failed attempt.
+var RetryDelay = time.Minute
+
+// Unhandled is returned by Process for activities which it doesn't
+// understand. Retrying them won't help, so they aren't retried.
+var Unhandled error = errors.New("Unhandled activity")
+
+// Unauthorized is returned by Process for activities which the sender
+// isn't allowed to perform, such as deleting someone else's note. They
+// aren't retried either.
+var Unauthorized error = errors.New("Unauthorized activity")
+
+// permanent returns true if err means that retrying the activity won't
+// help.
+func permanent(err error) bool {
+	return errors.Is(err, Unhandled) || errors.Is(err, Unauthorized)
+}
+
+// A Queue processes inbound activities which have been saved to the
+// ObjectDatabase and queued in the ActivityDatabase, so that the inbox
+// can respond as soon as an activity is received and activities which
+// fail (for instance, because the sender's server is down when we try
+// to send an Accept) are retried later.
+type Queue struct {
+	db      activitypub.ActivityDatabase
+	process func(activitypub.Object) error
+	workers int
+	work    chan activitypub.Object
+}
+
+// NewQueue creates a queue which calls process for each activity using
+// the given number of background workers. If workers is 0, activities
+// are processed synchronously when they're pushed and failures are only
+// retried by Resume or Replay, which is useful when running as a CGI
+// script where there's no background to process them in.
+func NewQueue(db activitypub.ActivityDatabase, process func(activitypub.Object) error, workers int) *Queue {
+	q := &Queue{
+		db:      db,
+		process: process,
+		workers: workers,
+		work:    make(chan activitypub.Object),
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for obj := range q.work {
+				q.handle(obj)
+			}
+		}()
+	}
+	return q
+}
+
+// handle processes obj and records the result, scheduling a retry if
+// it failed.
+func (q *Queue) handle(obj activitypub.Object) {
+	err := q.process(obj)
+	if err == nil || permanent(err) {
+		if err != nil {
+			log.Println(obj.Id, err)
+		}
+		if err := q.db.MarkProcessed(obj.Id); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	log.Printf("Could not process %s: %v\n", obj.Id, err)
+	attempts, err := q.db.MarkFailed(obj.Id, err)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if attempts >= MaxAttempts {
+		log.Printf("Giving up on %s after %d attempts\n", obj.Id, attempts)
+		return
+	}
+	if q.workers == 0 {
+		return
+	}
+	delay := RetryDelay << (attempts - 1)
+	time.AfterFunc(delay, func() {
+		q.work <- obj
+	})
+}
+
+// Push processes obj, which must already have been queued in the
+// ActivityDatabase.
+func (q *Queue) Push(obj activitypub.Object) {
+	if q.workers == 0 {
+		q.handle(obj)
+		return
+	}
+	go func() {
+		q.work <- obj
+	}()
+}
+
+// Resume pushes every queued activity which hasn't been processed and
+// hasn't failed MaxAttempts times. It should be called on startup so
+// that activities which were received before a restart aren't lost.
+func (q *Queue) Resume() error {
+	objs, err := q.db.UnprocessedObjects(MaxAttempts)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		q.Push(obj)
+	}
+	return nil
+}
+
+// Replay synchronously processes every unprocessed activity, including
+// ones which have been given up on, and returns the number which were
+// processed successfully and the number which failed.
+func Replay(db activitypub.ActivityDatabase, process func(activitypub.Object) error) (int, int, error) {
+	objs, err := db.UnprocessedObjects(0)
+	if err != nil {
+		return 0, 0, err
+	}
+	var succeeded, failed int
+	for _, obj := range objs {
+		err := process(obj)
+		if err == nil || permanent(err) {
+			if err := db.MarkProcessed(obj.Id); err != nil {
+				return succeeded, failed, err
+			}
+			succeeded++
+			continue
+		}
+		log.Printf("Could not process %s: %v\n", obj.Id, err)
+		if _, err := db.MarkFailed(obj.Id, err); err != nil {
+			return succeeded, failed, err
+		}
+		failed++
+	}
+	return succeeded, failed, nil
+}
@@ -0,0 +1,140 @@
+// Package mediawiki imports pages from MediaWiki XML dumps, such as the
+// ones created by Special:Export or dumpBackup.php.
+package mediawiki
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"fediwiki/activitypub"
+	"fediwiki/pages"
+)
+
+type Contributor struct {
+	Username string `xml:"username"`
+	IP       string `xml:"ip"`
+}
+
+type Revision struct {
+	Id          string      `xml:"id"`
+	Timestamp   time.Time   `xml:"timestamp"`
+	Contributor Contributor `xml:"contributor"`
+	Comment     string      `xml:"comment"`
+	Text        string      `xml:"text"`
+}
+
+type Page struct {
+	Title     string `xml:"title"`
+	Namespace int    `xml:"ns"`
+	Redirect  *struct {
+		Title string `xml:"title,attr"`
+	} `xml:"redirect"`
+	Revisions []Revision `xml:"revision"`
+}
+
+// Editor returns the name to record as the editor of the revision.
+func (r Revision) Editor() string {
+	if r.Contributor.Username != "" {
+		return r.Contributor.Username
+	}
+	if r.Contributor.IP != "" {
+		return r.Contributor.IP
+	}
+	return "unknown"
+}
+
+// PageName converts a MediaWiki title to the name of a page in the wiki.
+// MediaWiki uses underscores for spaces in URLs, and subpages can't be
+// represented since a page name is a single path component.
+func PageName(title string) string {
+	title = strings.TrimSpace(title)
+	title = strings.Replace(title, " ", "_", -1)
+	title = strings.Replace(title, "/", "_", -1)
+	if title == "" {
+		return ""
+	}
+	// MediaWiki titles always start with a capital letter.
+	first, size := utf8.DecodeRuneInString(title)
+	return string(unicode.ToUpper(first)) + title[size:]
+}
+
+// ReadDump calls fn for each page in the dump read from r.
+func ReadDump(r io.Reader, fn func(Page) error) error {
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "page" {
+			continue
+		}
+		var page Page
+		if err := decoder.DecodeElement(&page, &start); err != nil {
+			return err
+		}
+		if err := fn(page); err != nil {
+			return err
+		}
+	}
+}
+
+// Import replays every revision of each page in the main namespace of
+// the dump read from r into db with its original author and timestamp.
+// actorFor is called before the first revision of each page is saved to
+// get (or create) the page's actor. Pages which already exist in db are
+// skipped. It returns the names of the pages which were imported.
+func Import(r io.Reader, db pages.Persister, actorFor func(pages.Page) (*activitypub.Actor, error)) ([]string, error) {
+	var imported []string
+	err := ReadDump(r, func(p Page) error {
+		if p.Namespace != 0 || p.Redirect != nil || len(p.Revisions) == 0 {
+			return nil
+		}
+		name := PageName(p.Title)
+		if name == "" {
+			return nil
+		}
+		if _, err := db.GetPage(name); err == nil {
+			return nil
+		}
+		sort.SliceStable(p.Revisions, func(i, j int) bool {
+			return p.Revisions[i].Timestamp.Before(p.Revisions[j].Timestamp)
+		})
+
+		var actor *activitypub.Actor
+		for _, rev := range p.Revisions {
+			page := pages.Page{
+				PageName: name,
+				Title:    p.Title,
+				Content:  ToMarkdown(rev.Text),
+			}
+			if actor == nil {
+				a, err := actorFor(page)
+				if err != nil {
+					return fmt.Errorf("%s: %v", name, err)
+				}
+				actor = a
+			}
+			edittime := rev.Timestamp
+			if _, err := db.SavePageRevision(page, *actor, pages.Revision{
+				PageName: name,
+				Editor:   rev.Editor(),
+				EditTime: &edittime,
+			}); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		imported = append(imported, name)
+		return nil
+	})
+	return imported, err
+}
@@ -0,0 +1,192 @@
+package mediawiki
+
+import (
+	"regexp"
+	"strings"
+
+	"fediwiki/pages"
+)
+
+var (
+	commentRe    = regexp.MustCompile(`(?s)<!--.*?-->`)
+	refRe        = regexp.MustCompile(`(?s)<ref[^>/]*>.*?</ref>|<ref[^>]*/>|<references\s*/>`)
+	templateRe   = regexp.MustCompile(`\{\{[^{}]*\}\}`)
+	headingRe    = regexp.MustCompile(`^(={1,6})\s*(.*?)\s*={1,6}\s*$`)
+	listRe       = regexp.MustCompile(`^([*#:;]+)\s*(.*)$`)
+	boldItalicRe = regexp.MustCompile(`'''''(.+?)'''''`)
+	boldRe       = regexp.MustCompile(`'''(.+?)'''`)
+	italicRe     = regexp.MustCompile(`''(.+?)''`)
+	linkRe       = regexp.MustCompile(`\[\[([^\[\]|]+)(?:\|([^\[\]]*))?\]\]`)
+	extLinkRe    = regexp.MustCompile(`\[((?:https?|ftp)://[^\s\]]+)(?:\s+([^\]]*))?\]`)
+	alphaRe      = regexp.MustCompile(`^[[:alpha:]]+$`)
+	brRe         = regexp.MustCompile(`(?i)<br\s*/?>`)
+)
+
+// ToMarkdown converts MediaWiki wikitext to the Markdown dialect used
+// by the wiki. Only the common subset of wikitext is understood. Templates,
+// references and categories have no equivalent and are dropped.
+func ToMarkdown(wikitext string) string {
+	text := strings.Replace(wikitext, "\r\n", "\n", -1)
+	text = commentRe.ReplaceAllString(text, "")
+	text = refRe.ReplaceAllString(text, "")
+	// Templates can be nested, so remove the innermost ones until
+	// there are none left.
+	for {
+		stripped := templateRe.ReplaceAllString(text, "")
+		if stripped == text {
+			break
+		}
+		text = stripped
+	}
+
+	var out []string
+	lines := strings.Split(text, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, "{|"):
+			var table []string
+			for ; i < len(lines) && !strings.HasPrefix(lines[i], "|}"); i++ {
+				table = append(table, lines[i])
+			}
+			out = append(out, convertTable(table)...)
+		case strings.HasPrefix(line, "----"):
+			out = append(out, "---")
+		case headingRe.MatchString(line):
+			m := headingRe.FindStringSubmatch(line)
+			out = append(out, strings.Repeat("#", len(m[1]))+" "+convertInline(m[2]))
+		case listRe.MatchString(line):
+			m := listRe.FindStringSubmatch(line)
+			out = append(out, convertListItem(m[1], convertInline(m[2])))
+		case strings.HasPrefix(line, " ") && strings.TrimSpace(line) != "":
+			// Preformatted text
+			out = append(out, "    "+line[1:])
+		default:
+			out = append(out, convertInline(line))
+		}
+	}
+	return strings.TrimSpace(strings.Join(out, "\n")) + "\n"
+}
+
+func convertListItem(markers, text string) string {
+	indent := strings.Repeat("    ", len(markers)-1)
+	switch markers[len(markers)-1] {
+	case '#':
+		return indent + "1. " + text
+	case ':':
+		if len(markers) == 1 {
+			return "> " + text
+		}
+		return indent + text
+	case ';':
+		return indent + "**" + text + "**"
+	default:
+		return indent + "- " + text
+	}
+}
+
+func convertInline(line string) string {
+	line = brRe.ReplaceAllString(line, "  \n")
+	line = boldItalicRe.ReplaceAllString(line, "***$1***")
+	line = boldRe.ReplaceAllString(line, "**$1**")
+	line = italicRe.ReplaceAllString(line, "*$1*")
+	line = linkRe.ReplaceAllStringFunc(line, func(link string) string {
+		m := linkRe.FindStringSubmatch(link)
+		target, label := strings.TrimSpace(m[1]), m[2]
+		if i := strings.Index(target, ":"); i > 0 {
+			switch strings.ToLower(target[:i]) {
+			case "category", "file", "image", "media":
+				return ""
+			}
+		}
+		var fragment string
+		if i := strings.Index(target, "#"); i >= 0 {
+			target, fragment = target[:i], target[i:]
+		}
+		explicitLabel := label != ""
+		if !explicitLabel {
+			label = strings.TrimSpace(m[1])
+		}
+		if target == "" {
+			return "[" + label + "](" + fragment + ")"
+		}
+		name := PageName(target)
+		if alphaRe.MatchString(name) && fragment == "" && (!explicitLabel || label == name) {
+			// The wiki understands [[Name]] links itself
+			return "[[" + name + "]]"
+		}
+		return "[" + label + "](" + pages.Root + name + fragment + ")"
+	})
+	line = extLinkRe.ReplaceAllStringFunc(line, func(link string) string {
+		m := extLinkRe.FindStringSubmatch(link)
+		if m[2] == "" {
+			return "<" + m[1] + ">"
+		}
+		return "[" + m[2] + "](" + m[1] + ")"
+	})
+	return line
+}
+
+// convertTable converts a table in wikitext table syntax to a Markdown
+// table. The first row is used as the header, since Markdown tables
+// require one.
+func convertTable(lines []string) []string {
+	var rows [][]string
+	var row []string
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "|+"):
+			// Caption, no equivalent
+		case strings.HasPrefix(line, "|-"):
+			if row != nil {
+				rows = append(rows, row)
+			}
+			row = nil
+		case strings.HasPrefix(line, "!"):
+			for _, cell := range strings.Split(line[1:], "!!") {
+				row = append(row, tableCell(cell))
+			}
+		case strings.HasPrefix(line, "|"):
+			for _, cell := range strings.Split(line[1:], "||") {
+				row = append(row, tableCell(cell))
+			}
+		case len(row) > 0:
+			// Continuation of a multiline cell
+			row[len(row)-1] += " " + convertInline(line)
+		}
+	}
+	if row != nil {
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	columns := 0
+	for _, r := range rows {
+		if len(r) > columns {
+			columns = len(r)
+		}
+	}
+	var out []string
+	for i, r := range rows {
+		for len(r) < columns {
+			r = append(r, "")
+		}
+		out = append(out, "| "+strings.Join(r, " | ")+" |")
+		if i == 0 {
+			out = append(out, "|"+strings.Repeat(" --- |", columns))
+		}
+	}
+	return out
+}
+
+func tableCell(cell string) string {
+	// Cells may have attributes, separated from the content by a
+	// single pipe.
+	if i := strings.Index(cell, "|"); i >= 0 && !strings.Contains(cell[:i], "[[") {
+		cell = cell[i+1:]
+	}
+	return strings.Replace(convertInline(strings.TrimSpace(cell)), "|", `\|`, -1)
+}
@@ -0,0 +1,101 @@
+package mediawiki
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestToMarkdown(t *testing.T) {
+	tests := []struct {
+		Input string
+		Want  string
+	}{
+		{"== Heading ==", "## Heading\n"},
+		{"'''bold''' and ''italic''", "**bold** and *italic*\n"},
+		{"See [[Foo]]", "See [[Foo]]\n"},
+		{"See [[foo]]", "See [[Foo]]\n"},
+		{"See [[Foo bar|the page]]", "See [the page](/pages/Foo_bar)\n"},
+		{"See [[Foo#History]]", "See [Foo#History](/pages/Foo#History)\n"},
+		{"[[Category:Stuff]]Text", "Text\n"},
+		{"[https://example.com Example] and [https://example.org]", "[Example](https://example.com) and <https://example.org>\n"},
+		{"* one\n** two\n# three", "- one\n    - two\n1. three\n"},
+		{"{{Infobox|name={{nested}}}}Text<!-- hidden -->", "Text\n"},
+		{"Fact.<ref>Source</ref>", "Fact.\n"},
+		{"{|\n! A !! B\n|-\n| 1 || 2\n|}", "| A | B |\n| --- | --- |\n| 1 | 2 |\n"},
+	}
+	for _, tc := range tests {
+		if got := ToMarkdown(tc.Input); got != tc.Want {
+			t.Errorf("ToMarkdown(%q): want %q got %q", tc.Input, tc.Want, got)
+		}
+	}
+}
+
+const testDump = `<mediawiki xmlns="http://www.mediawiki.org/xml/export-0.10/" version="0.10">
+  <page>
+    <title>Main Page</title>
+    <ns>0</ns>
+    <revision>
+      <id>2</id>
+      <timestamp>2021-02-03T04:05:06Z</timestamp>
+      <contributor><ip>127.0.0.1</ip></contributor>
+      <text xml:space="preserve">second</text>
+    </revision>
+    <revision>
+      <id>1</id>
+      <timestamp>2020-02-03T04:05:06Z</timestamp>
+      <contributor><username>Bob</username><id>1</id></contributor>
+      <text xml:space="preserve">first</text>
+    </revision>
+  </page>
+  <page>
+    <title>Talk:Main Page</title>
+    <ns>1</ns>
+    <revision><timestamp>2020-02-03T04:05:06Z</timestamp><text>talk</text></revision>
+  </page>
+</mediawiki>`
+
+func TestReadDump(t *testing.T) {
+	var result []Page
+	if err := ReadDump(strings.NewReader(testDump), func(p Page) error {
+		result = append(result, p)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 {
+		t.Fatalf("Unexpected number of pages: want 2 got %v", len(result))
+	}
+	if name := PageName(result[0].Title); name != "Main_Page" {
+		t.Errorf("Unexpected page name: want Main_Page got %v", name)
+	}
+	if len(result[0].Revisions) != 2 {
+		t.Fatalf("Unexpected number of revisions: want 2 got %v", len(result[0].Revisions))
+	}
+	rev := result[0].Revisions[1]
+	if rev.Editor() != "Bob" || rev.Text != "first" || !rev.Timestamp.Equal(time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)) {
+		t.Errorf("Unexpected revision %v", rev)
+	}
+	if result[0].Revisions[0].Editor() != "127.0.0.1" {
+		t.Errorf("Unexpected anonymous editor %v", result[0].Revisions[0].Editor())
+	}
+}
+
+func TestPageName(t *testing.T) {
+	tests := []struct {
+		Input string
+		Want  string
+	}{
+		{"foo bar", "Foo_bar"},
+		{" Foo/Sub ", "Foo_Sub"},
+		{"état", "État"},
+		{"ßtraße", "ßtraße"},
+		{"日本", "日本"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := PageName(test.Input); got != test.Want {
+			t.Errorf("PageName(%q) = %q, want %q", test.Input, got, test.Want)
+		}
+	}
+}
@@ -1,32 +1,43 @@
 package outbox
 
 import (
+	"fmt"
 	"io"
 	"log"
 
 	"encoding/json"
 
-	"net/http"
-
 	"fediwiki/activitypub"
+	"fediwiki/httpsig"
 )
 
+// GetActor returns the actor with the given id, fetching it if it isn't
+// cached or the cached copy is stale. If it can't be fetched, a stale copy
+// is returned.
 func GetActor(cachedb activitypub.ActorDatabase, actorid string) (*activitypub.Actor, error) {
-	if actor, err := cachedb.GetForeignActor(actorid); err == nil {
+	cached, err := cachedb.GetForeignActor(actorid)
+	if err == nil && !cachedb.IsActorStale(actorid) {
 		log.Println("Got actor from cache")
-		return actor, nil
+		return cached, nil
 	}
-
-	req, err := http.NewRequest("GET", actorid, nil)
-	if err != nil {
-		return nil, err
+	actor, err := FetchActor(cachedb, actorid)
+	if err != nil && cached != nil {
+		log.Printf("Could not refresh %v: %v\n", actorid, err)
+		return cached, nil
 	}
-	req.Header.Add("Accept", `application/ld+json; profile="https://www.w3.org/ns/activitystreams", application/ld+json, application/activity+json`)
-	resp, err := http.DefaultClient.Do(req)
+	return actor, err
+}
+
+// FetchActor fetches the actor with the given id and caches it.
+func FetchActor(cachedb activitypub.ActorDatabase, actorid string) (*activitypub.Actor, error) {
+	resp, err := httpsig.Get(actorid, `application/ld+json; profile="https://www.w3.org/ns/activitystreams", application/ld+json, application/activity+json`)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Could not fetch %v: %v", actorid, resp.Status)
+	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -36,6 +47,9 @@ func GetActor(cachedb activitypub.ActorDatabase, actorid string) (*activitypub.A
 	if err := json.Unmarshal(body, &actor); err != nil {
 		return nil, err
 	}
+	if actor.Id != actorid {
+		return nil, fmt.Errorf("Fetched %v but got %v", actorid, actor.Id)
+	}
 	if err := cachedb.StoreActor(actor, body); err != nil {
 		// we unmarshalled it so don't return the error
 		// from caching it, just print it
@@ -0,0 +1,43 @@
+package outbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"fediwiki/activitypub"
+	"fediwiki/httpsig"
+)
+
+// FetchArticle fetches the Article representing a page on another wiki.
+func FetchArticle(url string) (*activitypub.Article, error) {
+	resp, err := httpsig.Get(url, `application/ld+json; profile="https://www.w3.org/ns/activitystreams", application/ld+json, application/activity+json`)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Could not fetch %v: %v", url, resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var article activitypub.Article
+	if err := json.Unmarshal(body, &article); err != nil {
+		return nil, err
+	}
+	if article.Type != "Article" {
+		return nil, fmt.Errorf("%v is a %v, not an Article", url, article.Type)
+	}
+	// Otherwise a page could claim to be any other page, and be
+	// linked to as its origin.
+	if article.Id != url {
+		return nil, fmt.Errorf("%v claims to be %v", url, article.Id)
+	}
+	if article.AttributedTo == "" {
+		return nil, fmt.Errorf("%v has no page actor", url)
+	}
+	return &article, nil
+}
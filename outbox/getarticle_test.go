@@ -0,0 +1,38 @@
+package outbox
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"fediwiki/activitypub"
+	"fediwiki/httpsig"
+)
+
+func TestFetchArticle(t *testing.T) {
+	var article activitypub.Article
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(article)
+	}))
+	defer server.Close()
+	defaultClient := httpsig.Client
+	httpsig.Client = server.Client()
+	defer func() { httpsig.Client = defaultClient }()
+
+	url := server.URL + "/pages/Foo"
+	article.Id = url
+	article.Type = "Article"
+	article.AttributedTo = url + "/actor"
+	if fetched, err := FetchArticle(url); err != nil || fetched.Id != url {
+		t.Errorf("Expected article %v, got %v %v", url, fetched, err)
+	}
+
+	// A page on one server can't claim to be a page anywhere else.
+	for _, id := range []string{"https://example.com/pages/Foo", "javascript:alert(1)", ""} {
+		article.Id = id
+		if _, err := FetchArticle(url); err == nil {
+			t.Errorf("Expected error for article with id %q", id)
+		}
+	}
+}
@@ -1,48 +1,177 @@
 package outbox
 
 import (
-	// "fmt"
 	"bytes"
 	"crypto"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/go-fed/httpsig"
 
 	"fediwiki/activitypub"
+	signatures "fediwiki/httpsig"
 	"fediwiki/pages"
 )
 
+// Send delivers obj from the page's actor to toactor's inbox.
 func Send(pagesdb pages.PagesDatabase, frompage string, toactor activitypub.Actor, obj activitypub.Object) error {
+	return send(pagesdb, frompage, toactor.Inbox, obj)
+}
+
+// Deliver sends obj from the page's actor to each of the recipients. Only
+// one copy is POSTed to each inbox, so recipients on the same server which
+// has a shared inbox only get one copy. Delivery to every inbox is
+// attempted even if some fail, and the first error is returned.
+func Deliver(pagesdb pages.PagesDatabase, frompage string, recipients []activitypub.Actor, obj activitypub.Object) error {
+	var firsterr error
+	for _, inbox := range deliveryInboxes(recipients) {
+		if err := send(pagesdb, frompage, inbox, obj); err != nil {
+			log.Printf("Could not deliver %v to %v: %v\n", obj.Id, inbox, err)
+			if firsterr == nil {
+				firsterr = err
+			}
+		}
+	}
+	return firsterr
+}
+
+// SendFrom delivers obj to toactor's inbox, signed by an actor other than
+// a page, such as the instance actor.
+func SendFrom(from activitypub.Actor, privkey crypto.PrivateKey, toactor activitypub.Actor, obj activitypub.Object) error {
+	key := signingKey{Id: from.PublicKey.Id, Private: privkey}
+	return sendSigned(key, key, toactor.Inbox, obj)
+}
+
+// deliveryInboxes returns the unique inboxes to deliver to for recipients.
+func deliveryInboxes(recipients []activitypub.Actor) []string {
+	var inboxes []string
+	seen := make(map[string]bool)
+	for _, actor := range recipients {
+		inbox := actor.DeliveryInbox()
+		if inbox == "" || seen[inbox] {
+			continue
+		}
+		seen[inbox] = true
+		inboxes = append(inboxes, inbox)
+	}
+	return inboxes
+}
+
+// cavageHosts remembers the hosts which rejected an RFC 9421 signature
+// but accepted a draft-cavage one, so that we don't knock twice on every
+// delivery to them.
+var cavageHosts = struct {
+	sync.Mutex
+	hosts map[string]bool
+}{hosts: make(map[string]bool)}
+
+func prefersCavage(host string) bool {
+	cavageHosts.Lock()
+	defer cavageHosts.Unlock()
+	return cavageHosts.hosts[host]
+}
+
+// rejectedSignature returns true if a response status means that the
+// remote server may not have understood the signature.
+func rejectedSignature(status int) bool {
+	return status == 400 || status == 401 || status == 403
+}
+
+// A signingKey is a private key and the id of its public key.
+type signingKey struct {
+	Id      string
+	Private crypto.PrivateKey
+}
+
+// send POSTs obj to the inbox, signed by the page's actor. The RFC 9421
+// signature is made with the actor's Ed25519 key if it has one.
+func send(pagesdb pages.PagesDatabase, frompage string, inbox string, obj activitypub.Object) error {
 	pageactor, privkey, err := pagesdb.GetPrivateKey(frompage)
 	if err != nil {
 		return err
 	}
-	req, err := makeRequest(toactor, obj.RawBytes)
+	rsakey := signingKey{Id: pageactor.PublicKey.Id, Private: privkey}
+	rfc9421key := rsakey
+	if keyid, edkey, err := pagesdb.GetAssertionKey(frompage); err == nil {
+		rfc9421key = signingKey{Id: keyid, Private: edkey}
+	}
+	return sendSigned(rfc9421key, rsakey, inbox, obj)
+}
+
+// sendSigned POSTs obj to the inbox. It first tries an RFC 9421 signature
+// made with rfc9421key and falls back to a draft-cavage one made with
+// the RSA key cavagekey if the remote server rejects it ("double
+// knocking").
+func sendSigned(rfc9421key, cavagekey signingKey, inbox string, obj activitypub.Object) error {
+	req, err := makeInboxRequest(inbox, obj.RawBytes)
 	if err != nil {
 		return err
 	}
+	host := req.URL.Host
+	if !prefersCavage(host) {
+		if err := signatures.SignRFC9421(req, obj.RawBytes, rfc9421key.Private, rfc9421key.Id); err != nil {
+			return err
+		}
+		status, err := post(req)
+		if err != nil {
+			return err
+		}
+		if !rejectedSignature(status) {
+			return checkStatus(inbox, status)
+		}
+		log.Printf("%v rejected RFC 9421 signature, retrying with draft-cavage\n", host)
+		req, err = makeInboxRequest(inbox, obj.RawBytes)
+		if err != nil {
+			return err
+		}
+	}
 
-	if err := signRequest(privkey, pageactor.PublicKey.Id, req, obj.RawBytes); err != nil {
+	if err := signRequest(cavagekey.Private, cavagekey.Id, req, obj.RawBytes); err != nil {
 		return err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	status, err := post(req)
 	if err != nil {
 		return err
 	}
+	if status >= 200 && status < 300 {
+		cavageHosts.Lock()
+		cavageHosts.hosts[host] = true
+		cavageHosts.Unlock()
+	}
+	return checkStatus(inbox, status)
+}
+
+func post(req *http.Request) (int, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
 	defer resp.Body.Close()
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
 		log.Println("Error", err)
 	}
 	log.Println(string(respBody))
+	return resp.StatusCode, nil
+}
+
+func checkStatus(inbox string, status int) error {
+	if status < 200 || status >= 300 {
+		return fmt.Errorf("Could not deliver to %v: status %d", inbox, status)
+	}
 	return nil
 }
 
 func makeRequest(toactor activitypub.Actor, body []byte) (*http.Request, error) {
-	req, err := http.NewRequest("POST", toactor.Inbox, bytes.NewBuffer(body))
+	return makeInboxRequest(toactor.Inbox, body)
+}
+
+func makeInboxRequest(inbox string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest("POST", inbox, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
 	}
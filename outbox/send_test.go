@@ -65,3 +65,22 @@ func TestSend(t *testing.T) {
 	t.Fail()
 }
 */
+
+func TestDeliveryInboxes(t *testing.T) {
+	shared := &activitypub.Endpoints{SharedInbox: "https://example.com/inbox"}
+	inboxes := deliveryInboxes([]activitypub.Actor{
+		{Id: "https://example.com/users/a", Inbox: "https://example.com/users/a/inbox", Endpoints: shared},
+		{Id: "https://example.com/users/b", Inbox: "https://example.com/users/b/inbox", Endpoints: shared},
+		{Id: "https://example.org/users/c", Inbox: "https://example.org/users/c/inbox"},
+		{Id: "https://example.org/users/d", Inbox: "https://example.org/users/d/inbox"},
+	})
+	expected := []string{"https://example.com/inbox", "https://example.org/users/c/inbox", "https://example.org/users/d/inbox"}
+	if len(inboxes) != len(expected) {
+		t.Fatalf("Unexpected inboxes: got %v want %v", inboxes, expected)
+	}
+	for i := range expected {
+		if inboxes[i] != expected[i] {
+			t.Errorf("Unexpected inbox %d: got %v want %v", i, inboxes[i], expected[i])
+		}
+	}
+}
@@ -7,9 +7,27 @@ import (
 )
 
 type PagesDatabase interface {
+	ProposalDatabase
+
 	GetPageActor(page string) (*activitypub.Actor, error)
 	NewPageActor(page Page, domain string, private crypto.PrivateKey, public crypto.PublicKey) (*activitypub.Actor, error)
 	GetPrivateKey(pagename string) (*activitypub.Actor, crypto.PrivateKey, error)
+	// GetAssertionKey returns the id and private key of the Ed25519 key
+	// in the page actor's assertionMethod, which RFC 9421 signatures are
+	// made with. Actors created before they had one don't have one
+	// until their keys are rotated.
+	GetAssertionKey(pagename string) (keyid string, private crypto.PrivateKey, err error)
+	// RotatePageKey replaces the page actor's keypair and returns the
+	// updated actor.
+	RotatePageKey(pagename string, private crypto.PrivateKey, public crypto.PublicKey) (*activitypub.Actor, error)
+
+	// GetInstanceActor returns the actor representing the whole wiki
+	// and its private key.
+	GetInstanceActor() (*activitypub.Actor, crypto.PrivateKey, error)
+	NewInstanceActor(domain string, private crypto.PrivateKey, public crypto.PublicKey) (*activitypub.Actor, error)
 
 	GetPageFollowers(pagename string, knownactors activitypub.ActorDatabase) ([]activitypub.Actor, error)
+	// GetPageFollowRequests returns the Follow activities which have
+	// been accepted and not undone for pagename.
+	GetPageFollowRequests(pagename string) ([]activitypub.Follow, error)
 }
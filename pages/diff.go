@@ -1,13 +1,17 @@
 package pages
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
 const posixDiff = "diff"
+const posixPatch = "patch"
 
 func (p1 Page) Diff(p2 *Page) (string, error) {
 	t1, err := os.CreateTemp("", "wikipage")
@@ -113,3 +117,115 @@ func (p1 Page) Diff(p2 *Page) (string, error) {
 	}
 	return buf.String(), nil
 }
+
+// gitHeaders are the extended header lines of git diffs, which can
+// rename, copy or change the mode of files rather than just their content.
+var gitHeaders = []string{"diff --git ", "index ", "old mode ", "new mode ", "deleted file mode ", "new file mode ", "similarity index ", "dissimilarity index ", "rename from ", "rename to ", "copy from ", "copy to ", "GIT binary patch", "Binary files "}
+
+var hunkHeader = regexp.MustCompile(`^@@ -\d+(?:,(\d+))? \+\d+(?:,(\d+))? @@`)
+
+// checkPatch returns an error unless patch is a unified diff of a single
+// file. patch applies every hunk of a multi-file diff to the output file
+// it's given, so those must be rejected before it sees them.
+func checkPatch(patch string) error {
+	var headers int
+	lines := strings.Split(patch, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		for _, h := range gitHeaders {
+			if strings.HasPrefix(line, h) {
+				return fmt.Errorf("Patch has unsupported header %q", line)
+			}
+		}
+		switch {
+		case strings.HasPrefix(line, "--- "):
+			if i+1 >= len(lines) || !strings.HasPrefix(lines[i+1], "+++ ") {
+				return fmt.Errorf("Malformed patch header %q", line)
+			}
+			headers++
+			i++
+		case strings.HasPrefix(line, "+++ "):
+			return fmt.Errorf("Malformed patch header %q", line)
+		case strings.HasPrefix(line, "@@ "):
+			if headers == 0 {
+				return fmt.Errorf("Patch hunk before file header")
+			}
+			match := hunkHeader.FindStringSubmatch(line)
+			if match == nil {
+				return fmt.Errorf("Malformed hunk header %q", line)
+			}
+			oldLines, newLines := 1, 1
+			if match[1] != "" {
+				oldLines, _ = strconv.Atoi(match[1])
+			}
+			if match[2] != "" {
+				newLines, _ = strconv.Atoi(match[2])
+			}
+			// Skip over the hunk, since its lines may look like
+			// headers.
+			for (oldLines > 0 || newLines > 0) && i+1 < len(lines) {
+				i++
+				hunkline := lines[i]
+				switch {
+				case strings.HasPrefix(hunkline, " ") || hunkline == "":
+					oldLines--
+					newLines--
+				case strings.HasPrefix(hunkline, "-"):
+					oldLines--
+				case strings.HasPrefix(hunkline, "+"):
+					newLines--
+				case strings.HasPrefix(hunkline, "\\"):
+				default:
+					return fmt.Errorf("Malformed hunk line %q", hunkline)
+				}
+			}
+			if oldLines != 0 || newLines != 0 {
+				return fmt.Errorf("Truncated patch hunk %q", line)
+			}
+		}
+	}
+	if headers != 1 {
+		return fmt.Errorf("Patch must change exactly one file, got %d", headers)
+	}
+	return nil
+}
+
+// ApplyPatch returns a copy of the page with a unified diff applied to
+// its content.
+func (p Page) ApplyPatch(patch string) (Page, error) {
+	orig, err := os.CreateTemp("", "wikipage")
+	if err != nil {
+		return p, err
+	}
+	defer os.Remove(orig.Name())
+	defer orig.Close()
+	out, err := os.CreateTemp("", "wikipage")
+	if err != nil {
+		return p, err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	if _, err := io.WriteString(orig, p.Content+"\n"); err != nil {
+		return p, err
+	}
+
+	if err := checkPatch(patch); err != nil {
+		return p, err
+	}
+	// -u makes sure that the patch is only interpreted as a unified
+	// diff, and never as an ed script which could run commands.
+	var output strings.Builder
+	patchcmd := exec.Command(posixPatch, "-u", "-s", "-f", "-r", "-", "-o", out.Name(), orig.Name())
+	patchcmd.Stdin = strings.NewReader(patch)
+	patchcmd.Stdout = &output
+	patchcmd.Stderr = &output
+	if err := patchcmd.Run(); err != nil {
+		return p, fmt.Errorf("Patch does not apply: %v %v", err, output.String())
+	}
+	content, err := io.ReadAll(out)
+	if err != nil {
+		return p, err
+	}
+	p.Content = strings.TrimSuffix(string(content), "\n")
+	return p, nil
+}
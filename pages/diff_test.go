@@ -0,0 +1,80 @@
+package pages
+
+import (
+	"testing"
+)
+
+func TestApplyPatch(t *testing.T) {
+	page := Page{PageName: "Foo", Title: "Foo", Content: "hello\nworld"}
+	tests := []struct {
+		Name    string
+		Patch   string
+		Want    string
+		WantErr bool
+	}{
+		{
+			"valid",
+			"--- Old Content\n+++ New Content\n@@ -1,2 +1,2 @@\n hello\n-world\n+there\n",
+			"hello\nthere",
+			false,
+		},
+		{
+			"removes a line that looks like a header",
+			"--- a\n+++ b\n@@ -1,2 +1,3 @@\n hello\n+-- x\n world\n",
+			"hello\n-- x\nworld",
+			false,
+		},
+		{
+			"does not apply",
+			"--- Old Content\n+++ New Content\n@@ -1,2 +1,2 @@\n hello\n-everyone\n+there\n",
+			"",
+			true,
+		},
+		{
+			"two files",
+			"--- a\n+++ a\n@@ -1 +1,2 @@\n+pwned\n hello\n--- b\n+++ b\n@@ -1 +1,2 @@\n+bye\n hello\n",
+			"",
+			true,
+		},
+		{
+			"git rename",
+			"diff --git a/x b/y\nrename from x\nrename to y\n--- a/x\n+++ b/y\n@@ -1 +1 @@\n-hello\n+bye\n",
+			"",
+			true,
+		},
+		{
+			"missing header",
+			"@@ -1 +1 @@\n-hello\n+bye\n",
+			"",
+			true,
+		},
+		{
+			"truncated hunk",
+			"--- a\n+++ b\n@@ -1,2 +1,2 @@\n hello\n",
+			"",
+			true,
+		},
+		{
+			"malformed",
+			"--- a\nnot a patch\n",
+			"",
+			true,
+		},
+	}
+	for _, tc := range tests {
+		patched, err := page.ApplyPatch(tc.Patch)
+		if tc.WantErr {
+			if err == nil {
+				t.Errorf("%v: expected error, got %q", tc.Name, patched.Content)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tc.Name, err)
+			continue
+		}
+		if patched.Content != tc.Want {
+			t.Errorf("%v: got %q want %q", tc.Name, patched.Content, tc.Want)
+		}
+	}
+}
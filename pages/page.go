@@ -1,7 +1,10 @@
 package pages
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"html"
 	"os"
 	"regexp"
 	"time"
@@ -23,11 +26,19 @@ type Revision struct {
 	RevisionID string
 	Editor     string
 	EditTime   *time.Time
+	// Origin is the URL of the page on another wiki that the revision
+	// was copied from, if it wasn't edited here.
+	Origin string
 }
 
 type Persister interface {
 	GetPage(pagename string) (*Page, error)
 	SavePage(page Page, pageactor activitypub.Actor, editor string) (*Revision, error)
+	// SavePageRevision saves page as a new revision, using the editor
+	// and edit time from rev instead of the current time. It's used
+	// when replaying history from elsewhere.
+	SavePageRevision(page Page, pageactor activitypub.Actor, rev Revision) (*Revision, error)
+	ListPages() ([]string, error)
 	GetPageRevisions(pagename string) ([]Revision, error)
 	GetPageRevision(pagename, revisionid string) (*Page, error)
 	GetPageRevisionParent(pagename, revisionid string) (*Page, error)
@@ -55,6 +66,66 @@ func (r Revision) DiffNote(diff string) activitypub.Note {
 	return note
 }
 
+// Article returns the ActivityPub representation of the page, with
+// content being the rendered HTML of the page.
+func (p Page) Article(content string, published, updated *time.Time) activitypub.Article {
+	id := fmt.Sprintf("https://%s%s%s", os.Getenv("fediwikidomain"), Root, p.PageName)
+	return activitypub.Article{
+		BaseProperties: activitypub.BaseProperties{
+			Context: []interface{}{"https://www.w3.org/ns/activitystreams"},
+			Id:      id,
+			Type:    "Article",
+		},
+		Name:         p.Title,
+		Summary:      p.Summary,
+		Content:      content,
+		MediaType:    "text/html",
+		Source:       &activitypub.Source{Content: p.Content, MediaType: "text/markdown"},
+		Url:          id,
+		AttributedTo: fmt.Sprintf("https://%s%s%s/actor", os.Getenv("fediwikidomain"), Root, p.PageName),
+		Published:    published,
+		Updated:      updated,
+	}
+}
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// PageFromArticle returns the page represented by an Article from another
+// wiki. The markdown source is used if the Article has it, otherwise the
+// HTML content is converted to plain text.
+func PageFromArticle(pagename string, article activitypub.Article) Page {
+	content := article.Content
+	if article.Source != nil && article.Source.MediaType == "text/markdown" {
+		content = article.Source.Content
+	} else {
+		content = html.UnescapeString(htmlTag.ReplaceAllString(content, ""))
+	}
+	return Page{
+		PageName: pagename,
+		Title:    article.Name,
+		Summary:  article.Summary,
+		Content:  content,
+	}
+}
+
+// Version returns a hash of the page's title, summary and content, which
+// identifies the version of the page regardless of its name.
+func (p Page) Version() string {
+	sum := sha256.Sum256([]byte(p.Title + "\x00" + p.Summary + "\x00" + p.Content))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetPageNameFromObjectId returns the page and revision of a page's
+// Article or a revision's diff note. revision is empty for Articles.
+func GetPageNameFromObjectId(url string) (pagename, revision string, err error) {
+	re := regexp.MustCompile("^https://" + regexp.QuoteMeta(os.Getenv("fediwikidomain")+Root) + "([^/]+)(?:/history/([^/]+)/diff)?$")
+	matches := re.FindStringSubmatch(url)
+	if matches == nil {
+		return "", "", fmt.Errorf("Unknown object %s", url)
+	}
+	return matches[1], matches[2], nil
+}
+
 func GetPageNameFromActorId(url string) (string, error) {
 	re := regexp.MustCompile("https://" + os.Getenv("fediwikidomain") + "/pages/(.+)/actor")
 	matches := re.FindStringSubmatch(url)
@@ -65,3 +136,20 @@ func GetPageNameFromActorId(url string) (string, error) {
 	return matches[1], nil
 
 }
+
+// NoteId returns the id of a note posted to the page's talk page from
+// this wiki.
+func NoteId(pagename, id string) string {
+	return fmt.Sprintf("https://%s%s%s/talk/%s", os.Getenv("fediwikidomain"), Root, pagename, id)
+}
+
+// GetPageNameFromNoteId returns the page that a note posted from this wiki
+// was posted to.
+func GetPageNameFromNoteId(url string) (string, error) {
+	re := regexp.MustCompile("^https://" + regexp.QuoteMeta(os.Getenv("fediwikidomain")+Root) + "([^/]+)/talk/[^/]+$")
+	matches := re.FindStringSubmatch(url)
+	if matches == nil {
+		return "", fmt.Errorf("Unknown note %s", url)
+	}
+	return matches[1], nil
+}
@@ -0,0 +1,63 @@
+package pages
+
+import (
+	"time"
+)
+
+// The status of a proposal.
+const (
+	ProposalOpen     = "open"
+	ProposalAccepted = "accepted"
+	ProposalRejected = "rejected"
+)
+
+// A Proposal is a change to a page which was suggested by someone who
+// can't edit it directly, such as the upstream page of a fork, and is
+// waiting for an editor to merge or reject it.
+type Proposal struct {
+	Id       string
+	PageName string
+	// Actor is the id of the actor who proposed the change.
+	Actor string
+	// Activity is the id of the activity the proposal arrived in.
+	Activity string
+	// Origin is the URL of the page on another wiki that the change
+	// was copied from, if any.
+	Origin string
+	// Parent is the revision of the page the proposal was made
+	// against.
+	Parent  string
+	Summary string
+	Page    Page
+	Created time.Time
+	Status  string
+	// Offer is true if the proposal arrived in an Offer, which is
+	// answered with an Accept or Reject once it's decided.
+	Offer bool
+}
+
+type ProposalDatabase interface {
+	// AddProposal saves a new open proposal and returns it with its Id
+	// set.
+	AddProposal(proposal Proposal) (*Proposal, error)
+	// GetProposals returns every proposal for the page, oldest first.
+	GetProposals(pagename string) ([]Proposal, error)
+	GetProposal(pagename, id string) (*Proposal, error)
+	SetProposalStatus(pagename, id, status string) error
+
+	// SetUpstream records that the page was forked from the Article
+	// with the given URL on another wiki, whose page actor is actor.
+	SetUpstream(pagename, actor, article string) error
+	// GetUpstream returns the page actor and Article URL of the page's
+	// upstream, or empty strings if it isn't a fork.
+	GetUpstream(pagename string) (actor, article string, err error)
+	// SetUpstreamVersion records the Version of the upstream page which
+	// was last seen, so that it isn't proposed again.
+	SetUpstreamVersion(pagename, version string) error
+	// GetUpstreamVersion returns the Version of the upstream page which
+	// was last seen, or an empty string if there isn't one.
+	GetUpstreamVersion(pagename string) (string, error)
+	// GetDownstreamPages returns the local pages forked from the
+	// upstream actor.
+	GetDownstreamPages(upstream string) ([]string, error)
+}